@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"gopkg.in/yaml.v3"
+)
+
+// Node settings. Each one is read, from lowest to highest precedence, from its default, the YAML config file
+// (named by -config or CONFIG_FILE), the environment variable named like its key in upper case and its flag.
+type Config struct {
+	Rendezvous          string `yaml:"rendezvous" flag:"rendezvous" usage:"Unique string to identify group of nodes. Share this with your friends to let them connect with you"`
+	ProtocolID          string `yaml:"protocol_id" flag:"pid" usage:"Sets a protocol id for stream headers"`
+	ListenHost          string `yaml:"listen_host" flag:"host" usage:"The bootstrap node host listen address"`
+	ListenPort          int    `yaml:"listen_port" flag:"port" usage:"node listen port"`
+	Peers               string `yaml:"peers" flag:"peers" usage:"Comma separated multiaddrs of peers to connect to, redialed while disconnected"`
+	MDNS                bool   `yaml:"mdns" flag:"mdns" usage:"Discover peers on the local network"`
+	HTTPAddr            string `yaml:"http_addr" flag:"http" usage:"Address of the HTTP server serving /rpc"`
+	GRPCAddr            string `yaml:"grpc_addr" flag:"grpc" usage:"Address workers connect to, nodes without workers ignore it"`
+	AttestationPolicy   string `yaml:"attestation_policy" flag:"policy" usage:"Attestation policy file narrowing the workers that may publish keys"`
+	UniqueID            string `yaml:"unique_id" flag:"unique-id" usage:"UniqueID of the workers that may publish keys when there is no attestation policy"`
+	AllowDebug          bool   `yaml:"allow_debug" flag:"allow-debug" usage:"Accept keys from debug enclaves with unique_id, a policy file sets this itself"`
+	SimulateAttestation bool   `yaml:"simulate_attestation" flag:"simulate" usage:"Accept simulated attestation reports instead of verifying them with EGo"`
+	GenesisFile         string `yaml:"genesis_file" flag:"genesis" usage:"Genesis file of the network"`
+	Bootstrap           string `yaml:"bootstrap" flag:"bootstrap" usage:"Snapshot to start a new chain from instead of syncing from genesis"`
+	Checkpoint          string `yaml:"checkpoint" flag:"checkpoint" usage:"Hash the bootstrap snapshot must match"`
+	DataDir             string `yaml:"data_dir" flag:"datadir" usage:"Directory holding the chain, keys, peerstore and logs"`
+	LogLevel            string `yaml:"log_level" flag:"log-level" usage:"Minimum level logged: debug, info, warn or error"`
+	LogFormat           string `yaml:"log_format" flag:"log-format" usage:"Log format: text or json"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Rendezvous: "meetme",
+		ProtocolID: "/chat/1.1.0",
+		ListenHost: "0.0.0.0",
+		ListenPort: 4001,
+		MDNS:       true,
+		HTTPAddr:   ":8080",
+		GRPCAddr:   "127.0.0.1:4002",
+		DataDir:    defaultDataDir(),
+		LogLevel:   "info",
+		LogFormat:  "text",
+	}
+}
+
+// A Config field with the names it is set by
+type setting struct {
+	key   string
+	flag  string
+	usage string
+	value reflect.Value
+}
+
+func (c *Config) settings() []setting {
+	v := reflect.ValueOf(c).Elem()
+	settings := make([]setting, v.NumField())
+	for i := range settings {
+		field := v.Type().Field(i)
+		settings[i] = setting{key: field.Tag.Get("yaml"), flag: field.Tag.Get("flag"), usage: field.Tag.Get("usage"), value: v.Field(i)}
+	}
+	return settings
+}
+
+func (s setting) env() string {
+	return strings.ToUpper(s.key)
+}
+
+func (s setting) String() string {
+	if !s.value.IsValid() {
+		return ""
+	}
+	return fmt.Sprint(s.value.Interface())
+}
+
+func (s setting) Set(raw string) error {
+	switch s.value.Kind() {
+	case reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		s.value.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		s.value.SetBool(b)
+	default:
+		s.value.SetString(raw)
+	}
+	return nil
+}
+
+func (s setting) IsBoolFlag() bool {
+	return s.value.Kind() == reflect.Bool
+}
+
+// Defaults, overridden by the config file and the environment. Subcommands start from this and add their own flags.
+func baseConfig(path string) (*Config, error) {
+	c := defaultConfig()
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		decoder := yaml.NewDecoder(f)
+		decoder.KnownFields(true)
+		if err := decoder.Decode(c); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	for _, s := range c.settings() {
+		if raw, ok := os.LookupEnv(s.env()); ok {
+			if err := s.Set(raw); err != nil {
+				return nil, fmt.Errorf("invalid %s %q: %w", s.env(), raw, err)
+			}
+		}
+	}
+	return c, nil
+}
+
+// Config of subcommands, which don't take the node's flags. Sets the data directory.
+func commandConfig() (*Config, error) {
+	c, err := baseConfig(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		return nil, err
+	}
+	return c, setDataDir(c.DataDir)
+}
+
+// Builds the node's config from all sources, flags are parsed from args. Returns flag.ErrHelp for -help.
+func loadConfig(name string, args []string) (*Config, error) {
+	// flags are parsed into their own config first, only the ones given override the other sources
+	flagged := defaultConfig()
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	path := flags.String("config", os.Getenv("CONFIG_FILE"), "YAML config file")
+	for _, s := range flagged.settings() {
+		flags.Var(s, s.flag, s.usage)
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	c, err := baseConfig(*path)
+	if err != nil {
+		return nil, err
+	}
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	settings := c.settings()
+	for i, s := range flagged.settings() {
+		if given[s.flag] {
+			settings[i].value.Set(s.value)
+		}
+	}
+	return c, c.validate()
+}
+
+func (c *Config) validate() error {
+	if c.Rendezvous == "" || c.ProtocolID == "" {
+		return errors.New("rendezvous and protocol_id must not be empty")
+	}
+	if net.ParseIP(c.ListenHost) == nil {
+		return fmt.Errorf("invalid listen_host %q", c.ListenHost)
+	}
+	if c.ListenPort < 1 || c.ListenPort > 65535 {
+		return fmt.Errorf("invalid listen_port %d", c.ListenPort)
+	}
+	if _, err := c.staticPeers(); err != nil {
+		return err
+	}
+	listen := net.JoinHostPort(c.ListenHost, strconv.Itoa(c.ListenPort))
+	for _, addr := range []string{c.HTTPAddr, c.GRPCAddr} {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid address %q: %w", addr, err)
+		}
+		if overlaps(addr, listen) {
+			return fmt.Errorf("address %q overlaps the listen address %s", addr, listen)
+		}
+	}
+	if overlaps(c.HTTPAddr, c.GRPCAddr) {
+		return fmt.Errorf("http_addr %q overlaps grpc_addr %q", c.HTTPAddr, c.GRPCAddr)
+	}
+	if c.UniqueID != "" && !isMeasurement(c.UniqueID) {
+		return fmt.Errorf("invalid unique_id %q", c.UniqueID)
+	}
+	if c.DataDir == "" {
+		return errors.New("data_dir must not be empty")
+	}
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		return err
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		return fmt.Errorf("invalid log_format %q", c.LogFormat)
+	}
+	if c.Bootstrap != "" && c.Checkpoint == "" {
+		return errors.New("bootstrap requires a checkpoint")
+	}
+	return nil
+}
+
+// node config dump [-config file] [flags]
+// Prints the config the node would run with.
+func runConfig(args []string) int {
+	if len(args) == 0 || args[0] != "dump" {
+		fmt.Fprintln(os.Stderr, "usage: node config dump [-config file] [flags]")
+		return 2
+	}
+	c, err := loadConfig("config dump", args[1:])
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	bytes, err := yaml.Marshal(c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	os.Stdout.Write(bytes)
+	return 0
+}
+
+func (c *Config) staticPeers() ([]peer.AddrInfo, error) {
+	peers := make([]peer.AddrInfo, 0)
+	for _, addr := range strings.Split(c.Peers, ",") {
+		if strings.TrimSpace(addr) == "" {
+			continue
+		}
+		p, err := peer.AddrInfoFromString(strings.TrimSpace(addr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer %q: %w", addr, err)
+		}
+		peers = append(peers, *p)
+	}
+	return peers, nil
+}
+
+// Whether two host:port addresses would bind the same port, an empty or unspecified host binds every interface
+func overlaps(a string, b string) bool {
+	hostA, portA, _ := net.SplitHostPort(a)
+	hostB, portB, _ := net.SplitHostPort(b)
+	if portA != portB {
+		return false
+	}
+	unspecified := func(host string) bool {
+		ip := net.ParseIP(host)
+		return host == "" || ip != nil && ip.IsUnspecified()
+	}
+	return unspecified(hostA) || unspecified(hostB) || hostA == hostB
+}
@@ -0,0 +1,586 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompetingMinersConverge(t *testing.T) {
+	s := newSimulation(t, 4, 1)
+	s.jitter = 200 * time.Millisecond
+	s.miner(s.nodes[0], 0, time.Minute, 3*time.Second)
+	s.miner(s.nodes[2], 0, time.Minute, 3*time.Second)
+	s.run(time.Minute)
+	// forks of equal work don't replace each other, one more block decides
+	s.mine(s.nodes[0])
+	s.run(time.Minute + 2*SIM_SYNC_INTERVAL)
+
+	s.assertConverged()
+	if s.tip(0).Index < 20 {
+		t.Fatalf("chain only reached block %d", s.tip(0).Index)
+	}
+}
+
+func TestSameHeightFork(t *testing.T) {
+	s := newSimulation(t, 2, 2)
+	a := s.mine(s.nodes[0])
+	b := s.mine(s.nodes[1])
+	s.run(2 * SIM_SYNC_INTERVAL)
+	if calculateWork(s.nodes[0].chain) == calculateWork(s.nodes[1].chain) {
+		// neither fork replaces the other
+		if s.tip(0).Hash != a.Hash || s.tip(1).Hash != b.Hash {
+			t.Fatal("a fork of equal work replaced the node's chain")
+		}
+	}
+	s.mine(s.nodes[1])
+	s.run(4 * SIM_SYNC_INTERVAL)
+	s.assertConverged()
+	if s.tip(0).Index != 2 {
+		t.Fatalf("tip is block %d, want 2", s.tip(0).Index)
+	}
+}
+
+func TestPartitionHeals(t *testing.T) {
+	s := newSimulation(t, 4, 3)
+	s.miner(s.nodes[0], 0, 10*time.Second, 2*time.Second)
+	s.run(10*time.Second + 2*SIM_SYNC_INTERVAL)
+	s.assertConverged()
+	shared := s.tip(0)
+
+	s.partition([]int{0, 1}, []int{2, 3})
+	s.miner(s.nodes[0], s.now, s.now+30*time.Second, 2*time.Second)
+	s.miner(s.nodes[2], s.now, s.now+30*time.Second, 6*time.Second)
+	s.run(s.now + 30*time.Second + 2*SIM_SYNC_INTERVAL)
+	if s.tip(0).Hash == s.tip(2).Hash {
+		t.Fatal("the partitions did not diverge")
+	}
+	if s.tip(0).Hash != s.tip(1).Hash || s.tip(2).Hash != s.tip(3).Hash {
+		t.Fatal("nodes within a partition did not converge")
+	}
+	heavier := s.tip(0)
+	if calculateWork(s.nodes[2].chain) > calculateWork(s.nodes[0].chain) {
+		heavier = s.tip(2)
+	}
+
+	s.heal()
+	s.run(s.now + 2*SIM_SYNC_INTERVAL)
+	s.assertConverged()
+	if s.tip(0).Hash != heavier.Hash {
+		t.Fatalf("nodes converged on block %d instead of the heavier partition's tip %d", s.tip(0).Index, heavier.Index)
+	}
+	if s.nodes[0].chain[shared.Index].Hash != shared.Hash {
+		t.Fatal("blocks mined before the partition were lost")
+	}
+}
+
+// A peer sending a chain with more work than the honest one, but an invalid block past the fork point
+func TestHeavierInvalidChainRejected(t *testing.T) {
+	unknown := sha256.Sum256([]byte("unknown enclave"))
+	tests := []struct {
+		name    string
+		reason  string
+		corrupt func(t *testing.T, parent Block, block Block) Block
+	}{
+		{"forged hash", "hash", func(t *testing.T, parent Block, block Block) Block {
+			// claims a lot of work without doing it
+			block.Hash = strings.Repeat("0", 60) + block.Hash[60:]
+			return block
+		}},
+		{"wrong parent", "prev_hash", func(t *testing.T, parent Block, block Block) Block {
+			block.PrevHash = strings.Repeat("0", 64)
+			return sealBlock(block)
+		}},
+		{"unknown enclave", "unknown_enclave", func(t *testing.T, parent Block, block Block) Block {
+			block.Proof = simulatedProof(t, parent.Hash, unknown[:])
+			return sealBlock(block)
+		}},
+		{"report bound to another block", "report_data", func(t *testing.T, parent Block, block Block) Block {
+			block.Proof = simulatedProof(t, genesisBlock.Hash, simulatedUniqueID(t))
+			return sealBlock(block)
+		}},
+		{"transactions replaced after sealing", "tx_root", func(t *testing.T, parent Block, block Block) Block {
+			block.Txs = encodeTxs([]Tx{signedTx(t, 1)})
+			return block
+		}},
+		{"transaction root replaced after sealing", "report_data", func(t *testing.T, parent Block, block Block) Block {
+			block.Txs = encodeTxs([]Tx{signedTx(t, 1)})
+			block.TxRoot = merkleRoot(txLeaves(blockTxs(block)))
+			return sealBlock(block)
+		}},
+		{"results replaced after sealing", "result_root", func(t *testing.T, parent Block, block Block) Block {
+			block.Results = encodeResults([]ResultCommitment{committedResult()})
+			return block
+		}},
+		{"result root replaced after sealing", "report_data", func(t *testing.T, parent Block, block Block) Block {
+			block.Results = encodeResults([]ResultCommitment{committedResult()})
+			block.ResultRoot = merkleRoot(commitmentLeaves(blockResults(block)))
+			return sealBlock(block)
+		}},
+		{"results committed twice", "results", func(t *testing.T, parent Block, block Block) Block {
+			results := encodeResults([]ResultCommitment{committedResult(), committedResult()})
+			block, err := simulatedBlock(parent, "", results, difficulty, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return block
+		}},
+		{"unsigned transaction", "txs", func(t *testing.T, parent Block, block Block) Block {
+			tx := signedTx(t, 1)
+			tx.Sig = ""
+			return sealedWith(t, parent, []Tx{tx})
+		}},
+		{"overdraft", "txs", func(t *testing.T, parent Block, block Block) Block {
+			return sealedWith(t, parent, []Tx{signedTx(t, 1)})
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newSimulation(t, 3, 4)
+			s.miner(s.nodes[0], 0, 20*time.Second, 2*time.Second)
+			s.run(20*time.Second + 2*SIM_SYNC_INTERVAL)
+			s.assertConverged()
+			honest := s.tip(0)
+
+			// the attacker forks off the honest chain and mines far ahead, one of its blocks is invalid
+			attack := append(Blockchain(nil), s.nodes[0].chain[:honest.Index/2+1]...)
+			for len(attack) < len(s.nodes[0].chain)+10 {
+				parent := attack[len(attack)-1]
+				block, err := simulatedBlock(parent, "", "", difficulty, s.rand.Uint32())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(attack) == honest.Index/2+2 {
+					block = test.corrupt(t, parent, block)
+				}
+				attack = append(attack, block)
+			}
+			if calculateWork(attack) <= calculateWork(s.nodes[0].chain) {
+				t.Fatal("attack chain is not heavier")
+			}
+			if _, err := forkChoice(s.nodes[0].chain, attack); err == nil || validationReason(err) != test.reason {
+				t.Fatalf("fork choice returned %v, want a %s rejection", err, test.reason)
+			}
+
+			for _, n := range s.nodes {
+				s.receive(n, attack)
+			}
+			s.run(s.now + 2*SIM_SYNC_INTERVAL)
+			s.assertConverged()
+			if s.tip(0).Hash != honest.Hash {
+				t.Fatalf("nodes left the honest tip %d for block %d", honest.Index, s.tip(0).Index)
+			}
+			for _, n := range s.nodes {
+				if n.rejected == 0 {
+					t.Fatalf("node %d did not reject the attack", n.id)
+				}
+			}
+		})
+	}
+}
+
+// A peer sending a heavier chain from another genesis block
+func TestForeignChainRejected(t *testing.T) {
+	s := newSimulation(t, 2, 5)
+	s.mine(s.nodes[0])
+	s.run(2 * SIM_SYNC_INTERVAL)
+
+	foreign := Blockchain{sealBlock(Block{Index: 0, Txs: "other network"})}
+	for i := 0; i < 10; i++ {
+		block, err := simulatedBlock(foreign[len(foreign)-1], "", "", difficulty, s.rand.Uint32())
+		if err != nil {
+			t.Fatal(err)
+		}
+		foreign = append(foreign, block)
+	}
+	if _, err := forkChoice(s.nodes[1].chain, foreign); err != errForeignChain {
+		t.Fatalf("fork choice returned %v, want %v", err, errForeignChain)
+	}
+	s.receive(s.nodes[1], foreign)
+	s.run(s.now + 2*SIM_SYNC_INTERVAL)
+	s.assertConverged()
+}
+
+func TestSimulationIsDeterministic(t *testing.T) {
+	run := func() Block {
+		s := newSimulation(t, 5, 42)
+		s.jitter = time.Second
+		s.partition([]int{0, 1, 2}, []int{3, 4})
+		for _, n := range s.nodes {
+			s.miner(n, 0, 40*time.Second, 4*time.Second)
+		}
+		s.at(20*time.Second, s.heal)
+		s.run(40 * time.Second)
+		return s.tip(4)
+	}
+	if a, b := run(), run(); a.Hash != b.Hash {
+		t.Fatalf("same seed ended on block %d %s and block %d %s", a.Index, a.Hash, b.Index, b.Hash)
+	}
+}
+
+func simulatedUniqueID(t *testing.T) []byte {
+	id, err := hex.DecodeString(SIMULATED_UNIQUE_ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// A transfer signed by a new account, which has no funds
+func signedTx(t *testing.T, amount int) Tx {
+	_, from, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := Tx{From: hex.EncodeToString(from.Public().(ed25519.PublicKey)), To: hex.EncodeToString(to), Amount: amount, Nonce: 1}
+	return signTx(tx, from)
+}
+
+// A node bootstrapped from a snapshot and a node synced from genesis adopt each other's heavier chains
+func TestBootstrappedNodeSyncs(t *testing.T) {
+	configureSimulatedNetwork(t)
+	extend := func(chain Blockchain, blocks int) Blockchain {
+		chain = append(Blockchain(nil), chain...)
+		for i := 0; i < blocks; i++ {
+			chain = append(chain, sealedWith(t, chain[len(chain)-1], nil))
+		}
+		return chain
+	}
+	full := extend(Blockchain{genesisBlock}, 5)
+	snapshot := takeSnapshot(full[:4])
+	// the bootstrapped node's chain starts at the snapshot's tip, it mines on top of it
+	bootstrapped := extend(full[3:], 4)
+
+	if _, err := forkChoice(full, bootstrapped); err != errForeignChain {
+		t.Fatalf("fork choice without the blocks before the snapshot returned %v", err)
+	}
+	received, ok := fromBase(anchorChain(full, bootstrapped))
+	if adopt, err := forkChoice(full, received); !ok || !adopt || err != nil {
+		t.Fatalf("the full node didn't adopt the bootstrapped node's chain: %v", err)
+	}
+	if !sameBlock(received[0], genesisBlock) || len(received) != 3+len(bootstrapped) {
+		t.Fatalf("adopted %d blocks from block %d, want the chain from genesis", len(received), received[0].Index)
+	}
+	if i, err := verifyChain(received); err != nil {
+		t.Fatalf("block %d of the adopted chain is invalid: %v", i, err)
+	}
+
+	full = extend(received, 2)
+	base = &snapshot
+	received, ok = fromBase(anchorChain(bootstrapped, full))
+	if adopt, err := forkChoice(bootstrapped, received); !ok || !adopt || err != nil {
+		t.Fatalf("the bootstrapped node didn't adopt the full node's chain: %v", err)
+	}
+	if received[0].Hash != snapshot.Tip.Hash || received[len(received)-1].Hash != full[len(full)-1].Hash {
+		t.Fatalf("adopted blocks %d to %d, want the snapshot's tip to the full node's tip", received[0].Index, received[len(received)-1].Index)
+	}
+}
+
+// An included transfer can't be included again, neither as it was nor with its signature written differently
+func TestTransferReplayRejected(t *testing.T) {
+	_, from, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := initialState(Blockchain{genesisBlock})
+	address := hex.EncodeToString(from.Public().(ed25519.PublicKey))
+	s.Balances[address] = 10
+	transfer := func(amount int, nonce uint64) Tx {
+		return signTx(Tx{From: address, To: hex.EncodeToString(to), Amount: amount, Nonce: nonce}, from)
+	}
+
+	tx := transfer(1, 5)
+	if err := s.applyTx(tx, 1); err != nil {
+		t.Fatal(err)
+	}
+	upper := tx
+	upper.Sig = strings.ToUpper(tx.Sig)
+	if calculateTxHash(upper) != calculateTxHash(tx) {
+		t.Fatal("the signature's encoding changes the transaction hash")
+	}
+	for _, test := range []struct {
+		name string
+		tx   Tx
+		want error
+	}{
+		{"same transfer", tx, errDuplicateTx},
+		{"uppercase signature", upper, errDuplicateTx},
+		{"lower nonce", transfer(2, 4), errStaleNonce},
+		{"same nonce", transfer(2, 5), errStaleNonce},
+	} {
+		if err := s.applyTx(test.tx, 2); !errors.Is(err, test.want) {
+			t.Errorf("%s: applyTx returned %v, want %v", test.name, err, test.want)
+		}
+	}
+	if err := verifyTx(upper); !errors.Is(err, errInvalidSignature) {
+		t.Errorf("verifyTx accepted a non-canonical signature: %v", err)
+	}
+	if err := s.applyTx(transfer(2, 6), 2); err != nil {
+		t.Fatalf("a higher nonce was rejected: %v", err)
+	}
+	if s.Balances[address] != 7 {
+		t.Fatalf("balance %d after both transfers, want 7", s.Balances[address])
+	}
+}
+
+// A block on top of parent sealed by the simulated enclave with the transactions
+func sealedWith(t *testing.T, parent Block, txs []Tx) Block {
+	block, err := simulatedBlock(parent, encodeTxs(txs), "", difficulty, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+// Governance transactions take effect in order of their activation heights, not in the order they were included
+func TestGovernanceActivationOrder(t *testing.T) {
+	configureSimulatedNetwork(t)
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := genesis
+	g.GovernanceKey = hex.EncodeToString(public)
+	if err := configureGenesis(g); err != nil {
+		t.Fatal(err)
+	}
+	governance := func(action string, height int) Tx {
+		gov := Governance{Action: action, UniqueID: SIMULATED_UNIQUE_ID, Height: height}
+		return Tx{Governance: &gov, Sig: hex.EncodeToString(ed25519.Sign(private, governanceMessage(gov)))}
+	}
+
+	chain := Blockchain{genesisBlock}
+	chain = append(chain, sealedWith(t, chain[0], []Tx{governance(GOVERNANCE_ADD, 5)}))
+	chain = append(chain, sealedWith(t, chain[1], []Tx{governance(GOVERNANCE_RETIRE, 3)}))
+	if i, err := checkBlocks(chain, 1, true); err != nil {
+		t.Fatalf("block %d rejected: %v", i, err)
+	}
+	if err := checkBlock(sealedWith(t, chain[2], nil), chain); !errors.Is(err, errUnknownEnclave) {
+		t.Fatalf("block after the retirement: got %v, want %v", err, errUnknownEnclave)
+	}
+	if ids := activePolicy(chain, 5).UniqueIDs; len(ids) != 1 || ids[0] != SIMULATED_UNIQUE_ID {
+		t.Fatalf("policy at the later activation accepts %v", ids)
+	}
+}
+
+// A commitment to the results of a job nobody submitted
+func committedResult() ResultCommitment {
+	return ResultCommitment{Job: "job", Worker: strings.Repeat("ab", 32), Results: 1, Root: merkleRoot(resultLeaves([]JobResult{{Key: "key", Value: []byte("1")}}))}
+}
+
+// A commitment for a job by one worker key doesn't keep the worker that ran the job from committing its results
+func TestResultCommitmentsPerWorker(t *testing.T) {
+	configureSimulatedNetwork(t)
+	s := initialState(Blockchain{genesisBlock})
+	commit := func(index int, worker string) error {
+		result := committedResult()
+		result.Worker = worker
+		block := Block{Index: index, Results: encodeResults([]ResultCommitment{result})}
+		block.ResultRoot = merkleRoot(commitmentLeaves(blockResults(block)))
+		return s.applyResults(block)
+	}
+	forged, honest := strings.Repeat("01", 32), strings.Repeat("02", 32)
+	if err := commit(1, forged); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(2, honest); err != nil {
+		t.Fatalf("the forged commitment locked out the worker's: %v", err)
+	}
+	if err := commit(3, honest); !errors.Is(err, errDuplicateResult) {
+		t.Fatalf("a worker committed the job twice: %v", err)
+	}
+	if err := commit(3, strings.Repeat("CD", 32)); !errors.Is(err, errBlockResults) {
+		t.Fatalf("an upper case key was accepted: %v", err)
+	}
+	committed := committedResults(s, []string{"job", "other"}, honest)
+	if len(committed) != 1 || committed["job"] != 2 {
+		t.Fatalf("committed results %v, want the job at block 2", committed)
+	}
+}
+
+// The cached tip state follows the chains it is asked for, through reorgs deeper than its undo records too, and
+// always matches replaying the chain from the start
+func TestTipStateFollowsReorgs(t *testing.T) {
+	configureSimulatedNetwork(t)
+	_, from, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := hex.EncodeToString(from.Public().(ed25519.PublicKey))
+	g := genesis
+	g.Balances = map[string]int{address: 100}
+	if err := configureGenesis(g); err != nil {
+		t.Fatal(err)
+	}
+	transfer := func(amount int, nonce uint64) Tx {
+		to, _, _ := ed25519.GenerateKey(nil)
+		return signTx(Tx{From: address, To: hex.EncodeToString(to), Amount: amount, Nonce: nonce}, from)
+	}
+	extend := func(chain Blockchain, blocks int, txs ...Tx) Blockchain {
+		chain = append(Blockchain(nil), chain...)
+		for i := 0; i < blocks; i++ {
+			chain = append(chain, sealedWith(t, chain[len(chain)-1], txs))
+			txs = nil
+		}
+		return chain
+	}
+	check := func(name string, chain Blockchain) {
+		t.Helper()
+		want, err := stateAt(chain, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = withChainState(chain, func(s *ChainState) error {
+			if len(s.Balances) != len(want.Balances) || len(s.Seen) != len(want.Seen) || s.Nonces[address] != want.Nonces[address] {
+				t.Fatalf("%s: the tip state has %d balances, %d txs and nonce %d, want %d, %d and %d", name,
+					len(s.Balances), len(s.Seen), s.Nonces[address], len(want.Balances), len(want.Seen), want.Nonces[address])
+			}
+			for account, balance := range want.Balances {
+				if s.Balances[account] != balance {
+					t.Fatalf("%s: balance %d, want %d", name, s.Balances[account], balance)
+				}
+			}
+			// changes made while checking a block don't stay in the state
+			s.applyTx(transfer(1, 100), nextHeight(chain))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	common := extend(Blockchain{genesisBlock}, 2, transfer(10, 1))
+	a := extend(common, 3, transfer(20, 2))
+	b := extend(common, 4, transfer(30, 2), transfer(5, 3))
+	check("a", a)
+	check("a again", a)
+	check("a extended", extend(a, 1, transfer(1, 3)))
+	check("reorg to b", b)
+	check("back to a", a)
+	check("common prefix", common)
+	check("deep fork", extend(common, STATE_UNDO_BLOCKS+5, transfer(40, 2)))
+	check("reorg past the undo records", b)
+
+	extended := extend(a, 1)
+	invalid := append(extended, sealedWith(t, extended[len(extended)-1], []Tx{transfer(1000, 9)}))
+	if err := withChainState(invalid, func(*ChainState) error { return nil }); !errors.Is(err, errBlockTxs) {
+		t.Fatalf("a chain with an invalid block was applied: %v", err)
+	}
+	check("after an invalid chain", a)
+}
+
+// The full mempool drops the highest nonce transfer of the account with the most pending ones, never governance
+func TestMempoolEviction(t *testing.T) {
+	saved := mempool
+	t.Cleanup(func() { mempool = saved })
+	mempool = make(map[string]Tx)
+	for i := 0; i < MAX_MEMPOOL_TXS; i++ {
+		tx := Tx{From: "spammer", Nonce: uint64(i + 1)}
+		if i < 10 {
+			tx = Tx{From: "honest", Nonce: uint64(i + 1)}
+		}
+		mempool[fmt.Sprint(i)] = tx
+	}
+	highest := func(account string) uint64 {
+		n := uint64(0)
+		for _, tx := range mempool {
+			if tx.From == account && tx.Nonce > n {
+				n = tx.Nonce
+			}
+		}
+		return n
+	}
+
+	if err := evictPending(Tx{From: "new", Nonce: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if len(mempool) != MAX_MEMPOOL_TXS-1 || highest("spammer") != MAX_MEMPOOL_TXS-1 {
+		t.Fatalf("evicted another transfer than the spammer's last one")
+	}
+	if err := evictPending(Tx{From: "spammer", Nonce: MAX_MEMPOOL_TXS + 1}); !errors.Is(err, errMempoolFull) {
+		t.Fatalf("the spammer's next transfer was taken: %v", err)
+	}
+	if err := evictPending(Tx{From: "spammer", Nonce: 11}); err != nil || highest("spammer") != MAX_MEMPOOL_TXS-2 {
+		t.Fatalf("a lower nonce of the spammer didn't replace its highest: %v", err)
+	}
+
+	for hash := range mempool {
+		mempool[hash] = Tx{Governance: &Governance{}}
+	}
+	if err := evictPending(Tx{From: "new", Nonce: 1}); !errors.Is(err, errMempoolFull) || len(mempool) != MAX_MEMPOOL_TXS-2 {
+		t.Fatalf("a governance transaction was dropped: %v", err)
+	}
+}
+
+// verify reads an export or a json chain block by block and stops at the first invalid block
+func TestVerifyStream(t *testing.T) {
+	configureSimulatedNetwork(t)
+	chain := Blockchain{genesisBlock}
+	for i := 0; i < 3; i++ {
+		chain = append(chain, sealedWith(t, chain[len(chain)-1], nil))
+	}
+	// a transfer from an account without funds
+	invalid := append(append(Blockchain(nil), chain...), sealedWith(t, chain[len(chain)-1], []Tx{signedTx(t, 1)}))
+	invalid = append(invalid, sealedWith(t, invalid[len(invalid)-1], nil))
+
+	dir := t.TempDir()
+	exported := filepath.Join(dir, "chain.bin")
+	var buf bytes.Buffer
+	cw, err := NewChainWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, block := range chain {
+		if err := cw.Write(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(exported, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	stored := filepath.Join(dir, "blockchain.json")
+	encoded, _ := json.Marshal(invalid)
+	if err := os.WriteFile(stored, encoded, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	verify := func(path string) (int, error) {
+		t.Helper()
+		r, f, err := openChainFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		first, err := r.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return verifyStream(first, r)
+	}
+	if count, err := verify(exported); err != nil || count != len(chain) {
+		t.Fatalf("verified %d blocks of the export, want %d: %v", count, len(chain), err)
+	}
+	if i, err := verify(stored); !errors.Is(err, errBlockTxs) || i != len(chain) {
+		t.Fatalf("block %d reported invalid: %v, want block %d", i, err, len(chain))
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Layout of a node's data directory, the worker uses the same names where they overlap:
+//
+//	LOCK                  held by the process using the directory
+//	chain/blockchain.json the chain
+//	chain/base.json       base snapshot of a bootstrapped chain
+//	chain/snapshots/      periodic snapshots
+//	keys/p2p.key          the node's libp2p identity
+//	peerstore/peers.json  peers connected to before, dialed again on startup
+//	workers/epochs.json   epoch of the last block accepted from each worker, miner nodes only
+//	logs/node.log         copy of the node's log
+const LOCK_FILE = "LOCK"
+
+// Absolute path of the data directory, set by setDataDir
+var dataDir string
+
+// Kept open so the lock is held until the process exits
+var dataLock *os.File
+
+var errDataDirLocked = errors.New("data directory is used by another process")
+
+// Default data directory below the user's home, DATA_DIR_NAME differs between the node binaries
+func defaultDataDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return DATA_DIR_NAME
+	}
+	return filepath.Join(home, ".poc", DATA_DIR_NAME)
+}
+
+func setDataDir(dir string) error {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	dataDir = abs
+	return nil
+}
+
+func chainFile() string {
+	return filepath.Join(dataDir, "chain", "blockchain.json")
+}
+
+func hostKeyFile() string {
+	return filepath.Join(dataDir, "keys", "p2p.key")
+}
+
+func epochsFile() string {
+	return filepath.Join(dataDir, "workers", "epochs.json")
+}
+
+func peersFile() string {
+	return filepath.Join(dataDir, "peerstore", "peers.json")
+}
+
+// Creates the data directory and takes its lock, fails if another process holds it
+func lockDataDir() error {
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dataDir, LOCK_FILE), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return fmt.Errorf("%s: %w", dataDir, errDataDirLocked)
+		}
+		return err
+	}
+	// the pid is informational only, the lock is released by the kernel when the process exits
+	f.Truncate(0)
+	fmt.Fprintf(f, "%d\n", os.Getpid())
+	dataLock = f
+	return nil
+}
+
+// Loads the node's libp2p key, a new one is created on first start so the node keeps its peer id
+func loadHostKey() (crypto.PrivKey, error) {
+	path := hostKeyFile()
+	raw, err := os.ReadFile(path)
+	if err == nil {
+		return crypto.UnmarshalPrivateKey(raw)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key, _, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	raw, err = crypto.MarshalPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	return key, os.WriteFile(path, raw, 0600)
+}
+
+func knownPeers() []peer.AddrInfo {
+	peers := make([]peer.AddrInfo, 0)
+	content, err := os.ReadFile(peersFile())
+	if err != nil {
+		return peers
+	}
+	if err := json.Unmarshal(content, &peers); err != nil {
+		p2pLog.Warn("Ignoring peerstore", "err", err)
+		return make([]peer.AddrInfo, 0)
+	}
+	return peers
+}
+
+// Adds a peer to the peerstore, replacing its previous addresses
+func rememberPeer(p peer.AddrInfo) {
+	peers := []peer.AddrInfo{p}
+	for _, known := range knownPeers() {
+		if known.ID != p.ID {
+			peers = append(peers, known)
+		}
+	}
+	bytes, err := json.MarshalIndent(peers, "", "  ")
+	if err != nil {
+		p2pLog.Error("Marshalling peerstore failed", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(peersFile()), os.ModePerm); err != nil {
+		p2pLog.Error("Writing peerstore failed", err)
+		return
+	}
+	_ = os.WriteFile(peersFile(), bytes, 0644)
+}
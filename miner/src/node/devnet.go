@@ -0,0 +1,546 @@
+package main
+
+import (
+	"context"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/crypto/nacl/box"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+
+	"node/minerpb"
+)
+
+const DEVNET_START_TIMEOUT = 30 * time.Second
+
+// Only the node serving workers can run simulated workers, so devnet is not part of the shared commands
+func init() {
+	commands["devnet"] = runDevnet
+}
+
+// A network of nodes on localhost. Every pair of nodes is connected through a proxy per direction,
+// which delays the traffic and drops it while the nodes are partitioned.
+type Devnet struct {
+	dir     string
+	nodes   []*DevnetNode
+	links   []*DevnetLink
+	latency time.Duration
+	jitter  time.Duration
+
+	mutex *sync.Mutex
+	// partition group of every node, nil while the network is whole
+	groups []int
+}
+
+type DevnetNode struct {
+	index    int
+	id       peer.ID
+	dir      string
+	p2pPort  int
+	httpPort int
+	grpcPort int
+	cmd      *exec.Cmd
+}
+
+type DevnetLink struct {
+	from     int
+	to       int
+	listener net.Listener
+	target   string
+	conns    map[net.Conn]bool
+}
+
+// node devnet [-nodes n] [-workers m] [-latency d] [-partition groups] ...
+// Runs n nodes as subprocesses and m simulated workers mining on them, optionally partitions the network for a while,
+// then checks all nodes converge on the same tip. Exits with 1 if they don't.
+func runDevnet(args []string) int {
+	flags := flag.NewFlagSet("devnet", flag.ExitOnError)
+	nodeCount := flags.Int("nodes", 3, "number of nodes")
+	workerCount := flags.Int("workers", 2, "number of simulated workers, assigned to the nodes in turn")
+	latency := flags.Duration("latency", 20*time.Millisecond, "one way latency between nodes")
+	jitter := flags.Duration("jitter", 0, "random latency added on top of -latency")
+	interval := flags.Duration("block-interval", 2*time.Second, "average time between blocks of each worker")
+	duration := flags.Duration("duration", 30*time.Second, "time the workers mine")
+	partition := flags.String("partition", "", "partition groups, e.g. 0,1|2 cuts node 2 off from nodes 0 and 1")
+	partitionAt := flags.Duration("partition-at", 10*time.Second, "time the partition starts")
+	healAt := flags.Duration("heal-at", 20*time.Second, "time the partition ends")
+	converge := flags.Duration("converge", 30*time.Second, "time the nodes have to agree on the tip after mining stopped")
+	basePort := flags.Int("base-port", 5000, "first port used, every node takes three")
+	dir := flags.String("dir", "", "directory of the nodes' data directories, a temporary one by default")
+	keep := flags.Bool("keep", false, "keep the temporary data directories")
+	flags.Parse(args)
+	rand.Seed(time.Now().UnixNano())
+
+	if *nodeCount < 1 || *workerCount < 1 {
+		fmt.Fprintln(os.Stderr, "devnet needs at least one node and one worker")
+		return 2
+	}
+	var groups []int
+	if *partition != "" {
+		var err error
+		groups, err = parseGroups(*partition, *nodeCount)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+	// only a directory the devnet created itself is removed, never one passed with -dir
+	if *dir == "" {
+		tmp, err := os.MkdirTemp("", "poc-devnet")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		*dir = tmp
+		if !*keep {
+			defer os.RemoveAll(tmp)
+		}
+	}
+
+	d := &Devnet{dir: *dir, latency: *latency, jitter: *jitter, mutex: &sync.Mutex{}}
+	if err := d.start(*nodeCount, *basePort); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		d.stop()
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "devnet: %d nodes running in %s\n", *nodeCount, *dir)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+	wg := &sync.WaitGroup{}
+	for i := 0; i < *workerCount; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			d.mine(ctx, fmt.Sprintf("devnet-worker-%d", i), d.nodes[i%len(d.nodes)], *interval)
+		}(i)
+	}
+	if groups != nil {
+		time.AfterFunc(*partitionAt, func() { d.partition(groups) })
+		time.AfterFunc(*healAt, func() { d.partition(nil) })
+	}
+	go d.report(ctx)
+	wg.Wait()
+	d.partition(nil)
+
+	// forks of equal work never replace each other, one more block on top of either decides
+	tieBreak, cancelTieBreak := context.WithTimeout(context.Background(), *converge)
+	d.mineOne(tieBreak, "devnet-tiebreak", d.nodes[0])
+	cancelTieBreak()
+
+	tip, converged := d.awaitConvergence(*converge)
+	code := 0
+	if converged {
+		fmt.Fprintf(os.Stderr, "devnet: converged on block %d %s\n", tip.Index, tip.Hash)
+	} else {
+		fmt.Fprintln(os.Stderr, "devnet: nodes did not converge")
+		code = 1
+	}
+	if !d.stop() {
+		code = 1
+	}
+	return code
+}
+
+// Parses partition groups like 0,1|2, every node must be in exactly one group
+func parseGroups(raw string, nodes int) ([]int, error) {
+	groups := make([]int, nodes)
+	seen := make([]bool, nodes)
+	for g, group := range strings.Split(raw, "|") {
+		for _, field := range strings.Split(group, ",") {
+			i, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil || i < 0 || i >= nodes || seen[i] {
+				return nil, fmt.Errorf("invalid partition %q", raw)
+			}
+			groups[i] = g
+			seen[i] = true
+		}
+	}
+	for i := range seen {
+		if !seen[i] {
+			return nil, fmt.Errorf("node %d is in no partition group", i)
+		}
+	}
+	return groups, nil
+}
+
+// Creates the nodes' keys and the links between them and starts the nodes
+func (d *Devnet) start(count int, basePort int) error {
+	if err := os.MkdirAll(d.dir, 0700); err != nil {
+		return err
+	}
+	genesisFile := filepath.Join(d.dir, "genesis.json")
+	// the network accepts the simulated enclave the devnet's workers pretend to run in
+	bytes, err := json.Marshal(Genesis{
+		ChainID:    "poc-devnet-local",
+		Difficulty: 1,
+		Timestamp:  time.Now().Unix(),
+		Policy:     &AttestationPolicy{UniqueIDs: []string{SIMULATED_UNIQUE_ID}, AllowDebug: true},
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(genesisFile, bytes, 0644); err != nil {
+		return err
+	}
+	// the simulated workers need the genesis block and the difficulty
+	if err := configureNetwork(genesisFile); err != nil {
+		return err
+	}
+
+	for i := 0; i < count; i++ {
+		n := &DevnetNode{
+			index:    i,
+			dir:      filepath.Join(d.dir, fmt.Sprintf("node%d", i)),
+			p2pPort:  basePort + 3*i,
+			httpPort: basePort + 3*i + 1,
+			grpcPort: basePort + 3*i + 2,
+		}
+		// the node's key is created up front so the other nodes know its peer id
+		if err := setDataDir(n.dir); err != nil {
+			return err
+		}
+		key, err := loadHostKey()
+		if err != nil {
+			return err
+		}
+		n.id, err = peer.IDFromPrivateKey(key)
+		if err != nil {
+			return err
+		}
+		d.nodes = append(d.nodes, n)
+	}
+
+	peers := make([][]string, count)
+	for _, from := range d.nodes {
+		for _, to := range d.nodes {
+			if from == to {
+				continue
+			}
+			l, err := d.link(from.index, to)
+			if err != nil {
+				return err
+			}
+			addr := fmt.Sprintf("/ip4/127.0.0.1/tcp/%d/p2p/%s", l.listener.Addr().(*net.TCPAddr).Port, to.id)
+			peers[from.index] = append(peers[from.index], addr)
+		}
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	for _, n := range d.nodes {
+		n.cmd = exec.Command(exe,
+			"-datadir", n.dir,
+			"-host", "127.0.0.1",
+			"-port", strconv.Itoa(n.p2pPort),
+			"-http", fmt.Sprintf("127.0.0.1:%d", n.httpPort),
+			"-grpc", fmt.Sprintf("127.0.0.1:%d", n.grpcPort),
+			"-genesis", genesisFile,
+			"-simulate",
+			"-mdns=false",
+			"-peers", strings.Join(peers[n.index], ","),
+		)
+		// the nodes log to their data directories
+		if err := n.cmd.Start(); err != nil {
+			return err
+		}
+	}
+	for _, n := range d.nodes {
+		if err := n.awaitHealthy(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stops the nodes with SIGTERM, returns false if one of them did not exit cleanly
+func (d *Devnet) stop() bool {
+	for _, l := range d.links {
+		l.listener.Close()
+	}
+	clean := true
+	for _, n := range d.nodes {
+		if n.cmd == nil || n.cmd.Process == nil {
+			continue
+		}
+		n.cmd.Process.Signal(syscall.SIGTERM)
+		if err := n.cmd.Wait(); err != nil {
+			fmt.Fprintf(os.Stderr, "devnet: node %d: %v\n", n.index, err)
+			clean = false
+		}
+	}
+	return clean
+}
+
+func (n *DevnetNode) awaitHealthy() error {
+	deadline := time.Now().Add(DEVNET_START_TIMEOUT)
+	for time.Now().Before(deadline) {
+		res, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/healthz", n.httpPort))
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return fmt.Errorf("node %d did not start, see %s", n.index, filepath.Join(n.dir, "logs", "node.log"))
+}
+
+func (n *DevnetNode) tip() (Block, error) {
+	var tip Block
+	err := callRPC(fmt.Sprintf("http://127.0.0.1:%d/rpc", n.httpPort), "chain_getTip", &tip)
+	return tip, err
+}
+
+// Polls the nodes' tips until they are all the same
+func (d *Devnet) awaitConvergence(timeout time.Duration) (Block, bool) {
+	deadline := time.Now().Add(timeout)
+	for {
+		tips := d.tips()
+		converged := true
+		for _, tip := range tips {
+			if tip.Hash == "" || tip.Hash != tips[0].Hash {
+				converged = false
+			}
+		}
+		if converged || time.Now().After(deadline) {
+			return tips[0], converged
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func (d *Devnet) tips() []Block {
+	tips := make([]Block, len(d.nodes))
+	for i, n := range d.nodes {
+		tip, err := n.tip()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "devnet: node %d: %v\n", i, err)
+			continue
+		}
+		tips[i] = tip
+	}
+	return tips
+}
+
+// Prints the nodes' heights every few seconds
+func (d *Devnet) report(ctx context.Context) {
+	start := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+		heights := make([]string, 0, len(d.nodes))
+		for _, tip := range d.tips() {
+			heights = append(heights, strconv.Itoa(tip.Index))
+		}
+		fmt.Fprintf(os.Stderr, "devnet: %4.0fs heights %s\n", time.Since(start).Seconds(), strings.Join(heights, " "))
+	}
+}
+
+// Sets the partition groups, nil heals the network. Connections between groups are closed.
+func (d *Devnet) partition(groups []int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if groups == nil && d.groups == nil {
+		return
+	}
+	d.groups = groups
+	if groups == nil {
+		fmt.Fprintln(os.Stderr, "devnet: healing partition")
+	} else {
+		fmt.Fprintf(os.Stderr, "devnet: partitioning nodes into groups %v\n", groups)
+	}
+	for _, l := range d.links {
+		if d.cut(l) {
+			for c := range l.conns {
+				c.Close()
+			}
+		}
+	}
+}
+
+// Must be called with d.mutex held
+func (d *Devnet) cut(l *DevnetLink) bool {
+	return d.groups != nil && d.groups[l.from] != d.groups[l.to]
+}
+
+// Opens the proxy node from dials to reach node to
+func (d *Devnet) link(from int, to *DevnetNode) (*DevnetLink, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	l := &DevnetLink{from: from, to: to.index, listener: listener, target: fmt.Sprintf("127.0.0.1:%d", to.p2pPort), conns: make(map[net.Conn]bool)}
+	d.links = append(d.links, l)
+	go d.serveLink(l)
+	return l, nil
+}
+
+func (d *Devnet) serveLink(l *DevnetLink) {
+	for {
+		in, err := l.listener.Accept()
+		if err != nil {
+			return
+		}
+		out, err := net.Dial("tcp", l.target)
+		if err != nil {
+			in.Close()
+			continue
+		}
+		d.mutex.Lock()
+		if d.cut(l) {
+			in.Close()
+			out.Close()
+			d.mutex.Unlock()
+			continue
+		}
+		l.conns[in] = true
+		l.conns[out] = true
+		d.mutex.Unlock()
+
+		go d.forward(l, out, in)
+		go d.forward(l, in, out)
+	}
+}
+
+// Copies src to dst, every chunk is delivered after the link's latency. Keeps the order of the chunks.
+func (d *Devnet) forward(l *DevnetLink, dst net.Conn, src net.Conn) {
+	type chunk struct {
+		at   time.Time
+		data []byte
+	}
+	chunks := make(chan chunk, 1024)
+	go func() {
+		defer close(chunks)
+		last := time.Now()
+		for {
+			buf := make([]byte, 32*1024)
+			n, err := src.Read(buf)
+			if n > 0 {
+				at := time.Now().Add(d.latency)
+				if d.jitter > 0 {
+					at = at.Add(time.Duration(rand.Int63n(int64(d.jitter))))
+				}
+				if at.Before(last) {
+					at = last
+				}
+				last = at
+				chunks <- chunk{at: at, data: buf[:n]}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	for c := range chunks {
+		time.Sleep(time.Until(c.at))
+		if _, err := dst.Write(c.data); err != nil {
+			break
+		}
+	}
+	src.Close()
+	dst.Close()
+	for range chunks {
+	}
+	d.mutex.Lock()
+	delete(l.conns, src)
+	delete(l.conns, dst)
+	d.mutex.Unlock()
+}
+
+// Mines blocks on the node about every interval until ctx is done, like a worker in simulation mode
+func (d *Devnet) mine(ctx context.Context, id string, n *DevnetNode, interval time.Duration) {
+	for {
+		wait := interval/2 + time.Duration(rand.Int63n(int64(interval)))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		d.mineOne(ctx, id, n)
+	}
+}
+
+// Submits one block on top of the node's tip, returns false if the node did not accept it
+func (d *Devnet) mineOne(ctx context.Context, id string, n *DevnetNode) bool {
+	conn, err := grpc.Dial(fmt.Sprintf("127.0.0.1:%d", n.grpcPort), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	client := minerpb.NewMinerClient(conn)
+	ctx, err = simulatedSession(ctx, client, id)
+	if err != nil {
+		return false
+	}
+	work, err := client.GetWork(ctx, &minerpb.GetWorkRequest{Version: PROTOCOL_VERSION, WorkerId: id, ForBlock: true})
+	if err != nil {
+		return false
+	}
+	block, err := simulatedBlock(fromProtoBlock(work.GetTip().GetBlock()), work.GetTxs(), "", int(work.GetTip().GetDifficulty()), rand.Uint32())
+	if err != nil {
+		return false
+	}
+	res, err := client.SubmitBlock(ctx, &minerpb.SubmitBlockRequest{Version: PROTOCOL_VERSION, WorkerId: id, Block: toProtoBlock(block)})
+	return err == nil && res.GetAccepted()
+}
+
+// Publishes a key with a simulated report like a worker does and returns ctx carrying the session token
+func simulatedSession(ctx context.Context, client minerpb.MinerClient, id string) (context.Context, error) {
+	// the report references the tip, which anyone may watch
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := client.WatchTip(watchCtx, &minerpb.WatchTipRequest{Version: PROTOCOL_VERSION, WorkerId: id})
+	if err != nil {
+		return nil, err
+	}
+	tip, err := stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	public, private, err := box.GenerateKey(crand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, 64)
+	digest := sha256.Sum256(public[:])
+	copy(data[:32], digest[:])
+	copy(data[32:], tip.GetBlock().GetHash())
+	report, err := simulatedReport(data)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.PublishKey(ctx, &minerpb.PublishKeyRequest{Version: PROTOCOL_VERSION, WorkerId: id, PublicKey: public[:], Report: report})
+	if err != nil {
+		return nil, err
+	}
+	token, ok := box.OpenAnonymous(nil, res.GetSealedToken(), public, private)
+	if !ok {
+		return nil, errors.New("session token could not be opened")
+	}
+	return metadata.AppendToOutgoingContext(ctx, WORKER_TOKEN_HEADER, string(token)), nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Governance transactions add or retire accepted enclave measurements on chain, so every node agrees on them.
+// They are signed with the network's governance key and take effect from their activation height on.
+type Governance struct {
+	Action             string
+	UniqueID           string `json:",omitempty"`
+	SignerID           string `json:",omitempty"`
+	ProductID          uint16 `json:",omitempty"`
+	MinSecurityVersion uint   `json:",omitempty"`
+	Height             int
+}
+
+const (
+	GOVERNANCE_ADD    = "add"
+	GOVERNANCE_RETIRE = "retire"
+)
+
+// Public key governance transactions are signed with, set from the genesis file
+var governanceKey ed25519.PublicKey
+
+var errGovernanceDisabled = errors.New("no governance key configured")
+var errInvalidGovernance = errors.New("invalid governance transaction")
+
+func loadGovernanceKey(key string) (ed25519.PublicKey, error) {
+	if key == "" {
+		return nil, nil
+	}
+	b, err := hex.DecodeString(key)
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid governance key %q", key)
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+// The message signed by the governance key, the signature is stored hex encoded in the tx's Sig. Bound to the
+// network like transfers, so a governance transaction can't be replayed on another chain sharing the key.
+func governanceMessage(g Governance) []byte {
+	return []byte(fmt.Sprintf("governance:%s:%s:%s:%s:%d:%d:%d", genesis.ChainID, g.Action, g.UniqueID, g.SignerID, g.ProductID, g.MinSecurityVersion, g.Height))
+}
+
+// Checks a governance transaction is well formed and signed with the governance key
+func verifyGovernance(tx Tx) error {
+	g := tx.Governance
+	if g == nil {
+		return errInvalidGovernance
+	}
+	if governanceKey == nil {
+		return errGovernanceDisabled
+	}
+	if g.Action != GOVERNANCE_ADD && g.Action != GOVERNANCE_RETIRE {
+		return errInvalidGovernance
+	}
+	// exactly one measurement per transaction, lower case so ids compare equal to the policy's
+	if (g.UniqueID == "") == (g.SignerID == "") || g.Height <= 0 {
+		return errInvalidGovernance
+	}
+	if g.UniqueID != "" && (!isMeasurement(g.UniqueID) || g.UniqueID != strings.ToLower(g.UniqueID)) {
+		return errInvalidGovernance
+	}
+	if g.SignerID != "" && (!isMeasurement(g.SignerID) || g.SignerID != strings.ToLower(g.SignerID)) {
+		return errInvalidGovernance
+	}
+	sig, err := hex.DecodeString(tx.Sig)
+	if err != nil || hex.EncodeToString(sig) != tx.Sig || !ed25519.Verify(governanceKey, governanceMessage(*g), sig) {
+		return errInvalidGovernance
+	}
+	return nil
+}
+
+// Measurements accepted for a block at the given height of the chain, see policyAt
+func activePolicy(chain Blockchain, height int) AttestationPolicy {
+	var accepted AttestationPolicy
+	err := withChainState(chain, func(s *ChainState) error {
+		accepted = s.policyAt(height)
+		return nil
+	})
+	if err == nil {
+		return accepted
+	}
+	s := initialState(chain)
+	for _, block := range chain[1:] {
+		// the chain's blocks have been checked, a transaction that doesn't apply is skipped like replayTxs does
+		s.applyGovernance(block)
+	}
+	return s.policyAt(height)
+}
+
+// Records a governance transaction included in the chain, it takes effect once policyAt reaches its activation height
+func (s *ChainState) addGovernance(record GovernanceRecord) {
+	s.Governance = append(s.Governance, record)
+	s.pending = append(s.pending, record)
+}
+
+// Measurements accepted for a block at the given height: the genesis policy changed by every governance
+// transaction included before that height whose activation height has been reached, in order of activation.
+// Blocks including a transaction at or after its own activation height are invalid. The state keeps the
+// policy it returned, heights must not decrease from one call to the next.
+func (s *ChainState) policyAt(height int) AttestationPolicy {
+	sort.SliceStable(s.pending, func(i, j int) bool {
+		return s.pending[i].Tx.Governance.Height < s.pending[j].Tx.Governance.Height
+	})
+	n := 0
+	for n < len(s.pending) && s.pending[n].Tx.Governance.Height <= height {
+		s.policy.apply(*s.pending[n].Tx.Governance)
+		n++
+	}
+	s.pending = s.pending[n:]
+	return s.policy.clone()
+}
+
+// Checks the governance transactions of a block and records them, light clients only know these of a block's transactions
+func (s *ChainState) applyGovernance(block Block) error {
+	for _, tx := range blockTxs(block) {
+		if tx.Governance == nil {
+			continue
+		}
+		if err := s.applyTx(tx, block.Index); err != nil {
+			return fmt.Errorf("%w: %s: %v", errBlockTxs, calculateTxHash(tx), err)
+		}
+	}
+	return nil
+}
+
+func (p *AttestationPolicy) apply(g Governance) {
+	uniqueIDs := p.UniqueIDs[:0]
+	for _, id := range p.UniqueIDs {
+		if id != g.UniqueID {
+			uniqueIDs = append(uniqueIDs, id)
+		}
+	}
+	signers := p.Signers[:0]
+	for _, s := range p.Signers {
+		if s.SignerID != g.SignerID || s.ProductID != g.ProductID {
+			signers = append(signers, s)
+		}
+	}
+	p.UniqueIDs, p.Signers = uniqueIDs, signers
+
+	if g.Action != GOVERNANCE_ADD {
+		return
+	}
+	if g.UniqueID != "" {
+		p.UniqueIDs = append(p.UniqueIDs, g.UniqueID)
+	} else {
+		p.Signers = append(p.Signers, SignerPolicy{SignerID: g.SignerID, ProductID: g.ProductID, MinSecurityVersion: g.MinSecurityVersion})
+	}
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/nacl/box"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"node/minerpb"
+)
+
+// Version of the miner protocol (poc.miner.v2) implemented by this node, see miner/src/proto
+const PROTOCOL_VERSION = 3
+
+// Metadata carrying a worker's session token
+const WORKER_TOKEN_HEADER = "worker-token"
+
+// How often running jobs are checked for an expired lease
+const JOB_LEASE_CHECK_INTERVAL = 10 * time.Second
+
+type minerServer struct {
+	minerpb.UnimplementedMinerServer
+}
+
+// Every connected worker watching the tip gets its own channel
+var tipSubscribers = make(map[chan Block]bool)
+var tipMutex = &sync.Mutex{}
+
+// Epoch of the last block accepted from each worker, a worker's epochs only ever grow. They are kept in the data
+// directory, so a worker whose sealed state was rolled back can't replay epochs after the node restarted either.
+var workerEpochs = make(map[string]uint64)
+var epochsMutex = &sync.Mutex{}
+
+var errStaleEpoch = errors.New("epoch does not follow the worker's last block")
+
+// A worker's session, its token is sealed to the attested key so only the worker's enclave can open it
+type workerSession struct {
+	key   []byte
+	token string
+}
+
+var workerSessions = make(map[string]workerSession)
+var sessionsMutex = &sync.Mutex{}
+
+var errUnauthenticated = status.Error(codes.Unauthenticated, "publish an attested key first")
+var errSessionTaken = status.Error(codes.PermissionDenied, "worker id is bound to another key")
+
+// Serializes key publishing, so a worker id is only ever bound by one call at a time
+var publishMutex = &sync.Mutex{}
+
+// Latest stats reported by each worker
+var workerStats = make(map[string]*minerpb.ReportStatsRequest)
+var statsMutex = &sync.Mutex{}
+
+var grpcServer = grpc.NewServer()
+
+func spinUpGRPC(addr string) {
+	if err := loadWorkerEpochs(); err != nil {
+		fatal(workerLog, "Loading worker epochs failed", err, "file", epochsFile())
+	}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		fatal(workerLog, "Failed to listen for workers", err)
+	}
+	prometheus.MustRegister(workerCollector{})
+	minerpb.RegisterMinerServer(grpcServer, &minerServer{})
+	go reapJobLeases()
+	workerLog.Info("Listening for workers", "addr", addr)
+	if err := grpcServer.Serve(lis); err != nil {
+		workerLog.Error("Serving workers failed", err)
+	}
+}
+
+// Ends the workers' tip streams and waits for running calls
+func stopGRPC() {
+	grpcServer.GracefulStop()
+}
+
+// Workers built against a newer version of poc.miner.v2 than ours are rejected, older ones are served
+func checkVersion(version uint32) error {
+	if version > PROTOCOL_VERSION {
+		return status.Errorf(codes.FailedPrecondition, "unsupported protocol version %d, node supports %d", version, PROTOCOL_VERSION)
+	}
+	return nil
+}
+
+// Whether the call carries the session's token
+func hasToken(ctx context.Context, session workerSession) bool {
+	md, _ := metadata.FromIncomingContext(ctx)
+	tokens := md.Get(WORKER_TOKEN_HEADER)
+	return len(tokens) == 1 && subtle.ConstantTimeCompare([]byte(tokens[0]), []byte(session.token)) == 1
+}
+
+// Whether the session's key is still the worker's published key and fresh
+func liveSession(worker string, session workerSession) bool {
+	workerKeysMutex.Lock()
+	key, ok := workerKeys[worker]
+	workerKeysMutex.Unlock()
+	return ok && bytes.Equal(key.PublicKey, session.key) && freshKey(key)
+}
+
+// Checks the call carries the session token of the worker and that the worker's key is still fresh
+func authenticate(ctx context.Context, worker string) error {
+	sessionsMutex.Lock()
+	session, ok := workerSessions[worker]
+	sessionsMutex.Unlock()
+	if !ok || !hasToken(ctx, session) || !liveSession(worker, session) {
+		return errUnauthenticated
+	}
+	return nil
+}
+
+// Whether the worker's live session is still the one holding the key, jobs handed to an ended session are queued again
+func sessionHolds(worker string, key string) bool {
+	sessionsMutex.Lock()
+	session, ok := workerSessions[worker]
+	sessionsMutex.Unlock()
+	return ok && hex.EncodeToString(session.key) == key && liveSession(worker, session)
+}
+
+// Queues jobs again once their lease ran out or their worker's session ended
+func reapJobLeases() {
+	for range time.Tick(JOB_LEASE_CHECK_INTERVAL) {
+		for _, id := range requeueExpiredJobs(time.Now(), sessionHolds) {
+			workerLog.Warn("Job lease expired, queued again", "job", id)
+		}
+	}
+}
+
+// Hex encoded key of the worker's session, the key its result commitments are by
+func sessionKey(worker string) string {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	return hex.EncodeToString(workerSessions[worker].key)
+}
+
+// A worker id stays bound to the key of its live session, another key only takes it over with the session's
+// token, which proves the caller holds the old key. Once the old key expired the id is free again.
+func checkTakeover(ctx context.Context, worker string, key []byte) error {
+	sessionsMutex.Lock()
+	session, ok := workerSessions[worker]
+	sessionsMutex.Unlock()
+	if !ok || bytes.Equal(session.key, key) || !liveSession(worker, session) || hasToken(ctx, session) {
+		return nil
+	}
+	return errSessionTaken
+}
+
+// Returns the worker's session token sealed to its key, a worker publishing the same key keeps its token
+func openSession(worker string, key []byte) ([]byte, error) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	session, ok := workerSessions[worker]
+	if !ok || !bytes.Equal(session.key, key) {
+		token := make([]byte, 32)
+		if _, err := rand.Read(token); err != nil {
+			return nil, err
+		}
+		session = workerSession{key: key, token: hex.EncodeToString(token)}
+		workerSessions[worker] = session
+	}
+	var public [32]byte
+	copy(public[:], key)
+	return box.SealAnonymous(nil, []byte(session.token), &public, rand.Reader)
+}
+
+func subscribeTip() chan Block {
+	c := make(chan Block, 1)
+	tipMutex.Lock()
+	tipSubscribers[c] = true
+	tipMutex.Unlock()
+	return c
+}
+
+func unsubscribeTip(c chan Block) {
+	tipMutex.Lock()
+	delete(tipSubscribers, c)
+	tipMutex.Unlock()
+}
+
+// Sends the new tip to every subscriber, a slow subscriber only gets the latest tip
+func notifyTip(block Block) {
+	tipMutex.Lock()
+	defer tipMutex.Unlock()
+	for c := range tipSubscribers {
+		select {
+		case <-c:
+		default:
+		}
+		c <- block
+	}
+}
+
+func currentTip() Block {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return blockchain[len(blockchain)-1]
+}
+
+func toProtoBlock(block Block) *minerpb.Block {
+	return &minerpb.Block{
+		Index:      int64(block.Index),
+		Txs:        block.Txs,
+		TxRoot:     block.TxRoot,
+		Results:    block.Results,
+		ResultRoot: block.ResultRoot,
+		Hash:       block.Hash,
+		Nonce:      block.Nonce,
+		PrevHash:   block.PrevHash,
+		Proof:      block.Proof,
+		Operations: block.Operations,
+		Epoch:      block.Epoch,
+	}
+}
+
+func fromProtoBlock(block *minerpb.Block) Block {
+	return Block{
+		Index:      int(block.GetIndex()),
+		Txs:        block.GetTxs(),
+		TxRoot:     block.GetTxRoot(),
+		Results:    block.GetResults(),
+		ResultRoot: block.GetResultRoot(),
+		Hash:       block.GetHash(),
+		Nonce:      block.GetNonce(),
+		PrevHash:   block.GetPrevHash(),
+		Proof:      block.GetProof(),
+		Operations: block.GetOperations(),
+		Epoch:      block.GetEpoch(),
+	}
+}
+
+func toProtoTip(block Block) *minerpb.Tip {
+	return &minerpb.Tip{Block: toProtoBlock(block), Difficulty: int32(difficulty)}
+}
+
+func (s *minerServer) GetWork(ctx context.Context, req *minerpb.GetWorkRequest) (*minerpb.Work, error) {
+	if err := checkVersion(req.GetVersion()); err != nil {
+		return nil, err
+	}
+	if err := authenticate(ctx, req.GetWorkerId()); err != nil {
+		return nil, err
+	}
+	// the tip and the candidates must match, they are only valid on top of that tip
+	mutex.Lock()
+	chain := blockchain
+	mutex.Unlock()
+	work := &minerpb.Work{Tip: toProtoTip(chain[len(chain)-1])}
+	key := sessionKey(req.GetWorkerId())
+	if req.GetForBlock() {
+		withChainState(chain, func(s *ChainState) error {
+			work.Txs = encodeTxs(blockCandidates(s, nextHeight(chain)))
+			work.Committed = committedResults(s, req.GetResults(), key)
+			return nil
+		})
+		return work, nil
+	}
+	if job := nextJob(req.GetWorkerId(), key); job != nil {
+		workerLog.Info("Assigned job", "job", job.ID, "worker", req.GetWorkerId())
+		work.Job = &minerpb.Job{
+			Id:     job.ID,
+			Script: job.Script,
+			Limits: &minerpb.Limits{
+				MaxOperations:  job.Limits.MaxOperations,
+				TimeoutSeconds: job.Limits.Timeout,
+				MaxMemoryBytes: job.Limits.MaxMemory,
+			},
+			SealedScript: job.Sealed,
+		}
+	}
+	return work, nil
+}
+
+func (s *minerServer) WatchTip(req *minerpb.WatchTipRequest, stream minerpb.Miner_WatchTipServer) error {
+	if err := checkVersion(req.GetVersion()); err != nil {
+		return err
+	}
+	c := subscribeTip()
+	defer unsubscribeTip(c)
+
+	if err := stream.Send(toProtoTip(currentTip())); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-stopped:
+			return nil
+		case block := <-c:
+			if err := stream.Send(toProtoTip(block)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *minerServer) SubmitBlock(ctx context.Context, req *minerpb.SubmitBlockRequest) (*minerpb.SubmitBlockResponse, error) {
+	if err := checkVersion(req.GetVersion()); err != nil {
+		return nil, err
+	}
+	if err := authenticate(ctx, req.GetWorkerId()); err != nil {
+		return nil, err
+	}
+	if req.GetBlock() == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing block")
+	}
+	block := fromProtoBlock(req.GetBlock())
+	// a worker seals every epoch into at most one block, an epoch it used before is a replayed attempt
+	epochsMutex.Lock()
+	defer epochsMutex.Unlock()
+	if block.Epoch <= workerEpochs[req.GetWorkerId()] {
+		return &minerpb.SubmitBlockResponse{Accepted: false, Reason: errStaleEpoch.Error()}, nil
+	}
+	if err := acceptBlock(block); err != nil {
+		return &minerpb.SubmitBlockResponse{Accepted: false, Reason: err.Error()}, nil
+	}
+	workerEpochs[req.GetWorkerId()] = block.Epoch
+	// the block is in our chain, replaying it after a lost write fails as a duplicate
+	if err := saveWorkerEpochs(); err != nil {
+		workerLog.Error("Saving worker epochs failed", err, "file", epochsFile())
+	}
+	return &minerpb.SubmitBlockResponse{Accepted: true}, nil
+}
+
+// A missing file starts without epochs, an unreadable one is an error: accepting epochs again would allow replays
+func loadWorkerEpochs() error {
+	content, err := os.ReadFile(epochsFile())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	epochsMutex.Lock()
+	defer epochsMutex.Unlock()
+	return json.Unmarshal(content, &workerEpochs)
+}
+
+// Replaces the epochs file atomically, callers hold epochsMutex
+func saveWorkerEpochs() error {
+	content, err := json.MarshalIndent(workerEpochs, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := epochsFile()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *minerServer) SubmitResult(ctx context.Context, req *minerpb.SubmitResultRequest) (*minerpb.SubmitResultResponse, error) {
+	if err := checkVersion(req.GetVersion()); err != nil {
+		return nil, err
+	}
+	if err := authenticate(ctx, req.GetWorkerId()); err != nil {
+		return nil, err
+	}
+	// results of the worker's local script are not tracked by the node
+	if req.GetJobId() == "" {
+		return &minerpb.SubmitResultResponse{}, nil
+	}
+	// jobs are only taken from the session they were handed to, a job queued again belongs to its next run
+	key := sessionKey(req.GetWorkerId())
+	if req.GetStarted() {
+		if err := startJob(req.GetJobId(), req.GetWorkerId(), key); err != nil {
+			return nil, jobError(err)
+		}
+		return &minerpb.SubmitResultResponse{}, nil
+	}
+	if abort := req.GetAbort(); abort != nil {
+		workerLog.Info("Job aborted by worker", "job", req.GetJobId(), "reason", abort.GetReason())
+		err := abortJob(req.GetJobId(), req.GetWorkerId(), key, JobAbort{
+			Reason:     abort.GetReason(),
+			Operations: abort.GetOperations(),
+			ElapsedMs:  abort.GetElapsedMs(),
+		})
+		if err != nil {
+			return nil, jobError(err)
+		}
+		return &minerpb.SubmitResultResponse{}, nil
+	}
+	if err := addJobResult(req.GetJobId(), req.GetWorkerId(), key, req.GetKey(), req.GetValue(), req.GetDone()); err != nil {
+		return nil, jobError(err)
+	}
+	return &minerpb.SubmitResultResponse{}, nil
+}
+
+// Jobs not running on the worker are refused, unknown ones are not found
+func jobError(err error) error {
+	if errors.Is(err, errJobNotAssigned) {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	return status.Error(codes.NotFound, err.Error())
+}
+
+func (s *minerServer) ReportStats(ctx context.Context, req *minerpb.ReportStatsRequest) (*minerpb.ReportStatsResponse, error) {
+	if err := checkVersion(req.GetVersion()); err != nil {
+		return nil, err
+	}
+	if err := authenticate(ctx, req.GetWorkerId()); err != nil {
+		return nil, err
+	}
+	statsMutex.Lock()
+	workerStats[req.GetWorkerId()] = req
+	statsMutex.Unlock()
+	workerLog.Debug("Worker stats", "worker", req.GetWorkerId(), "operations", req.GetOperations(), "blocks_found", req.GetBlocksFound(), "results", req.GetResults())
+	return &minerpb.ReportStatsResponse{}, nil
+}
+
+// Exports the counters last reported by each worker, their rate gives the operations per second
+type workerCollector struct{}
+
+var (
+	workerOperationsDesc = prometheus.NewDesc("poc_worker_operations_total", "Operations evaluated by the worker", []string{"worker"}, nil)
+	workerBlocksDesc     = prometheus.NewDesc("poc_worker_blocks_found_total", "Blocks found by the worker and accepted", []string{"worker"}, nil)
+	workerResultsDesc    = prometheus.NewDesc("poc_worker_results_total", "Job results submitted by the worker", []string{"worker"}, nil)
+)
+
+func (workerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- workerOperationsDesc
+	ch <- workerBlocksDesc
+	ch <- workerResultsDesc
+}
+
+func (workerCollector) Collect(ch chan<- prometheus.Metric) {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+	for id, stats := range workerStats {
+		ch <- prometheus.MustNewConstMetric(workerOperationsDesc, prometheus.CounterValue, float64(stats.GetOperations()), id)
+		ch <- prometheus.MustNewConstMetric(workerBlocksDesc, prometheus.CounterValue, float64(stats.GetBlocksFound()), id)
+		ch <- prometheus.MustNewConstMetric(workerResultsDesc, prometheus.CounterValue, float64(stats.GetResults()), id)
+	}
+}
+
+func (s *minerServer) PublishKey(ctx context.Context, req *minerpb.PublishKeyRequest) (*minerpb.PublishKeyResponse, error) {
+	if err := checkVersion(req.GetVersion()); err != nil {
+		return nil, err
+	}
+	publishMutex.Lock()
+	defer publishMutex.Unlock()
+	if err := checkTakeover(ctx, req.GetWorkerId(), req.GetPublicKey()); err != nil {
+		attestLog.Warn("Refused key of worker bound to another key", "worker", req.GetWorkerId())
+		return nil, err
+	}
+	err := registerWorkerKey(WorkerKey{Worker: req.GetWorkerId(), PublicKey: req.GetPublicKey(), Report: req.GetReport()})
+	if err != nil {
+		attestLog.Warn("Rejected key of worker", "worker", req.GetWorkerId(), "reason", rejectionReason(err), "err", err)
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	sealed, err := openSession(req.GetWorkerId(), req.GetPublicKey())
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	workerLog.Info("Worker published its job key", "worker", req.GetWorkerId())
+	return &minerpb.PublishKeyResponse{SealedToken: sealed}, nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"node/minerpb"
+)
+
+// Runs the node's gRPC handlers on the simulated network with a fresh set of worker sessions
+func grpcNode(t *testing.T) {
+	configureSimulatedNetwork(t)
+	savedChain, savedKeys, savedSessions := blockchain, workerKeys, workerSessions
+	t.Cleanup(func() {
+		blockchain, workerKeys, workerSessions = savedChain, savedKeys, savedSessions
+	})
+	blockchain = Blockchain{genesisBlock}
+	workerKeys = make(map[string]WorkerKey)
+	workerSessions = make(map[string]workerSession)
+}
+
+type testWorkerKey struct {
+	public  *[32]byte
+	private *[32]byte
+}
+
+func newTestWorkerKey(t *testing.T) testWorkerKey {
+	public, private, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testWorkerKey{public, private}
+}
+
+// Publishes the key attested for the current tip, returns the opened session token
+func publishTestKey(t *testing.T, ctx context.Context, worker string, key testWorkerKey) (string, error) {
+	data := make([]byte, 64)
+	digest := sha256.Sum256(key.public[:])
+	copy(data[:32], digest[:])
+	copy(data[32:], currentTip().Hash)
+	report, err := simulatedReport(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := (&minerServer{}).PublishKey(ctx, &minerpb.PublishKeyRequest{Version: PROTOCOL_VERSION, WorkerId: worker, PublicKey: key.public[:], Report: report})
+	if err != nil {
+		return "", err
+	}
+	token, ok := box.OpenAnonymous(nil, res.GetSealedToken(), key.public, key.private)
+	if !ok {
+		t.Fatal("the session token is not sealed to the published key")
+	}
+	return string(token), nil
+}
+
+func withToken(token string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs(WORKER_TOKEN_HEADER, token))
+}
+
+// A worker id can't be taken over by another key while its session is live, unless the old session's token comes along
+func TestSessionTakeover(t *testing.T) {
+	grpcNode(t)
+	first, second, third := newTestWorkerKey(t), newTestWorkerKey(t), newTestWorkerKey(t)
+
+	token, err := publishTestKey(t, context.Background(), "w", first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := authenticate(withToken(token), "w"); err != nil {
+		t.Fatalf("the session token was refused: %v", err)
+	}
+	if _, err := publishTestKey(t, context.Background(), "w", second); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("another key took over the live session: %v", err)
+	}
+	if again, err := publishTestKey(t, context.Background(), "w", first); err != nil || again != token {
+		t.Fatalf("publishing the same key again returned %v, want the same token", err)
+	}
+
+	// the worker itself moves to a new key with its token
+	moved, err := publishTestKey(t, withToken(token), "w", second)
+	if err != nil {
+		t.Fatalf("the session's own token didn't allow a new key: %v", err)
+	}
+	if authenticate(withToken(token), "w") == nil || authenticate(withToken(moved), "w") != nil {
+		t.Fatal("the session was not moved to the new key")
+	}
+
+	// once the key expired the id is free again
+	workerKeysMutex.Lock()
+	expired := workerKeys["w"]
+	expired.Height = -genesis.basePolicy().MaxReportAge - 1
+	workerKeys["w"] = expired
+	workerKeysMutex.Unlock()
+	if _, err := publishTestKey(t, context.Background(), "w", third); err != nil {
+		t.Fatalf("the id of an expired session was not freed: %v", err)
+	}
+}
+
+// Runs the job lease checks with a fresh job queue
+func jobNode(t *testing.T) {
+	grpcNode(t)
+	savedJobs, savedQueue := jobs, jobQueue
+	t.Cleanup(func() { jobs, jobQueue = savedJobs, savedQueue })
+	jobs = make(map[string]*Job)
+	jobQueue = nil
+}
+
+func submitTestResult(ctx context.Context, req *minerpb.SubmitResultRequest) error {
+	req.Version = PROTOCOL_VERSION
+	_, err := (&minerServer{}).SubmitResult(ctx, req)
+	return err
+}
+
+// A job handed to a worker goes back to the queue once its lease runs out or the worker's session ends, results
+// of the run it was taken from are refused
+func TestJobLeaseRequeue(t *testing.T) {
+	jobNode(t)
+	token, err := publishTestKey(t, context.Background(), "w", newTestWorkerKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := withToken(token)
+	first := submitJob("save(\"a\", 1)", JobLimits{Timeout: 60})
+	second := submitJob("save(\"b\", 2)", JobLimits{})
+	if job := nextJob("w", sessionKey("w")); job != first {
+		t.Fatal("the oldest job was not handed out first")
+	}
+	if err := submitTestResult(ctx, &minerpb.SubmitResultRequest{WorkerId: "w", JobId: first.ID, Key: "a", Value: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// waiting in the worker's queue the job is held for the queue lease, once started for its timeout
+	now := time.Now()
+	if requeued := requeueExpiredJobs(now.Add(JOB_QUEUE_LEASE-time.Second), sessionHolds); len(requeued) != 0 {
+		t.Fatalf("queued again within the lease: %v", requeued)
+	}
+	if err := submitTestResult(ctx, &minerpb.SubmitResultRequest{WorkerId: "w", JobId: first.ID, Started: true}); err != nil {
+		t.Fatal(err)
+	}
+	if requeued := requeueExpiredJobs(now.Add(60*time.Second), sessionHolds); len(requeued) != 0 {
+		t.Fatalf("queued again before the timeout and grace period passed: %v", requeued)
+	}
+	if requeued := requeueExpiredJobs(now.Add(60*time.Second+JOB_LEASE_GRACE+time.Second), sessionHolds); len(requeued) != 1 || requeued[0] != first.ID {
+		t.Fatalf("queued again %v, want the expired job", requeued)
+	}
+	if job, _ := getJob(first.ID); job.Status != JOB_QUEUED || len(job.Results) != 0 || job.Worker != "" {
+		t.Fatalf("the expired job is %s with %d results on %q", job.Status, len(job.Results), job.Worker)
+	}
+	if len(jobQueue) != 2 || jobQueue[0] != first.ID || jobQueue[1] != second.ID {
+		t.Fatalf("queue %v, want the expired job ahead of younger ones", jobQueue)
+	}
+
+	// handed out again, the worker's session ends when it publishes a new key
+	nextJob("w", sessionKey("w"))
+	moved, err := publishTestKey(t, ctx, "w", newTestWorkerKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requeued := requeueExpiredJobs(time.Now(), sessionHolds); len(requeued) != 1 || requeued[0] != first.ID {
+		t.Fatalf("queued again %v, want the job of the ended session", requeued)
+	}
+	err = submitTestResult(withToken(moved), &minerpb.SubmitResultRequest{WorkerId: "w", JobId: first.ID, Key: "a", Value: []byte("1")})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("accepted a result of a job queued again: %v", err)
+	}
+}
+
+// The last accepted epoch of each worker survives a restart, older epochs stay refused
+func TestWorkerEpochsPersisted(t *testing.T) {
+	grpcNode(t)
+	savedDir, savedEpochs := dataDir, workerEpochs
+	t.Cleanup(func() { dataDir, workerEpochs = savedDir, savedEpochs })
+	dataDir = t.TempDir()
+	workerEpochs = make(map[string]uint64)
+	if err := loadWorkerEpochs(); err != nil || len(workerEpochs) != 0 {
+		t.Fatalf("a node without an epochs file loaded %v, %v", workerEpochs, err)
+	}
+
+	workerEpochs["w"] = 7
+	if err := saveWorkerEpochs(); err != nil {
+		t.Fatal(err)
+	}
+	// restarted
+	workerEpochs = make(map[string]uint64)
+	if err := loadWorkerEpochs(); err != nil || workerEpochs["w"] != 7 {
+		t.Fatalf("loaded %v, %v", workerEpochs, err)
+	}
+	token, err := publishTestKey(t, context.Background(), "w", newTestWorkerKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, epoch := range []uint64{1, 7} {
+		block := toProtoBlock(genesisBlock)
+		block.Epoch = epoch
+		res, err := (&minerServer{}).SubmitBlock(withToken(token), &minerpb.SubmitBlockRequest{Version: PROTOCOL_VERSION, WorkerId: "w", Block: block})
+		if err != nil || res.GetAccepted() || res.GetReason() != errStaleEpoch.Error() {
+			t.Fatalf("epoch %d answered %v, %v", epoch, res, err)
+		}
+	}
+
+	if err := os.WriteFile(epochsFile(), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadWorkerEpochs(); err == nil {
+		t.Fatal("a corrupt epochs file was accepted")
+	}
+}
+
+// Blocks posted by workers to /newblock
+func FuzzProcessBlock(f *testing.F) {
+	chain := fuzzNode(f)
+	next, err := simulatedBlock(chain[len(chain)-1], "", "", difficulty, 0)
+	if err != nil {
+		f.Fatal(err)
+	}
+	short := next
+	short.Proof = mustReport(f, []byte("0"))
+	f.Add(mustJSON(f, next))
+	f.Add(mustJSON(f, sealBlock(short)))
+	f.Add(mustJSON(f, chain[len(chain)-1]))
+	f.Add([]byte(`{"Index":"4"}`))
+	f.Add([]byte(""))
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		resetChain(chain)
+		w := httptest.NewRecorder()
+		processBlock(w, httptest.NewRequest(http.MethodPost, "/newblock", bytes.NewReader(body)))
+		if w.Code != http.StatusOK && w.Code != http.StatusBadRequest {
+			t.Fatalf("status %d", w.Code)
+		}
+		mutex.Lock()
+		grew := len(blockchain) == len(chain)+1
+		mutex.Unlock()
+		if w.Code == http.StatusOK && !grew {
+			t.Fatal("accepted a block without appending it")
+		}
+		assertValidChain(t)
+	})
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	KEYSTORE_VERSION = 1
+	// scrypt parameters of new keystores, about 100ms to derive a key
+	SCRYPT_N = 1 << 15
+	SCRYPT_R = 8
+	SCRYPT_P = 1
+	// bounds on the parameters of a keystore read from disk, a crafted file can't make scrypt take minutes or
+	// gigabytes, the memory scrypt needs is 128*N*R bytes
+	MAX_SCRYPT_N      = 1 << 20
+	MAX_SCRYPT_R      = 32
+	MAX_SCRYPT_P      = 16
+	MAX_SCRYPT_MEMORY = 1 << 30
+	MIN_SALT_SIZE     = 16
+)
+
+// A wallet key encrypted with a passphrase. The seed of the ed25519 key is sealed with AES-GCM under a key derived
+// from the passphrase with scrypt, the address is authenticated along with it.
+type Keystore struct {
+	Version    int
+	Address    string
+	KDF        KDFParams
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+type KDFParams struct {
+	N    int
+	R    int
+	P    int
+	Salt []byte
+}
+
+var errWrongPassphrase = errors.New("wrong passphrase or corrupt keystore")
+var errKeyExists = errors.New("a key with this name exists")
+
+func walletDir() string {
+	return filepath.Join(dataDir, "wallet")
+}
+
+func keystoreFile(name string) string {
+	return filepath.Join(walletDir(), name+".json")
+}
+
+func encryptKey(key ed25519.PrivateKey, passphrase string) (Keystore, error) {
+	k := Keystore{
+		Version: KEYSTORE_VERSION,
+		Address: addressOf(key.Public().(ed25519.PublicKey)),
+		KDF:     KDFParams{N: SCRYPT_N, R: SCRYPT_R, P: SCRYPT_P, Salt: make([]byte, 32)},
+	}
+	if _, err := rand.Read(k.KDF.Salt); err != nil {
+		return k, err
+	}
+	aead, err := k.cipher(passphrase)
+	if err != nil {
+		return k, err
+	}
+	k.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(k.Nonce); err != nil {
+		return k, err
+	}
+	k.Ciphertext = aead.Seal(nil, k.Nonce, key.Seed(), []byte(k.Address))
+	return k, nil
+}
+
+func (k Keystore) decrypt(passphrase string) (ed25519.PrivateKey, error) {
+	if k.Version != KEYSTORE_VERSION {
+		return nil, fmt.Errorf("unsupported keystore version %d", k.Version)
+	}
+	aead, err := k.cipher(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if len(k.Nonce) != aead.NonceSize() {
+		return nil, errWrongPassphrase
+	}
+	seed, err := aead.Open(nil, k.Nonce, k.Ciphertext, []byte(k.Address))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errWrongPassphrase
+	}
+	key := ed25519.NewKeyFromSeed(seed)
+	if addressOf(key.Public().(ed25519.PublicKey)) != k.Address {
+		return nil, errWrongPassphrase
+	}
+	return key, nil
+}
+
+// Rejects parameters scrypt would refuse and those that are too expensive to try
+func (p KDFParams) validate() error {
+	if p.N < 2 || p.N > MAX_SCRYPT_N || p.N&(p.N-1) != 0 {
+		return fmt.Errorf("scrypt N %d is not a power of two up to %d", p.N, MAX_SCRYPT_N)
+	}
+	if p.R < 1 || p.R > MAX_SCRYPT_R {
+		return fmt.Errorf("scrypt r %d is not between 1 and %d", p.R, MAX_SCRYPT_R)
+	}
+	if p.P < 1 || p.P > MAX_SCRYPT_P {
+		return fmt.Errorf("scrypt p %d is not between 1 and %d", p.P, MAX_SCRYPT_P)
+	}
+	if 128*p.N*p.R > MAX_SCRYPT_MEMORY {
+		return fmt.Errorf("scrypt N %d and r %d need more than %d bytes", p.N, p.R, MAX_SCRYPT_MEMORY)
+	}
+	if len(p.Salt) < MIN_SALT_SIZE {
+		return fmt.Errorf("scrypt salt of %d bytes is shorter than %d", len(p.Salt), MIN_SALT_SIZE)
+	}
+	return nil
+}
+
+func (k Keystore) cipher(passphrase string) (cipher.AEAD, error) {
+	if err := k.KDF.validate(); err != nil {
+		return nil, fmt.Errorf("keystore of %s: %w", k.Address, err)
+	}
+	secret, err := scrypt.Key([]byte(passphrase), k.KDF.Salt, k.KDF.N, k.KDF.R, k.KDF.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Writes a new keystore, an existing key is never replaced
+func writeKeystore(name string, k Keystore) error {
+	if err := os.MkdirAll(walletDir(), 0700); err != nil {
+		return err
+	}
+	bytes, err := json.MarshalIndent(k, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(keystoreFile(name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return fmt.Errorf("%s: %w", name, errKeyExists)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(bytes); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readKeystore(name string) (Keystore, error) {
+	var k Keystore
+	content, err := os.ReadFile(keystoreFile(name))
+	if err != nil {
+		return k, err
+	}
+	if err := json.Unmarshal(content, &k); err != nil {
+		return k, fmt.Errorf("%s: %w", keystoreFile(name), err)
+	}
+	return k, nil
+}
+
+// Names of the keys in the wallet directory, sorted
+func keystoreNames() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(walletDir(), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(files))
+	for i, f := range files {
+		names[i] = strings.TrimSuffix(filepath.Base(f), ".json")
+	}
+	sort.Strings(names)
+	return names, nil
+}
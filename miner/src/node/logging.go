@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/exp/slog"
+)
+
+// Subsystem loggers, every record carries its subsystem. Output and format are set by configureLogging.
+var (
+	p2pLog    *slog.Logger
+	chainLog  *slog.Logger
+	httpLog   *slog.Logger
+	workerLog *slog.Logger
+	attestLog *slog.Logger
+)
+
+// Minimum level logged, changed at runtime with log_setLevel
+var logLevel = new(slog.LevelVar)
+
+func init() {
+	setLogOutput(os.Stderr, false)
+}
+
+func setLogOutput(w io.Writer, json bool) {
+	opts := slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler = opts.NewTextHandler(w)
+	if json {
+		handler = opts.NewJSONHandler(w)
+	}
+	logger := slog.New(handler)
+	// libraries writing to the log package end up in the same output, at info level
+	slog.SetDefault(logger)
+	p2pLog = logger.With("subsystem", "p2p")
+	chainLog = logger.With("subsystem", "chain")
+	httpLog = logger.With("subsystem", "http")
+	workerLog = logger.With("subsystem", "worker")
+	attestLog = logger.With("subsystem", "attest")
+}
+
+func parseLogLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return slog.DebugLevel, nil
+	case "info":
+		return slog.InfoLevel, nil
+	case "warn":
+		return slog.WarnLevel, nil
+	case "error":
+		return slog.ErrorLevel, nil
+	}
+	return 0, fmt.Errorf("invalid log level %q", name)
+}
+
+// Sets the configured level and format, logs are written to stderr and to logs/<name>.log in the data directory
+func configureLogging(c *Config, name string) error {
+	level, err := parseLogLevel(c.LogLevel)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(level)
+
+	dir := filepath.Join(dataDir, "logs")
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, name+".log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	setLogOutput(io.MultiWriter(os.Stderr, f), c.LogFormat == "json")
+	return nil
+}
+
+// Logs at error level and exits, for errors the node can't run with
+func fatal(logger *slog.Logger, msg string, err error, args ...any) {
+	logger.Error(msg, err, args...)
+	os.Exit(1)
+}
@@ -2,31 +2,34 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
-	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/joho/godotenv"
-
 	"github.com/libp2p/go-libp2p"
-	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
 
 	"github.com/multiformats/go-multiaddr"
-
-	"github.com/edgelesssys/ego/eclient"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/exp/slog"
 )
 
 // Blockchain is a series of validated Blocks
@@ -34,61 +37,79 @@ import (
 type Blockchain []Block
 
 type Block struct {
-	Index    int
-	Txs      string
-	Hash     string
-	Nonce    uint32
-	PrevHash string
-	Proof    []byte
+	Index int
+	Txs   string
+	// Merkle root of Txs, the hash covers the root and the attestation binds it, so Txs can't be swapped
+	TxRoot string `json:",omitempty"`
+	// Commitments to the results of finished jobs and their Merkle root, covered and bound like Txs and TxRoot
+	Results    string `json:",omitempty"`
+	ResultRoot string `json:",omitempty"`
+	Hash       string
+	Nonce      uint32
+	PrevHash   string
+	Proof      []byte
+	// Operations and number of the worker's epoch sealed into the block, both must match the attestation
+	Operations uint64 `json:",omitempty"`
+	Epoch      uint64 `json:",omitempty"`
 }
 
 type Tx struct {
 	From   string
 	To     string
 	Amount int
-	Sig    string
+	// Makes otherwise equal transfers distinct, signatures don't differ for the same message
+	Nonce uint64 `json:",omitempty"`
+	Sig   string
+	// Set for governance transactions, which move no funds
+	Governance *Governance `json:",omitempty"`
 }
 
-var genesisBlock = Block{
-	Index:    0,
-	Txs:      "",
-	Hash:     "0000000000000000000000000000000000000000",
-	Nonce:    21,
-	PrevHash: "",
-	Proof:    []byte(""),
-}
+// Derived from the genesis file by configureNetwork
+var genesisBlock Block
+
+// Name of the default data directory below ~/.poc
+const DATA_DIR_NAME = "miner"
 
 var blockchain Blockchain
 var newBlock Block
 
 var mutex = &sync.Mutex{}
 
-var uniqueID string = "8a529934ab1359c62f551de5ff70d61229e1492a33a1e699a3de1bd1c1280e03"
 var difficulty int = 1
 
+var errInvalidBlock = errors.New("invalid block")
+var errBlockIndex = errors.New("index does not follow the previous block")
+var errPrevHash = errors.New("previous hash does not match")
+var errBlockHash = errors.New("hash does not match the block")
+var errDifficulty = errors.New("hash does not meet the difficulty")
+var errBlockWork = errors.New("block carries less work than required")
+
+// Operations a worker evaluates per block attempt, OPS_PER_BLOCK of the worker
+const MIN_BLOCK_OPERATIONS = 10000000
+
 func readBlockchain() Blockchain {
-	content, err := ioutil.ReadFile("./../../data/blockchain.json")
+	content, err := ioutil.ReadFile(chainFile())
 	if err != nil {
-		path := "./../../data"
+		path := filepath.Dir(chainFile())
 		err := os.MkdirAll(path, os.ModePerm)
 		if err != nil {
-			log.Fatalln(err)
+			fatal(chainLog, "Creating the chain directory failed", err)
 		}
 		blockchain = append(blockchain, genesisBlock)
 		bytes, err := json.MarshalIndent(blockchain, "", "  ")
 		if err != nil {
-			log.Fatalln("Failed to initialize blockchain", err)
+			fatal(chainLog, "Failed to initialize blockchain", err)
 		}
 
-		ioutil.WriteFile("./../../data/blockchain.json", bytes, 0644)
-		log.Println("Initialized blockchain with genesis block")
+		ioutil.WriteFile(chainFile(), bytes, 0644)
+		chainLog.Info("Initialized blockchain with genesis block", "genesis", genesisBlock.Hash)
 	}
-	content, err = ioutil.ReadFile("./../../data/blockchain.json")
+	content, err = ioutil.ReadFile(chainFile())
 	// Now let's unmarshall the data into `payload`
 	var payload Blockchain
 	err = json.Unmarshal(content, &payload)
 	if err != nil {
-		log.Fatal("Error during Unmarshal(): ", err)
+		fatal(chainLog, "Reading the chain failed", err, "file", chainFile())
 	}
 
 	// Let's print the unmarshalled data!
@@ -102,11 +123,12 @@ func writeBlock(newBlock Block) {
 
 	bytes, err := json.MarshalIndent(blockchain, "", "  ")
 	if err != nil {
-		log.Println("Error marshalling blockchain")
+		chainLog.Error("Marshalling blockchain failed", err)
 		return
 	}
-	_ = ioutil.WriteFile("./../../data/blockchain.json", bytes, 0644)
-
+	_ = ioutil.WriteFile(chainFile(), bytes, 0644)
+	observeChain(blockchain)
+	maybeSnapshot(blockchain)
 }
 
 func writeBlockchain(chain Blockchain) {
@@ -114,15 +136,20 @@ func writeBlockchain(chain Blockchain) {
 
 	bytes, err := json.MarshalIndent(blockchain, "", "  ")
 	if err != nil {
-		log.Println("Error marshalling blockchain")
+		chainLog.Error("Marshalling blockchain failed", err)
 		return
 	}
-	_ = ioutil.WriteFile("./../../data/blockchain.json", bytes, 0644)
-
+	_ = ioutil.WriteFile(chainFile(), bytes, 0644)
+	observeChain(blockchain)
+	maybeSnapshot(blockchain)
 }
 
 func calculateWork(chain Blockchain) int {
 	totalZeros := 0
+	// the work of a bootstrapped chain's first block is part of its base snapshot
+	if based(chain) {
+		totalZeros = base.Work - countLeadingZeros(chain[0].Hash)
+	}
 
 	for _, block := range chain {
 
@@ -147,7 +174,7 @@ func countLeadingZeros(hash string) int {
 
 // SHA256 hashing
 func calculateHash(block Block) string {
-	record := strconv.Itoa(block.Index) + block.PrevHash + strconv.Itoa(int(block.Nonce)) + string(block.Proof)
+	record := strconv.Itoa(block.Index) + block.PrevHash + strconv.Itoa(int(block.Nonce)) + block.TxRoot + block.ResultRoot + string(block.Proof)
 	h := sha256.New()
 	h.Write([]byte(record))
 	hashed := h.Sum(nil)
@@ -170,6 +197,11 @@ func handleStream(stream network.Stream) {
 
 	// Create a buffer stream for non blocking read and write.
 	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	if err := readHello(rw); err != nil {
+		p2pLog.Warn("Rejected peer", "peer", stream.Conn().RemotePeer(), "err", err)
+		stream.Reset()
+		return
+	}
 
 	go readData(rw)
 	//go writeData(rw)
@@ -181,8 +213,7 @@ func readData(rw *bufio.ReadWriter) {
 	for {
 		str, err := rw.ReadString('\n')
 		if err != nil {
-			fmt.Println("Error reading from buffer")
-			log.Println(err)
+			p2pLog.Debug("Reading from stream failed", "err", err)
 		}
 
 		if str == "" {
@@ -192,14 +223,38 @@ func readData(rw *bufio.ReadWriter) {
 
 			chain := make([]Block, 0)
 			if err := json.Unmarshal([]byte(str), &chain); err != nil {
-				fmt.Println("Error unmarshalling received blockchain")
-				log.Println(err)
+				p2pLog.Warn("Unmarshalling received blockchain failed", "err", err)
 			}
 
 			mutex.Lock()
-			if calculateWork(chain) > calculateWork(blockchain) {
-				log.Println("Heavier chain received")
+			if isStopping() {
+				mutex.Unlock()
+				return
+			}
+			chain, ok := fromBase(anchorChain(blockchain, chain))
+			adopt := false
+			if ok {
+				var err error
+				adopt, err = forkChoice(blockchain, chain)
+				if err != nil {
+					blockRejections.WithLabelValues(validationReason(err)).Inc()
+					countRejection(err)
+					chainLog.Warn("Rejected chain", "reason", validationReason(err), "err", err)
+					ok = false
+				}
+			}
+			if adopt {
+				chainLog.Info("Heavier chain received", "height", chain[len(chain)-1].Index, "tip", chain[len(chain)-1].Hash)
+				if isReorg(blockchain, chain) {
+					chainReorgs.Inc()
+					chainLog.Info("Reorganized chain", "old_tip", blockchain[len(blockchain)-1].Hash)
+				}
 				writeBlockchain(chain)
+				pruneMempool(chain)
+				notifyTip(chain[len(chain)-1])
+			}
+			if ok && len(chain) > 0 {
+				markSynced()
 			}
 			mutex.Unlock()
 		}
@@ -213,7 +268,7 @@ func writeData(rw *bufio.ReadWriter) {
 			mutex.Lock()
 			bytes, err := json.Marshal(blockchain)
 			if err != nil {
-				log.Println(err)
+				chainLog.Error("Marshalling blockchain failed", err)
 			}
 			mutex.Unlock()
 
@@ -227,51 +282,81 @@ func writeData(rw *bufio.ReadWriter) {
 
 }
 
-func isBlockValid(newBlock, oldBlock Block) bool {
-	if oldBlock.Index+1 != newBlock.Index {
+func isBlockValid(newBlock Block, chain Blockchain) bool {
+	start := time.Now()
+	err := checkBlock(newBlock, chain)
+	blockValidation.Observe(time.Since(start).Seconds())
+	if err != nil {
+		blockRejections.WithLabelValues(validationReason(err)).Inc()
+		countRejection(err)
+		chainLog.Warn("Rejected block", "index", newBlock.Index, "reason", validationReason(err), "err", err)
 		return false
 	}
+	return true
+}
+
+// Checks newBlock extends chain and its transactions are valid on top of it
+func checkBlock(newBlock Block, chain Blockchain) error {
+	return withChainState(chain, func(state *ChainState) error {
+		if err := checkHeader(newBlock, chain, state.policyAt(newBlock.Index)); err != nil {
+			return err
+		}
+		return state.applyBlock(newBlock)
+	})
+}
+
+// Checks newBlock's link, hash and difficulty, its attestation must come from an enclave the policy accepts at
+// the block's height. Light clients check headers only, the transactions are checked against the TxRoot by checkBlock.
+func checkHeader(newBlock Block, chain Blockchain, accepted AttestationPolicy) error {
+	oldBlock := chain[len(chain)-1]
+	if oldBlock.Index+1 != newBlock.Index {
+		return errBlockIndex
+	}
 	if oldBlock.Hash != newBlock.PrevHash {
-		return false
+		return errPrevHash
 	}
 	if calculateHash(newBlock) != newBlock.Hash {
-		return false
+		return errBlockHash
 	}
 	if validateHash(newBlock.Hash) != true {
-		return false
+		return errDifficulty
 	}
-	if verifyAttestation(newBlock.Proof, oldBlock.Hash) != true {
-		return false
-	}
-
-	return true
+	return checkAttestation(newBlock, oldBlock.Hash, accepted)
 }
 
-func verifyAttestation(attestation []byte, oldHash string) bool {
-	report, err := eclient.VerifyRemoteReport(attestation)
+// A block's report is bound to its parent, which makes it as fresh as a report can be, to the work sealed into
+// the block and to the block's content
+func checkAttestation(block Block, oldHash string, accepted AttestationPolicy) error {
+	report, err := accepted.verifyReport(block.Proof)
 	if err != nil {
-		log.Println(err)
-		return false
-	} else {
-		if hex.EncodeToString(report.UniqueID) == uniqueID {
-			data := report.Data
-			if validateHash(string(data[:32])) {
-				if string(data[:32]) == oldHash[:32] {
-					return true
-				} else {
-					return false
-				}
-
-			} else {
-				return false
-			}
-
-		} else {
-			log.Println("invalid enclave")
-			return false
-		}
-
+		return err
+	}
+	data := report.Data
+	// both come from peers, a report or parent hash too short to compare is rejected rather than sliced
+	if len(data) < 64 || len(oldHash) < 32 {
+		return errReportData
+	}
+	if !validateHash(string(data[:32])) || string(data[:32]) != oldHash[:32] {
+		return errReportData
+	}
+	if binary.BigEndian.Uint64(data[32:40]) != block.Operations || binary.BigEndian.Uint64(data[40:48]) != block.Epoch {
+		return errReportData
+	}
+	if !bytes.Equal(data[48:64], contentDigest(block)) {
+		return errReportData
 	}
+	// epochs are numbered from 1, an epoch sealed below the threshold is no block attempt
+	if block.Epoch == 0 || block.Operations < MIN_BLOCK_OPERATIONS {
+		return errBlockWork
+	}
+	return nil
+}
+
+// Report data [48:64] of a block's attestation, binds the block's transactions and result commitments to the
+// enclave that sealed it
+func contentDigest(block Block) []byte {
+	sum := sha256.Sum256([]byte(block.TxRoot + block.ResultRoot))
+	return sum[:16]
 }
 
 func processBlock(w http.ResponseWriter, req *http.Request) {
@@ -283,50 +368,98 @@ func processBlock(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	} else {
-		if isBlockValid(b, blockchain[len(blockchain)-1]) {
-			writeBlock(b)
-			log.Println("Blockchain updated with valid new block!")
+		if err := acceptBlock(b); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 		}
 	}
 }
 
-func spinUpServer() {
+// Validates a block produced by a worker and appends it to the chain
+func acceptBlock(b Block) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if isStopping() {
+		return errShuttingDown
+	}
+	if !isBlockValid(b, blockchain) {
+		return errInvalidBlock
+	}
+	writeBlock(b)
+	pruneMempool(Blockchain{b})
+	notifyTip(b)
+	chainLog.Info("Blockchain updated with valid new block", "index", b.Index, "hash", b.Hash)
+	return nil
+}
+
+func spinUpServer(server *http.Server) {
 	http.HandleFunc("/newblock", processBlock)
-	log.Println("Listening on port 4001")
-	http.ListenAndServe(":4001", nil)
+	http.HandleFunc("/rpc", handleRPC)
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/healthz", handleHealth)
+	http.HandleFunc("/readyz", handleReady)
+	httpLog.Info("Listening", "addr", server.Addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		fatal(httpLog, "HTTP server failed", err)
+	}
 }
 
 func main() {
-	godotenv.Load("../../../.env")
-	uniqueID = os.Getenv("UNIQUE_ID")
-	log.Println(uniqueID)
-	blockchain = readBlockchain()
-
-	go spinUpServer()
-
-	help := flag.Bool("help", false, "Display Help")
-	cfg := parseFlags()
-
-	if *help {
-		log.Printf("Simple example for peer discovery using mDNS. mDNS is great when you have multiple peers in local LAN.")
-		log.Printf("Usage: \n   Run './chat-with-mdns'\nor Run './chat-with-mdns -host [host] -port [port] -rendezvous [string] -pid [proto ID]'\n")
-
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:]))
+		}
+	}
+	cfg, err := loadConfig(os.Args[0], os.Args[1:])
+	if err == flag.ErrHelp {
 		os.Exit(0)
 	}
+	if err != nil {
+		fatal(slog.Default(), "Invalid config", err)
+	}
+	if err := setDataDir(cfg.DataDir); err != nil {
+		fatal(slog.Default(), "Invalid data directory", err)
+	}
+	if err := lockDataDir(); err != nil {
+		fatal(slog.Default(), "Locking the data directory failed", err)
+	}
+	if err := configureLogging(cfg, "node"); err != nil {
+		fatal(slog.Default(), "Configuring logging failed", err)
+	}
+	if err := configureAttestation(cfg); err != nil {
+		fatal(attestLog, "Configuring attestation failed", err)
+	}
+	if err := configureNetwork(cfg.GenesisFile); err != nil {
+		fatal(chainLog, "Configuring the network failed", err)
+	}
 
-	log.Printf("[*] Listening on: %s with port: %d\n", cfg.listenHost, cfg.listenPort)
+	if cfg.Bootstrap != "" {
+		if err := bootstrap(cfg.Bootstrap, cfg.Checkpoint); err != nil {
+			fatal(chainLog, "Bootstrapping failed", err)
+		}
+	}
+	blockchain = readBlockchain()
+	if blockchain[0].Index == 0 && blockchain[0].Hash != genesisBlock.Hash {
+		fatal(chainLog, "Chain file starts with another genesis block, it belongs to another network", nil, "file", chainFile(), "genesis", blockchain[0].Hash)
+	}
+	if err := loadBase(blockchain); err != nil {
+		fatal(chainLog, "Loading base snapshot failed", err)
+	}
+	observeChain(blockchain)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 
-	ctx := context.Background()
-	r := rand.Reader
+	server := &http.Server{Addr: cfg.HTTPAddr}
+	go spinUpServer(server)
+	go spinUpGRPC(cfg.GRPCAddr)
 
-	// Creates a new RSA key pair for this host.
-	prvKey, _, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, r)
+	prvKey, err := loadHostKey()
 	if err != nil {
-		panic(err)
+		fatal(p2pLog, "Loading host key failed", err)
 	}
 
 	// 0.0.0.0 will listen on any interface device.
-	sourceMultiAddr, _ := multiaddr.NewMultiaddr(fmt.Sprintf("/ip4/%s/tcp/%d", cfg.listenHost, cfg.listenPort))
+	sourceMultiAddr, _ := multiaddr.NewMultiaddr(fmt.Sprintf("/ip4/%s/tcp/%d", cfg.ListenHost, cfg.ListenPort))
 	// libp2p.New constructs a new libp2p Host.
 	// Other options can be added here.
 	host, err := libp2p.New(
@@ -334,37 +467,64 @@ func main() {
 		libp2p.Identity(prvKey),
 	)
 	if err != nil {
-		panic(err)
+		fatal(p2pLog, "Creating the libp2p host failed", err)
 	}
+	p2pHost = host
 
 	// Set a function as stream handler.
 	// This function is called when a peer initiates a connection and starts a stream with this peer.
 	host.SetStreamHandler(protocol.ID(cfg.ProtocolID), handleStream)
 
-	log.Printf("\n[*] Your Multiaddress Is: /ip4/%s/tcp/%v/p2p/%s\n", cfg.listenHost, cfg.listenPort, host.ID().Pretty())
+	p2pLog.Info("Listening", "addr", fmt.Sprintf("/ip4/%s/tcp/%v/p2p/%s", cfg.ListenHost, cfg.ListenPort, host.ID().Pretty()))
 
-	peerChan := initMDNS(host, cfg.RendezvousString)
+	peerChan := make(chan peer.AddrInfo)
+	if cfg.MDNS {
+		peerChan = initMDNS(host, cfg.Rendezvous)
+	}
+	staticPeers, _ := cfg.staticPeers()
+	go redialPeers(host, staticPeers, peerChan)
+	go func() {
+		for _, peer := range knownPeers() {
+			peerChan <- peer
+		}
+	}()
 	for { // allows multiple peers to join
-		peer := <-peerChan // will block untill we discover a peer
-		log.Println("Found peer:", peer, ", connecting")
-
-		if err := host.Connect(ctx, peer); err != nil {
-			log.Println("Connection failed:", err)
-			continue
+		select {
+		case <-ctx.Done():
+			// a second signal kills the node right away
+			stop()
+			os.Exit(shutdown(server, stopGRPC))
+		case peer := <-peerChan:
+			connectPeer(ctx, host, peer, protocol.ID(cfg.ProtocolID))
 		}
+	}
+}
 
-		// open a stream, this stream will be handled by handleStream other end
-		stream, err := host.NewStream(ctx, peer.ID, protocol.ID(cfg.ProtocolID))
+// Connects to a discovered peer and opens the stream our chain is sent on
+func connectPeer(ctx context.Context, host host.Host, peer peer.AddrInfo, pid protocol.ID) {
+	p2pLog.Info("Found peer, connecting", "peer", peer)
 
-		if err != nil {
-			log.Println("Stream open failed", err)
-		} else {
-			rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	if err := host.Connect(ctx, peer); err != nil {
+		p2pLog.Warn("Connection failed", "peer", peer.ID, "err", err)
+		return
+	}
+
+	// open a stream, this stream will be handled by handleStream other end
+	stream, err := host.NewStream(ctx, peer.ID, pid)
 
-			go writeData(rw)
-			//go readData(rw)
-			log.Println("Connected to:", peer)
+	if err != nil {
+		p2pLog.Warn("Stream open failed", "peer", peer.ID, "err", err)
+	} else {
+		rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+		if err := writeHello(rw); err != nil {
+			p2pLog.Warn("Handshake failed", "peer", peer.ID, "err", err)
+			stream.Reset()
+			return
 		}
-	}
 
+		go writeData(rw)
+		//go readData(rw)
+		p2pLog.Info("Connected", "peer", peer)
+		rememberPeer(peer)
+	}
 }
@@ -0,0 +1,353 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: miner/v2/miner.proto
+
+// Communication between a node and the workers mining for it.
+//
+// Versioning: the package is versioned (poc.miner.v2). Within v2 fields and
+// methods are only ever added, field numbers are never reused or renumbered.
+// Clients send the protocol version they were built against, the node rejects
+// versions newer than its own with FAILED_PRECONDITION. Breaking changes get a
+// new package (poc.miner.v3) served next to v2. v2 replaced poc.miner.v1, which
+// had no authentication and is no longer served: its calls fail with UNIMPLEMENTED.
+//
+// Authentication: a worker publishes its attested key first and gets a session
+// token sealed to that key. Every call but WatchTip carries the token in the
+// "worker-token" metadata, calls without a valid token for their worker_id fail
+// with UNAUTHENTICATED and the worker publishes its key again. A worker_id is
+// bound to the key of its session: publishing another key for it fails with
+// PERMISSION_DENIED while that key is fresh, unless the call carries the
+// session's token.
+
+package minerpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Miner_GetWork_FullMethodName      = "/poc.miner.v2.Miner/GetWork"
+	Miner_WatchTip_FullMethodName     = "/poc.miner.v2.Miner/WatchTip"
+	Miner_SubmitBlock_FullMethodName  = "/poc.miner.v2.Miner/SubmitBlock"
+	Miner_SubmitResult_FullMethodName = "/poc.miner.v2.Miner/SubmitResult"
+	Miner_ReportStats_FullMethodName  = "/poc.miner.v2.Miner/ReportStats"
+	Miner_PublishKey_FullMethodName   = "/poc.miner.v2.Miner/PublishKey"
+)
+
+// MinerClient is the client API for Miner service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type MinerClient interface {
+	// Returns the current chain tip and the next queued job, if any. Workers about to seal a block
+	// ask for the pending transactions instead of a job.
+	GetWork(ctx context.Context, in *GetWorkRequest, opts ...grpc.CallOption) (*Work, error)
+	// Streams the chain tip, starting with the current one and followed by every change.
+	WatchTip(ctx context.Context, in *WatchTipRequest, opts ...grpc.CallOption) (Miner_WatchTipClient, error)
+	// Submits a block mined by the worker.
+	SubmitBlock(ctx context.Context, in *SubmitBlockRequest, opts ...grpc.CallOption) (*SubmitBlockResponse, error)
+	// Submits a result produced while evaluating a job.
+	SubmitResult(ctx context.Context, in *SubmitResultRequest, opts ...grpc.CallOption) (*SubmitResultResponse, error)
+	// Reports worker statistics.
+	ReportStats(ctx context.Context, in *ReportStatsRequest, opts ...grpc.CallOption) (*ReportStatsResponse, error)
+	// Publishes the worker's public key for confidential jobs, together with an attestation binding it to the enclave.
+	PublishKey(ctx context.Context, in *PublishKeyRequest, opts ...grpc.CallOption) (*PublishKeyResponse, error)
+}
+
+type minerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewMinerClient(cc grpc.ClientConnInterface) MinerClient {
+	return &minerClient{cc}
+}
+
+func (c *minerClient) GetWork(ctx context.Context, in *GetWorkRequest, opts ...grpc.CallOption) (*Work, error) {
+	out := new(Work)
+	err := c.cc.Invoke(ctx, Miner_GetWork_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *minerClient) WatchTip(ctx context.Context, in *WatchTipRequest, opts ...grpc.CallOption) (Miner_WatchTipClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Miner_ServiceDesc.Streams[0], Miner_WatchTip_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &minerWatchTipClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Miner_WatchTipClient interface {
+	Recv() (*Tip, error)
+	grpc.ClientStream
+}
+
+type minerWatchTipClient struct {
+	grpc.ClientStream
+}
+
+func (x *minerWatchTipClient) Recv() (*Tip, error) {
+	m := new(Tip)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *minerClient) SubmitBlock(ctx context.Context, in *SubmitBlockRequest, opts ...grpc.CallOption) (*SubmitBlockResponse, error) {
+	out := new(SubmitBlockResponse)
+	err := c.cc.Invoke(ctx, Miner_SubmitBlock_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *minerClient) SubmitResult(ctx context.Context, in *SubmitResultRequest, opts ...grpc.CallOption) (*SubmitResultResponse, error) {
+	out := new(SubmitResultResponse)
+	err := c.cc.Invoke(ctx, Miner_SubmitResult_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *minerClient) ReportStats(ctx context.Context, in *ReportStatsRequest, opts ...grpc.CallOption) (*ReportStatsResponse, error) {
+	out := new(ReportStatsResponse)
+	err := c.cc.Invoke(ctx, Miner_ReportStats_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *minerClient) PublishKey(ctx context.Context, in *PublishKeyRequest, opts ...grpc.CallOption) (*PublishKeyResponse, error) {
+	out := new(PublishKeyResponse)
+	err := c.cc.Invoke(ctx, Miner_PublishKey_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// MinerServer is the server API for Miner service.
+// All implementations must embed UnimplementedMinerServer
+// for forward compatibility
+type MinerServer interface {
+	// Returns the current chain tip and the next queued job, if any. Workers about to seal a block
+	// ask for the pending transactions instead of a job.
+	GetWork(context.Context, *GetWorkRequest) (*Work, error)
+	// Streams the chain tip, starting with the current one and followed by every change.
+	WatchTip(*WatchTipRequest, Miner_WatchTipServer) error
+	// Submits a block mined by the worker.
+	SubmitBlock(context.Context, *SubmitBlockRequest) (*SubmitBlockResponse, error)
+	// Submits a result produced while evaluating a job.
+	SubmitResult(context.Context, *SubmitResultRequest) (*SubmitResultResponse, error)
+	// Reports worker statistics.
+	ReportStats(context.Context, *ReportStatsRequest) (*ReportStatsResponse, error)
+	// Publishes the worker's public key for confidential jobs, together with an attestation binding it to the enclave.
+	PublishKey(context.Context, *PublishKeyRequest) (*PublishKeyResponse, error)
+	mustEmbedUnimplementedMinerServer()
+}
+
+// UnimplementedMinerServer must be embedded to have forward compatible implementations.
+type UnimplementedMinerServer struct {
+}
+
+func (UnimplementedMinerServer) GetWork(context.Context, *GetWorkRequest) (*Work, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetWork not implemented")
+}
+func (UnimplementedMinerServer) WatchTip(*WatchTipRequest, Miner_WatchTipServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchTip not implemented")
+}
+func (UnimplementedMinerServer) SubmitBlock(context.Context, *SubmitBlockRequest) (*SubmitBlockResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SubmitBlock not implemented")
+}
+func (UnimplementedMinerServer) SubmitResult(context.Context, *SubmitResultRequest) (*SubmitResultResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SubmitResult not implemented")
+}
+func (UnimplementedMinerServer) ReportStats(context.Context, *ReportStatsRequest) (*ReportStatsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReportStats not implemented")
+}
+func (UnimplementedMinerServer) PublishKey(context.Context, *PublishKeyRequest) (*PublishKeyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PublishKey not implemented")
+}
+func (UnimplementedMinerServer) mustEmbedUnimplementedMinerServer() {}
+
+// UnsafeMinerServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to MinerServer will
+// result in compilation errors.
+type UnsafeMinerServer interface {
+	mustEmbedUnimplementedMinerServer()
+}
+
+func RegisterMinerServer(s grpc.ServiceRegistrar, srv MinerServer) {
+	s.RegisterService(&Miner_ServiceDesc, srv)
+}
+
+func _Miner_GetWork_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetWorkRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MinerServer).GetWork(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Miner_GetWork_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MinerServer).GetWork(ctx, req.(*GetWorkRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Miner_WatchTip_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchTipRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(MinerServer).WatchTip(m, &minerWatchTipServer{stream})
+}
+
+type Miner_WatchTipServer interface {
+	Send(*Tip) error
+	grpc.ServerStream
+}
+
+type minerWatchTipServer struct {
+	grpc.ServerStream
+}
+
+func (x *minerWatchTipServer) Send(m *Tip) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Miner_SubmitBlock_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SubmitBlockRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MinerServer).SubmitBlock(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Miner_SubmitBlock_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MinerServer).SubmitBlock(ctx, req.(*SubmitBlockRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Miner_SubmitResult_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SubmitResultRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MinerServer).SubmitResult(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Miner_SubmitResult_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MinerServer).SubmitResult(ctx, req.(*SubmitResultRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Miner_ReportStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReportStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MinerServer).ReportStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Miner_ReportStats_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MinerServer).ReportStats(ctx, req.(*ReportStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Miner_PublishKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PublishKeyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MinerServer).PublishKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Miner_PublishKey_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MinerServer).PublishKey(ctx, req.(*PublishKeyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Miner_ServiceDesc is the grpc.ServiceDesc for Miner service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Miner_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "poc.miner.v2.Miner",
+	HandlerType: (*MinerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetWork",
+			Handler:    _Miner_GetWork_Handler,
+		},
+		{
+			MethodName: "SubmitBlock",
+			Handler:    _Miner_SubmitBlock_Handler,
+		},
+		{
+			MethodName: "SubmitResult",
+			Handler:    _Miner_SubmitResult_Handler,
+		},
+		{
+			MethodName: "ReportStats",
+			Handler:    _Miner_ReportStats_Handler,
+		},
+		{
+			MethodName: "PublishKey",
+			Handler:    _Miner_PublishKey_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchTip",
+			Handler:       _Miner_WatchTip_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "miner/v2/miner.proto",
+}
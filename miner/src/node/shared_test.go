@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The full node in node/src is this node without the worker endpoints, every one of its files but main.go is a
+// copy of the file here. Its tests are copies too, so they cover the same code.
+func TestFullNodeSharesFiles(t *testing.T) {
+	full := filepath.Join("..", "..", "..", "node", "src")
+	files, err := filepath.Glob(filepath.Join(full, "*.go"))
+	if err != nil || len(files) == 0 {
+		t.Skip("the full node's sources are not next to this node's")
+	}
+	for _, file := range files {
+		name := filepath.Base(file)
+		if name == "main.go" {
+			continue
+		}
+		theirs, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ours, err := os.ReadFile(name)
+		if err != nil {
+			t.Errorf("%s of the full node has no counterpart here: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(ours, theirs) {
+			t.Errorf("%s differs between the nodes, copy it over after changing it", name)
+		}
+	}
+	for _, name := range []string{"consensus_test.go", "sim_test.go", "fuzz_test.go"} {
+		if _, err := os.Stat(filepath.Join(full, name)); err != nil {
+			t.Errorf("the full node doesn't run %s", name)
+		}
+	}
+}
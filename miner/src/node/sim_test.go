@@ -0,0 +1,254 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/edgelesssys/ego/attestation"
+)
+
+// Interval at which simulated nodes send their chain to their peers, like writeData
+const SIM_SYNC_INTERVAL = 5 * time.Second
+
+// A deterministic network of nodes. Every node runs the node's block validation and fork choice on its own chain,
+// chains travel through an in-memory transport and time is virtual, so a scenario replays exactly for a seed.
+type Simulation struct {
+	t       *testing.T
+	now     time.Duration
+	events  simQueue
+	seq     int
+	rand    *rand.Rand
+	latency time.Duration
+	jitter  time.Duration
+	nodes   []*SimNode
+	// links cut by a partition, by sender and receiver
+	cut map[[2]int]bool
+}
+
+type SimNode struct {
+	id    int
+	chain Blockchain
+	// received chains that replaced the node's chain
+	adopted int
+	// received chains rejected by the fork choice
+	rejected int
+}
+
+type simEvent struct {
+	at  time.Duration
+	seq int
+	run func()
+}
+
+// Events ordered by time, events at the same time in the order they were scheduled
+type simQueue []simEvent
+
+func (q simQueue) Len() int { return len(q) }
+func (q simQueue) Less(i, j int) bool {
+	return q[i].at < q[j].at || q[i].at == q[j].at && q[i].seq < q[j].seq
+}
+func (q simQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *simQueue) Push(x interface{}) { *q = append(*q, x.(simEvent)) }
+func (q *simQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+// Sets up the network configuration shared by all nodes: the default genesis with a policy accepting the
+// simulated enclave and simulated attestation. The globals are restored when the test ends.
+func configureSimulatedNetwork(tb testing.TB) {
+	savedGenesis, savedVerify, savedBase := genesis, verifyRemoteReport, base
+	tb.Cleanup(func() {
+		verifyRemoteReport, base = savedVerify, savedBase
+		configureGenesis(savedGenesis)
+	})
+	setLogOutput(io.Discard, false)
+	g := defaultGenesis
+	g.Policy = &AttestationPolicy{UniqueIDs: []string{SIMULATED_UNIQUE_ID}, AllowDebug: true}
+	if err := configureGenesis(g); err != nil {
+		tb.Fatal(err)
+	}
+	verifyRemoteReport = verifySimulatedReport
+	base = nil
+}
+
+func newSimulation(t *testing.T, nodes int, seed int64) *Simulation {
+	configureSimulatedNetwork(t)
+	s := &Simulation{t: t, rand: rand.New(rand.NewSource(seed)), latency: 50 * time.Millisecond, cut: make(map[[2]int]bool)}
+	for i := 0; i < nodes; i++ {
+		n := &SimNode{id: i, chain: Blockchain{genesisBlock}}
+		s.nodes = append(s.nodes, n)
+		// nodes don't sync in lockstep
+		s.every(time.Duration(s.rand.Int63n(int64(SIM_SYNC_INTERVAL))), SIM_SYNC_INTERVAL, func() { s.sync(n) })
+	}
+	return s
+}
+
+// Runs fn at the virtual time at
+func (s *Simulation) at(at time.Duration, fn func()) {
+	s.seq++
+	heap.Push(&s.events, simEvent{at: at, seq: s.seq, run: fn})
+}
+
+// Runs fn at start and every interval after
+func (s *Simulation) every(start time.Duration, interval time.Duration, fn func()) {
+	var tick func()
+	tick = func() {
+		fn()
+		s.at(s.now+interval, tick)
+	}
+	s.at(start, tick)
+}
+
+// Processes events until the virtual time reaches until
+func (s *Simulation) run(until time.Duration) {
+	for s.events.Len() > 0 && s.events[0].at <= until {
+		e := heap.Pop(&s.events).(simEvent)
+		s.now = e.at
+		e.run()
+	}
+	s.now = until
+}
+
+// Sends the node's chain to every peer it can reach
+func (s *Simulation) sync(n *SimNode) {
+	for _, peer := range s.nodes {
+		if peer != n {
+			s.send(n.id, peer, n.chain)
+		}
+	}
+}
+
+// Delivers a chain after the link's latency, chains crossing a partition are lost
+func (s *Simulation) send(from int, to *SimNode, chain Blockchain) {
+	if s.cut[[2]int{from, to.id}] {
+		return
+	}
+	// chains are sent as json, the receiver never shares memory with the sender
+	encoded, err := json.Marshal(chain)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	delay := s.latency
+	if s.jitter > 0 {
+		delay += time.Duration(s.rand.Int63n(int64(s.jitter)))
+	}
+	s.at(s.now+delay, func() {
+		if s.cut[[2]int{from, to.id}] {
+			return
+		}
+		var received Blockchain
+		if err := json.Unmarshal(encoded, &received); err != nil {
+			s.t.Fatal(err)
+		}
+		s.receive(to, received)
+	})
+}
+
+// What readData does with a received chain
+func (s *Simulation) receive(n *SimNode, chain Blockchain) {
+	chain = anchorChain(n.chain, chain)
+	adopt, err := forkChoice(n.chain, chain)
+	if err != nil {
+		n.rejected++
+		return
+	}
+	if adopt {
+		n.chain = chain
+		n.adopted++
+	}
+}
+
+// Mines a block on the node's tip, as if one of its workers submitted it
+func (s *Simulation) mine(n *SimNode) Block {
+	block, err := simulatedBlock(n.chain[len(n.chain)-1], "", "", difficulty, s.rand.Uint32())
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.extend(n, block)
+	return block
+}
+
+// What acceptBlock does with a block submitted by a worker
+func (s *Simulation) extend(n *SimNode, block Block) {
+	if err := checkBlock(block, n.chain); err != nil {
+		s.t.Fatalf("node %d rejected its own block: %v", n.id, err)
+	}
+	n.chain = append(n.chain[:len(n.chain):len(n.chain)], block)
+}
+
+// Mines on the node about every interval between start and stop
+func (s *Simulation) miner(n *SimNode, start time.Duration, stop time.Duration, interval time.Duration) {
+	next := start
+	for next < stop {
+		next += interval/2 + time.Duration(s.rand.Int63n(int64(interval)))
+		if next < stop {
+			s.at(next, func() { s.mine(n) })
+		}
+	}
+}
+
+// Cuts every link between nodes of different groups
+func (s *Simulation) partition(groups ...[]int) {
+	group := make(map[int]int)
+	for g, ids := range groups {
+		for _, id := range ids {
+			group[id] = g
+		}
+	}
+	for _, a := range s.nodes {
+		for _, b := range s.nodes {
+			if group[a.id] != group[b.id] {
+				s.cut[[2]int{a.id, b.id}] = true
+			}
+		}
+	}
+}
+
+func (s *Simulation) heal() {
+	s.cut = make(map[[2]int]bool)
+}
+
+func (s *Simulation) tip(id int) Block {
+	chain := s.nodes[id].chain
+	return chain[len(chain)-1]
+}
+
+// Fails the test unless all nodes have the same tip and a valid chain
+func (s *Simulation) assertConverged() {
+	s.t.Helper()
+	for _, n := range s.nodes {
+		if tip := s.tip(n.id); tip.Hash != s.tip(0).Hash {
+			s.t.Fatalf("node %d is at block %d %s, node 0 at block %d %s", n.id, tip.Index, tip.Hash, s.tip(0).Index, s.tip(0).Hash)
+		}
+		if i, err := verifyChain(n.chain); err != nil {
+			s.t.Fatalf("node %d holds an invalid block %d: %v", n.id, i, err)
+		}
+	}
+}
+
+// A simulated report on the parent's hash from an enclave with the given UniqueID
+func simulatedProof(t *testing.T, parentHash string, uniqueID []byte) []byte {
+	report, err := json.Marshal(attestation.Report{Data: simulatedReportData(Block{PrevHash: parentHash}), Debug: true, UniqueID: uniqueID, SignerID: make([]byte, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte(SIMULATED_REPORT_PREFIX), report...)
+}
+
+// Searches the nonce until the block's hash meets the difficulty
+func sealBlock(block Block) Block {
+	for {
+		block.Hash = calculateHash(block)
+		if countLeadingZeros(block.Hash) >= difficulty {
+			return block
+		}
+		block.Nonce++
+	}
+}
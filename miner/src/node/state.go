@@ -0,0 +1,910 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Transactions waiting to be included in a block, keyed by tx hash
+var mempool = make(map[string]Tx)
+var mempoolMutex = &sync.Mutex{}
+
+// Jobs submitted through the api, waiting to be picked up by a worker
+var jobs = make(map[string]*Job)
+var jobQueue []string
+var jobMutex = &sync.Mutex{}
+
+// Public keys published by attested workers, clients seal confidential jobs to them
+var workerKeys = make(map[string]WorkerKey)
+var workerKeysMutex = &sync.Mutex{}
+
+// A transfer of an account as listed by account_getHistory
+type HistoryEntry struct {
+	Hash   string
+	Status string
+	// -1 while pending
+	Block int
+	Tx    Tx
+}
+
+type Job struct {
+	ID        string
+	Script    string
+	Status    string
+	Submitted int64
+	Worker    string
+	// Key of the worker the job was assigned to, its result commitment is by this key
+	WorkerKey string `json:",omitempty"`
+	Limits    JobLimits
+	// Unix nanoseconds until which the running job is held for its worker, it's queued again after that
+	Lease   int64 `json:",omitempty"`
+	Results []JobResult
+	Abort   *JobAbort `json:",omitempty"`
+	// Confidential jobs carry their script sealed to the key of the worker they were submitted for
+	Confidential bool
+	Sealed       []byte `json:"-"`
+}
+
+// Resource limits for evaluating a job, zero values leave the choice to the worker
+type JobLimits struct {
+	MaxOperations uint64
+	Timeout       uint32
+	MaxMemory     uint64
+}
+
+type JobAbort struct {
+	Reason     string
+	Operations uint64
+	ElapsedMs  uint64
+}
+
+type JobResult struct {
+	Key   string
+	Value json.RawMessage
+}
+
+type WorkerKey struct {
+	Worker    string
+	PublicKey []byte
+	Report    []byte
+	Published int64
+	// Index of the block the report references
+	Height int
+}
+
+const (
+	TX_PENDING   = "pending"
+	TX_CONFIRMED = "confirmed"
+	TX_UNKNOWN   = "unknown"
+
+	JOB_QUEUED  = "queued"
+	JOB_RUNNING = "running"
+	JOB_DONE    = "done"
+	JOB_ABORTED = "aborted"
+
+	// A job handed to a worker is held while it waits in the worker's queue at most this long, once the worker
+	// starts it until its timeout and the grace period have passed
+	JOB_QUEUE_LEASE = 30 * time.Minute
+	JOB_LEASE_GRACE = time.Minute
+	// Timeout workers apply to jobs that don't set one
+	DEFAULT_JOB_TIMEOUT = 10 * time.Minute
+
+	// Transactions a block may carry at most
+	MAX_BLOCK_TXS = 1000
+	// Pending transfers kept at most, governance transactions are always kept
+	MAX_MEMPOOL_TXS = 10 * MAX_BLOCK_TXS
+)
+
+var errInvalidTx = errors.New("invalid transaction")
+var errBlockTxs = errors.New("invalid block transactions")
+var errTxRoot = errors.New("transaction root does not match the block's transactions")
+var errDuplicateTx = errors.New("transaction included before")
+var errStaleNonce = errors.New("transaction nonce not above the account's last one")
+var errInsufficientFunds = errors.New("insufficient funds")
+var errMempoolFull = errors.New("mempool full, the account has too many pending transactions")
+var errInvalidSignature = errors.New("invalid transaction signature")
+var errUnknownJob = errors.New("unknown job")
+var errUnknownWorker = errors.New("unknown worker")
+var errJobNotAssigned = errors.New("job is not running on the worker")
+var errInvalidKey = errors.New("public key not bound to an accepted enclave")
+var errStaleKey = errors.New("worker key expired")
+
+// SHA256 hashing of a transaction over the message its signature covers. The signature itself is left out,
+// a re-encoded signature of the same transaction must not make it a different one.
+func calculateTxHash(tx Tx) string {
+	record := txMessage(tx)
+	if tx.Governance != nil {
+		record = governanceMessage(*tx.Governance)
+	}
+	hashed := sha256.Sum256(record)
+	return hex.EncodeToString(hashed[:])
+}
+
+// Txs of a block are stored as a json encoded list of transactions
+func blockTxs(block Block) []Tx {
+	txs, err := decodeTxs(block.Txs)
+	if err != nil {
+		return make([]Tx, 0)
+	}
+	return txs
+}
+
+func decodeTxs(encoded string) ([]Tx, error) {
+	txs := make([]Tx, 0)
+	if encoded == "" {
+		return txs, nil
+	}
+	err := json.Unmarshal([]byte(encoded), &txs)
+	return txs, err
+}
+
+func encodeTxs(txs []Tx) string {
+	if len(txs) == 0 {
+		return ""
+	}
+	bytes, err := json.Marshal(txs)
+	if err != nil {
+		return ""
+	}
+	return string(bytes)
+}
+
+// Balances, included transactions and the attestation policy as of a block. Blocks are applied one by one on
+// top of their parent's state, so checking a chain doesn't replay it from the start for every block.
+type ChainState struct {
+	Balances map[string]int
+	// Hashes of the included transactions, a copy of one is rejected
+	Seen map[string]bool
+	// Nonce of the last included transfer of each account, the next one must be higher
+	Nonces map[string]uint64
+	// Result commitments, by commitmentKey, with the index of the block committing them
+	Committed map[string]int
+	// Governance transactions included so far, in chain order
+	Governance []GovernanceRecord
+	// Policy as of the last policyAt, pending holds the governance transactions that haven't taken effect yet
+	policy  AttestationPolicy
+	pending []GovernanceRecord
+	// Changes since the last mark, recorded while they may have to be reverted
+	undo *stateUndo
+}
+
+// Values a state held before the changes since its mark, nil for entries that didn't exist
+type stateUndo struct {
+	balances   map[string]*int
+	nonces     map[string]*uint64
+	seen       []string
+	committed  []string
+	governance int
+	policy     AttestationPolicy
+	pending    []GovernanceRecord
+}
+
+// Reorgs deeper than this rebuild the tip state from the start of the chain
+const STATE_UNDO_BLOCKS = 100
+
+// State at the tip of the chain last asked for. It moves to another chain by reverting its blocks past the
+// common prefix and applying the other chain's, so checking a block doesn't replay the chain.
+type stateCache struct {
+	anchor string
+	base   *Snapshot
+	state  *ChainState
+	// The blocks applied after the anchor, their undo records are dropped once STATE_UNDO_BLOCKS deep
+	blocks []appliedBlock
+}
+
+type appliedBlock struct {
+	hash string
+	undo *stateUndo
+}
+
+var tipState stateCache
+var tipStateMutex = &sync.Mutex{}
+
+// State after the chain's first block: the genesis balances, or the base snapshot's state for a chain
+// bootstrapped from one
+func initialState(chain Blockchain) *ChainState {
+	s := &ChainState{Balances: make(map[string]int), Seen: make(map[string]bool), Nonces: make(map[string]uint64), Committed: make(map[string]int), policy: genesis.basePolicy()}
+	initial := genesis.Balances
+	if based(chain) {
+		initial = base.Balances
+		for _, hash := range base.TxHashes {
+			s.Seen[hash] = true
+		}
+		for address, nonce := range base.Nonces {
+			s.Nonces[address] = nonce
+		}
+		for key, index := range base.Committed {
+			s.Committed[key] = index
+		}
+		for _, record := range base.Governance {
+			s.addGovernance(record)
+		}
+	}
+	for address, balance := range initial {
+		s.Balances[address] = balance
+	}
+	return s
+}
+
+// Starts recording changes, revert undoes the changes made after this mark
+func (s *ChainState) mark() *stateUndo {
+	s.undo = &stateUndo{
+		balances:   make(map[string]*int),
+		nonces:     make(map[string]*uint64),
+		governance: len(s.Governance),
+		policy:     s.policy.clone(),
+		pending:    append([]GovernanceRecord(nil), s.pending...),
+	}
+	return s.undo
+}
+
+// Restores the state as of u's mark, later marks must have been reverted before
+func (s *ChainState) revert(u *stateUndo) {
+	for address, balance := range u.balances {
+		if balance == nil {
+			delete(s.Balances, address)
+		} else {
+			s.Balances[address] = *balance
+		}
+	}
+	for address, nonce := range u.nonces {
+		if nonce == nil {
+			delete(s.Nonces, address)
+		} else {
+			s.Nonces[address] = *nonce
+		}
+	}
+	for _, hash := range u.seen {
+		delete(s.Seen, hash)
+	}
+	for _, key := range u.committed {
+		delete(s.Committed, key)
+	}
+	s.Governance = s.Governance[:u.governance]
+	s.policy, s.pending = u.policy, u.pending
+	s.undo = nil
+}
+
+func (s *ChainState) setBalance(address string, balance int) {
+	if s.undo != nil {
+		if _, ok := s.undo.balances[address]; !ok {
+			if old, ok := s.Balances[address]; ok {
+				s.undo.balances[address] = &old
+			} else {
+				s.undo.balances[address] = nil
+			}
+		}
+	}
+	s.Balances[address] = balance
+}
+
+func (s *ChainState) setNonce(address string, nonce uint64) {
+	if s.undo != nil {
+		if _, ok := s.undo.nonces[address]; !ok {
+			if old, ok := s.Nonces[address]; ok {
+				s.undo.nonces[address] = &old
+			} else {
+				s.undo.nonces[address] = nil
+			}
+		}
+	}
+	s.Nonces[address] = nonce
+}
+
+// Marks a transaction included, callers made sure it wasn't before
+func (s *ChainState) see(hash string) {
+	if s.undo != nil {
+		s.undo.seen = append(s.undo.seen, hash)
+	}
+	s.Seen[hash] = true
+}
+
+// Records a result commitment, callers made sure there was none by the key before
+func (s *ChainState) commit(key string, index int) {
+	if s.undo != nil {
+		s.undo.committed = append(s.undo.committed, key)
+	}
+	s.Committed[key] = index
+}
+
+// Runs f on the state after the chain's tip, fails if one of the chain's blocks doesn't apply. The changes f
+// makes are reverted afterwards, the state must not be kept past f.
+func withChainState(chain Blockchain, f func(s *ChainState) error) error {
+	tipStateMutex.Lock()
+	defer tipStateMutex.Unlock()
+	if err := tipState.moveTo(chain); err != nil {
+		return err
+	}
+	u := tipState.state.mark()
+	defer tipState.state.revert(u)
+	return f(tipState.state)
+}
+
+func (c *stateCache) reset(chain Blockchain) {
+	c.anchor, c.base, c.state, c.blocks = chain[0].Hash, base, initialState(chain), nil
+}
+
+// Moves the state to the chain's tip, a block that doesn't apply leaves it at the block's parent
+func (c *stateCache) moveTo(chain Blockchain) error {
+	if c.state == nil || c.anchor != chain[0].Hash || c.base != base {
+		c.reset(chain)
+	}
+	// a block's hash covers its parent's, the chains are the same up to the last block they share
+	shared := len(c.blocks)
+	if shared > len(chain)-1 {
+		shared = len(chain) - 1
+	}
+	for shared > 0 && c.blocks[shared-1].hash != chain[shared].Hash {
+		shared--
+	}
+	for len(c.blocks) > shared {
+		last := c.blocks[len(c.blocks)-1]
+		if last.undo == nil {
+			c.reset(chain)
+			break
+		}
+		c.state.revert(last.undo)
+		c.blocks = c.blocks[:len(c.blocks)-1]
+	}
+	for _, block := range chain[len(c.blocks)+1:] {
+		u := c.state.mark()
+		if err := c.state.applyBlock(block); err != nil {
+			c.state.revert(u)
+			return fmt.Errorf("block %d: %w", block.Index, err)
+		}
+		c.state.undo = nil
+		c.blocks = append(c.blocks, appliedBlock{hash: block.Hash, undo: u})
+		if deep := len(c.blocks) - STATE_UNDO_BLOCKS - 1; deep >= 0 {
+			c.blocks[deep].undo = nil
+		}
+	}
+	return nil
+}
+
+// State after the chain's tip replayed from the start of the chain, fails if one of its blocks doesn't apply.
+// Without withTxs only the governance transactions are applied, which is all light clients need.
+func stateAt(chain Blockchain, withTxs bool) (*ChainState, error) {
+	s := initialState(chain)
+	for _, block := range chain[1:] {
+		apply := s.applyGovernance
+		if withTxs {
+			apply = s.applyBlock
+		}
+		if err := apply(block); err != nil {
+			return nil, fmt.Errorf("block %d: %w", block.Index, err)
+		}
+	}
+	return s, nil
+}
+
+// Checks the block's transactions and result commitments against the state of its parent and applies them.
+// The state is left partially applied if one is invalid.
+func (s *ChainState) applyBlock(block Block) error {
+	txs, err := decodeTxs(block.Txs)
+	// the encoding is canonical, so the Merkle leaves are the encoded transactions the worker sealed
+	if err != nil || encodeTxs(txs) != block.Txs || len(txs) > MAX_BLOCK_TXS {
+		return errBlockTxs
+	}
+	if merkleRoot(txLeaves(txs)) != block.TxRoot {
+		return errTxRoot
+	}
+	for _, tx := range txs {
+		if err := s.applyTx(tx, block.Index); err != nil {
+			return fmt.Errorf("%w: %s: %v", errBlockTxs, calculateTxHash(tx), err)
+		}
+	}
+	return s.applyResults(block)
+}
+
+// Checks the transaction may be included in the block at index and applies it
+func (s *ChainState) applyTx(tx Tx, index int) error {
+	hash := calculateTxHash(tx)
+	if s.Seen[hash] {
+		return errDuplicateTx
+	}
+	if tx.Governance != nil {
+		// governance transactions must be included before they activate
+		if tx.From != "" || tx.To != "" || tx.Amount != 0 || tx.Governance.Height <= index {
+			return errInvalidGovernance
+		}
+		if err := verifyGovernance(tx); err != nil {
+			return err
+		}
+		s.addGovernance(GovernanceRecord{Block: index, Tx: tx})
+	} else {
+		if !isAddress(tx.From) || !isAddress(tx.To) || tx.Amount <= 0 {
+			return errInvalidTx
+		}
+		if err := verifyTx(tx); err != nil {
+			return err
+		}
+		if tx.Nonce <= s.Nonces[tx.From] {
+			return errStaleNonce
+		}
+		if s.Balances[tx.From] < tx.Amount {
+			return errInsufficientFunds
+		}
+		s.setBalance(tx.From, s.Balances[tx.From]-tx.Amount)
+		s.setBalance(tx.To, s.Balances[tx.To]+tx.Amount)
+		s.setNonce(tx.From, tx.Nonce)
+	}
+	s.see(hash)
+	return nil
+}
+
+// Balance of the address after the chain's tip. Accounts start with their genesis balances, or with the
+// snapshot's balances for a chain bootstrapped from one.
+func accountBalance(chain Blockchain, address string) (int, error) {
+	balance := 0
+	err := withChainState(chain, func(s *ChainState) error {
+		balance = s.Balances[address]
+		return nil
+	})
+	return balance, err
+}
+
+// Replays all of the chain's transactions from its start, applied is called for every transfer.
+// Blocks are checked before they join the chain, a transaction that doesn't apply is skipped all the same.
+func replayTxs(chain Blockchain, applied func(block Block, tx Tx)) *ChainState {
+	s := initialState(chain)
+	for _, block := range chain[1:] {
+		for _, tx := range blockTxs(block) {
+			if s.applyTx(tx, block.Index) != nil || tx.Governance != nil {
+				continue
+			}
+			if applied != nil {
+				applied(block, tx)
+			}
+		}
+		s.applyResults(block)
+	}
+	return s
+}
+
+// Pending transactions valid on top of the state for a block at height, as many as fit in a block, which are
+// applied to the state. Transfers of an account are taken in nonce order.
+func blockCandidates(s *ChainState, height int) []Tx {
+	txs := make([]Tx, 0)
+	pending := pendingTxs()
+	sort.Slice(pending, func(i, j int) bool {
+		if pending[i].From != pending[j].From {
+			return pending[i].From < pending[j].From
+		}
+		if pending[i].Nonce != pending[j].Nonce {
+			return pending[i].Nonce < pending[j].Nonce
+		}
+		return calculateTxHash(pending[i]) < calculateTxHash(pending[j])
+	})
+	for _, tx := range pending {
+		if len(txs) == MAX_BLOCK_TXS {
+			break
+		}
+		if s.applyTx(tx, height) == nil {
+			txs = append(txs, tx)
+		}
+	}
+	return txs
+}
+
+// Transfers from or to the address, confirmed ones in chain order followed by pending ones
+func accountHistory(chain Blockchain, address string) []HistoryEntry {
+	history := make([]HistoryEntry, 0)
+	replayTxs(chain, func(block Block, tx Tx) {
+		if tx.From == address || tx.To == address {
+			history = append(history, HistoryEntry{Hash: calculateTxHash(tx), Status: TX_CONFIRMED, Block: block.Index, Tx: tx})
+		}
+	})
+	pending := make([]HistoryEntry, 0)
+	for _, tx := range pendingTxs() {
+		if tx.Governance == nil && (tx.From == address || tx.To == address) {
+			pending = append(pending, HistoryEntry{Hash: calculateTxHash(tx), Status: TX_PENDING, Block: -1, Tx: tx})
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Tx.Nonce < pending[j].Tx.Nonce })
+	return append(history, pending...)
+}
+
+// Looks up the index of the block containing the transaction, -1 if it is not in the chain
+func findTx(chain Blockchain, hash string) int {
+	for i := len(chain) - 1; i >= 0; i-- {
+		for _, tx := range blockTxs(chain[i]) {
+			if calculateTxHash(tx) == hash {
+				return chain[i].Index
+			}
+		}
+	}
+	return -1
+}
+
+func addTx(tx Tx) (string, error) {
+	if tx.Governance != nil {
+		return addGovernanceTx(tx)
+	}
+	if !isAddress(tx.From) || !isAddress(tx.To) || tx.Amount <= 0 {
+		return "", errInvalidTx
+	}
+	if err := verifyTx(tx); err != nil {
+		return "", err
+	}
+	hash := calculateTxHash(tx)
+
+	var confirmed bool
+	var nonce uint64
+	var balance int
+	mutex.Lock()
+	err := withChainState(blockchain, func(s *ChainState) error {
+		confirmed, nonce, balance = s.Seen[hash], s.Nonces[tx.From], s.Balances[tx.From]
+		return nil
+	})
+	mutex.Unlock()
+	if err != nil {
+		return "", err
+	}
+	if confirmed {
+		return hash, nil
+	}
+	if tx.Nonce <= nonce {
+		return "", errStaleNonce
+	}
+
+	mempoolMutex.Lock()
+	defer mempoolMutex.Unlock()
+	if _, ok := mempool[hash]; ok {
+		return hash, nil
+	}
+	pending := 0
+	for _, p := range mempool {
+		if p.From == tx.From {
+			pending += p.Amount
+		}
+	}
+	if balance-pending < tx.Amount {
+		return "", errInsufficientFunds
+	}
+	if len(mempool) >= MAX_MEMPOOL_TXS {
+		if err := evictPending(tx); err != nil {
+			return "", err
+		}
+	}
+	mempool[hash] = tx
+	return hash, nil
+}
+
+// Makes room for the transfer in the full mempool, callers hold mempoolMutex. Transfers of the accounts with the
+// most pending transfers have the lowest priority, of those the one with the highest nonce is dropped, it would be
+// included last anyway. Fails if that is the new transfer itself. Governance transactions are never dropped.
+func evictPending(tx Tx) error {
+	counts := map[string]int{tx.From: 1}
+	for _, p := range mempool {
+		if p.Governance == nil {
+			counts[p.From]++
+		}
+	}
+	lower := func(a Tx, b Tx) bool {
+		if counts[a.From] != counts[b.From] {
+			return counts[a.From] > counts[b.From]
+		}
+		if a.Nonce != b.Nonce {
+			return a.Nonce > b.Nonce
+		}
+		return a.From > b.From
+	}
+	evict, lowest := "", tx
+	for hash, p := range mempool {
+		if p.Governance == nil && lower(p, lowest) {
+			evict, lowest = hash, p
+		}
+	}
+	if evict == "" {
+		return errMempoolFull
+	}
+	delete(mempool, evict)
+	return nil
+}
+
+// Governance transactions must activate after the next block, which is the earliest block to include them
+func addGovernanceTx(tx Tx) (string, error) {
+	if tx.From != "" || tx.To != "" || tx.Amount != 0 {
+		return "", errInvalidGovernance
+	}
+	if err := verifyGovernance(tx); err != nil {
+		return "", err
+	}
+	hash := calculateTxHash(tx)
+
+	var confirmed bool
+	mutex.Lock()
+	next := nextHeight(blockchain)
+	err := withChainState(blockchain, func(s *ChainState) error {
+		confirmed = s.Seen[hash]
+		return nil
+	})
+	mutex.Unlock()
+	if err != nil {
+		return "", err
+	}
+	if confirmed {
+		return hash, nil
+	}
+	if tx.Governance.Height <= next {
+		return "", errInvalidGovernance
+	}
+
+	mempoolMutex.Lock()
+	defer mempoolMutex.Unlock()
+	mempool[hash] = tx
+	return hash, nil
+}
+
+func pendingTxs() []Tx {
+	mempoolMutex.Lock()
+	defer mempoolMutex.Unlock()
+	txs := make([]Tx, 0, len(mempool))
+	for _, tx := range mempool {
+		txs = append(txs, tx)
+	}
+	return txs
+}
+
+// Drops every pending transaction that has been included in the given chain
+func pruneMempool(chain Blockchain) {
+	mempoolMutex.Lock()
+	defer mempoolMutex.Unlock()
+	for _, block := range chain {
+		for _, tx := range blockTxs(block) {
+			delete(mempool, calculateTxHash(tx))
+		}
+	}
+}
+
+func txStatus(hash string) (string, int) {
+	mutex.Lock()
+	index := findTx(blockchain, hash)
+	mutex.Unlock()
+	if index >= 0 {
+		return TX_CONFIRMED, index
+	}
+	mempoolMutex.Lock()
+	defer mempoolMutex.Unlock()
+	if _, ok := mempool[hash]; ok {
+		return TX_PENDING, -1
+	}
+	return TX_UNKNOWN, -1
+}
+
+func submitJob(script string, limits JobLimits) *Job {
+	submitted := time.Now().UnixNano()
+	h := sha256.New()
+	h.Write([]byte(script + strconv.FormatInt(submitted, 10)))
+	job := &Job{
+		ID:        hex.EncodeToString(h.Sum(nil)),
+		Script:    script,
+		Status:    JOB_QUEUED,
+		Submitted: submitted,
+		Limits:    limits,
+	}
+	queueJob(job)
+	return job
+}
+
+// Queues a script sealed to a worker's public key, only that worker is handed the job
+func submitSealedJob(worker string, sealed []byte, limits JobLimits) (*Job, error) {
+	workerKeysMutex.Lock()
+	key, ok := workerKeys[worker]
+	workerKeysMutex.Unlock()
+	if !ok {
+		return nil, errUnknownWorker
+	}
+	if !freshKey(key) {
+		return nil, errStaleKey
+	}
+
+	submitted := time.Now().UnixNano()
+	h := sha256.New()
+	h.Write(sealed)
+	h.Write([]byte(strconv.FormatInt(submitted, 10)))
+	job := &Job{
+		ID:           hex.EncodeToString(h.Sum(nil)),
+		Status:       JOB_QUEUED,
+		Submitted:    submitted,
+		Worker:       worker,
+		Limits:       limits,
+		Confidential: true,
+		Sealed:       sealed,
+	}
+	queueJob(job)
+	return job, nil
+}
+
+func queueJob(job *Job) {
+	jobMutex.Lock()
+	defer jobMutex.Unlock()
+	jobs[job.ID] = job
+	jobQueue = append(jobQueue, job.ID)
+}
+
+// Hands out the oldest queued job the worker may run, nil if there is none
+func nextJob(worker string, key string) *Job {
+	jobMutex.Lock()
+	defer jobMutex.Unlock()
+	for i, id := range jobQueue {
+		job := jobs[id]
+		if job.Confidential && job.Worker != worker {
+			continue
+		}
+		jobQueue = append(jobQueue[:i:i], jobQueue[i+1:]...)
+		job.Status = JOB_RUNNING
+		job.Worker = worker
+		job.WorkerKey = key
+		job.Lease = time.Now().Add(JOB_QUEUE_LEASE).UnixNano()
+		return job
+	}
+	return nil
+}
+
+// The running job for the worker with the key it was handed out to, a job queued again answers to its next run only
+func assignedJob(id string, worker string, workerKey string) (*Job, error) {
+	job, ok := jobs[id]
+	if !ok {
+		return nil, errUnknownJob
+	}
+	if job.Worker != worker || job.WorkerKey != workerKey || job.Status != JOB_RUNNING {
+		return nil, errJobNotAssigned
+	}
+	return job, nil
+}
+
+// Holds the job for the worker until its timeout has passed, the worker started evaluating it
+func startJob(id string, worker string, workerKey string) error {
+	jobMutex.Lock()
+	defer jobMutex.Unlock()
+	job, err := assignedJob(id, worker, workerKey)
+	if err != nil {
+		return err
+	}
+	timeout := time.Duration(job.Limits.Timeout) * time.Second
+	if timeout == 0 {
+		timeout = DEFAULT_JOB_TIMEOUT
+	}
+	job.Lease = time.Now().Add(timeout + JOB_LEASE_GRACE).UnixNano()
+	return nil
+}
+
+// Adds a result of the job, only the worker running the job may add them
+func addJobResult(id string, worker string, workerKey string, key string, value []byte, done bool) error {
+	jobMutex.Lock()
+	defer jobMutex.Unlock()
+	job, err := assignedJob(id, worker, workerKey)
+	if err != nil {
+		return err
+	}
+	if key != "" {
+		job.Results = append(job.Results, JobResult{Key: key, Value: json.RawMessage(value)})
+	}
+	if done {
+		job.Status = JOB_DONE
+		job.Lease = 0
+	}
+	return nil
+}
+
+func abortJob(id string, worker string, workerKey string, abort JobAbort) error {
+	jobMutex.Lock()
+	defer jobMutex.Unlock()
+	job, err := assignedJob(id, worker, workerKey)
+	if err != nil {
+		return err
+	}
+	job.Status = JOB_ABORTED
+	job.Lease = 0
+	job.Abort = &abort
+	return nil
+}
+
+// Queues the running jobs again whose lease ran out or whose worker's session ended, in the order they were
+// submitted and ahead of younger jobs. Their partial results are dropped, the next run produces them again.
+// Returns the ids of the jobs queued again.
+func requeueExpiredJobs(now time.Time, live func(worker string, workerKey string) bool) []string {
+	jobMutex.Lock()
+	defer jobMutex.Unlock()
+	requeued := make([]string, 0)
+	for id, job := range jobs {
+		if job.Status != JOB_RUNNING || (job.Lease > now.UnixNano() && live(job.Worker, job.WorkerKey)) {
+			continue
+		}
+		job.Status = JOB_QUEUED
+		job.Lease = 0
+		job.Results = nil
+		job.WorkerKey = ""
+		// a confidential job can only run on the worker it was sealed for
+		if !job.Confidential {
+			job.Worker = ""
+		}
+		jobQueue = append(jobQueue, id)
+		requeued = append(requeued, id)
+	}
+	sort.SliceStable(jobQueue, func(i, j int) bool { return jobs[jobQueue[i]].Submitted < jobs[jobQueue[j]].Submitted })
+	return requeued
+}
+
+// Returns a copy of the job so it can be read without holding the lock
+func getJob(id string) (Job, bool) {
+	jobMutex.Lock()
+	defer jobMutex.Unlock()
+	job, ok := jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	copied := *job
+	copied.Results = append([]JobResult(nil), job.Results...)
+	return copied, true
+}
+
+// Accepts a worker's public key if it comes with a recent report of an enclave accepted by the chain and by
+// the node's own policy, if it has one. The report data holds the SHA256 of the key followed by the prefix of a
+// recent block's hash.
+func registerWorkerKey(key WorkerKey) error {
+	mutex.Lock()
+	accepted := activePolicy(blockchain, nextHeight(blockchain))
+	mutex.Unlock()
+	report, err := accepted.verifyReport(key.Report)
+	if err == nil && policy.configured() {
+		err = policy.check(report)
+	}
+	if err != nil {
+		countRejection(err)
+		return err
+	}
+	digest := sha256.Sum256(key.PublicKey)
+	if len(key.PublicKey) != 32 || len(report.Data) < 64 || !bytes.Equal(report.Data[:32], digest[:]) {
+		return errInvalidKey
+	}
+	mutex.Lock()
+	key.Height = reportHeight(blockchain, report.Data[32:64], accepted.MaxReportAge)
+	mutex.Unlock()
+	if key.Height < 0 {
+		countRejection(errStaleReport)
+		return errStaleReport
+	}
+
+	key.Published = time.Now().Unix()
+	workerKeysMutex.Lock()
+	defer workerKeysMutex.Unlock()
+	workerKeys[key.Worker] = key
+	return nil
+}
+
+// Keys whose report has become older than the active policy allows must be published again with a new report,
+// the same age registerWorkerKey accepts
+func freshKey(key WorkerKey) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	next := nextHeight(blockchain)
+	return next-1-key.Height <= activePolicy(blockchain, next).MaxReportAge
+}
+
+func listWorkerKeys() []WorkerKey {
+	workerKeysMutex.Lock()
+	all := make([]WorkerKey, 0, len(workerKeys))
+	for _, key := range workerKeys {
+		all = append(all, key)
+	}
+	workerKeysMutex.Unlock()
+
+	keys := make([]WorkerKey, 0, len(all))
+	for _, key := range all {
+		if freshKey(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Worker < keys[j].Worker })
+	return keys
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var errEmptyChain = errors.New("chain is empty")
+var errGenesis = errors.New("chain does not start with the genesis block")
+var errForeignChain = errors.New("chain does not start with our first block")
+
+// node verify [-chain file] [-base file] [-genesis file] [-simulate]
+// Replays a chain offline and reports the first invalid block, exits with 1 if there is one. The chain is read
+// and checked block by block, only the state and the last block are held.
+func runVerify(args []string) int {
+	cfg, err := commandConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	path := flags.String("chain", chainFile(), "chain file in JSON or the export format, or a data directory")
+	basePath := flags.String("base", "", "base snapshot of a chain that doesn't start at genesis, base.json next to the chain file by default")
+	flags.StringVar(&cfg.GenesisFile, "genesis", cfg.GenesisFile, "genesis file of the chain's network")
+	flags.BoolVar(&cfg.SimulateAttestation, "simulate", cfg.SimulateAttestation, "accept simulated attestation reports instead of verifying them with EGo")
+	flags.Parse(args)
+
+	if err := configureAttestation(cfg); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if err := configureNetwork(cfg.GenesisFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	r, f, err := openChainFile(*path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer f.Close()
+	first, err := r.Read()
+	if err == io.EOF {
+		fmt.Printf("block 0 is invalid: %v\n", errEmptyChain)
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", f.Name(), err)
+		return 2
+	}
+	if *basePath == "" {
+		*basePath = filepath.Join(filepath.Dir(chainPath(*path)), "base.json")
+	}
+	if err := loadBaseFile(Blockchain{first}, *basePath); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	count, err := verifyStream(first, r)
+	if err != nil {
+		fmt.Printf("block %d is invalid: %v\n", count, err)
+		return 1
+	}
+	fmt.Printf("all %d blocks are valid\n", count)
+	return 0
+}
+
+// The chain file of a data directory, other paths are taken as they are
+func chainPath(path string) string {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return filepath.Join(path, "chain", "blockchain.json")
+	}
+	return path
+}
+
+// Blocks of a chain in order, io.EOF after the last one
+type blockReader interface {
+	Read() (Block, error)
+}
+
+// Reads a chain as the node stores it, a json list of blocks, one block at a time
+type jsonChainReader struct {
+	decoder *json.Decoder
+}
+
+func newJSONChainReader(r io.Reader) (*jsonChainReader, error) {
+	decoder := json.NewDecoder(r)
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		return nil, errChainFormat
+	}
+	return &jsonChainReader{decoder: decoder}, nil
+}
+
+func (jr *jsonChainReader) Read() (Block, error) {
+	var block Block
+	if !jr.decoder.More() {
+		return block, io.EOF
+	}
+	err := jr.decoder.Decode(&block)
+	return block, err
+}
+
+// Opens a chain as the node stores it or as node export writes it, the file must be closed by the caller
+func openChainFile(path string) (blockReader, *os.File, error) {
+	path = chainPath(path)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := bufio.NewReader(f)
+	var br blockReader
+	if magic, _ := r.Peek(len(CHAIN_MAGIC)); string(magic) == CHAIN_MAGIC {
+		br, err = NewChainReader(r)
+	} else {
+		br, err = newJSONChainReader(r)
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return br, f, nil
+}
+
+// Checks the blocks read after first like verifyChain, block by block against the state after the block before.
+// Returns the number of blocks, or the position of the first invalid or unreadable one.
+func verifyStream(first Block, r blockReader) (int, error) {
+	chain := Blockchain{first}
+	if !based(chain) && (first.Index != genesisBlock.Index || first.Hash != genesisBlock.Hash) {
+		return 0, errGenesis
+	}
+	state := initialState(chain)
+	parent := first
+	for i := 1; ; i++ {
+		block, err := r.Read()
+		if err == io.EOF {
+			return i, nil
+		}
+		if err != nil {
+			return i, err
+		}
+		if err := checkHeader(block, Blockchain{parent}, state.policyAt(block.Index)); err != nil {
+			return i, err
+		}
+		if err := state.applyBlock(block); err != nil {
+			return i, err
+		}
+		parent = block
+	}
+}
+
+// Checks every block against the chain before it, returns the index of the first invalid block
+func verifyChain(chain Blockchain) (int, error) {
+	return verifyBlocks(chain, true)
+}
+
+// Like verifyChain, with withTxs unset only headers are checked, as light clients do
+func verifyBlocks(chain Blockchain, withTxs bool) (int, error) {
+	if len(chain) == 0 {
+		return 0, errEmptyChain
+	}
+	// a chain bootstrapped from a snapshot starts at the snapshot's tip instead
+	if !based(chain) && (chain[0].Index != genesisBlock.Index || chain[0].Hash != genesisBlock.Hash) {
+		return 0, errGenesis
+	}
+	return checkBlocks(chain, 1, withTxs)
+}
+
+// Checks the blocks from start on against the blocks before them, the blocks before start must be valid.
+// Returns the index of the first invalid block. Transactions are applied block by block to the state at start,
+// which also tracks the attestation policy as governance transactions take effect. A full check starts from the
+// node's tip state, only a header check replays the governance transactions before start.
+func checkBlocks(chain Blockchain, start int, withTxs bool) (int, error) {
+	if withTxs {
+		invalid := start - 1
+		err := withChainState(chain[:start], func(state *ChainState) error {
+			var err error
+			invalid, err = checkFrom(chain, start, state, state.applyBlock)
+			return err
+		})
+		return invalid, err
+	}
+	state, err := stateAt(chain[:start], false)
+	if err != nil {
+		return start - 1, err
+	}
+	return checkFrom(chain, start, state, state.applyGovernance)
+}
+
+func checkFrom(chain Blockchain, start int, state *ChainState, apply func(Block) error) (int, error) {
+	for i := start; i < len(chain); i++ {
+		if err := checkHeader(chain[i], chain[:i], state.policyAt(chain[i].Index)); err != nil {
+			return i, err
+		}
+		if err := apply(chain[i]); err != nil {
+			return i, err
+		}
+	}
+	return len(chain), nil
+}
+
+// Fork choice: a received chain replaces the current one if it carries more work and every block past the
+// common prefix is valid. Returns false without an error for chains that aren't heavier.
+func forkChoice(current Blockchain, received Blockchain) (bool, error) {
+	return chooseFork(current, received, true)
+}
+
+// Like forkChoice, with withTxs unset only headers are checked, as light clients do
+func chooseFork(current Blockchain, received Blockchain, withTxs bool) (bool, error) {
+	if len(received) == 0 || calculateWork(received) <= calculateWork(current) {
+		return false, nil
+	}
+	if !sameBlock(received[0], current[0]) {
+		return false, errForeignChain
+	}
+	// blocks shared with the current chain have been checked before
+	fork := 1
+	for fork < len(received) && fork < len(current) && sameBlock(received[fork], current[fork]) {
+		fork++
+	}
+	if i, err := checkBlocks(received, fork, withTxs); err != nil {
+		return false, fmt.Errorf("block %d: %w", received[i].Index, err)
+	}
+	return true, nil
+}
+
+// Compares every field, a block's hash isn't checked against the other fields and doesn't cover Txs and Results but their roots
+func sameBlock(a Block, b Block) bool {
+	return a.Index == b.Index && a.Hash == b.Hash && a.Nonce == b.Nonce && a.PrevHash == b.PrevHash && a.Txs == b.Txs && a.TxRoot == b.TxRoot &&
+		a.Results == b.Results && a.ResultRoot == b.ResultRoot &&
+		a.Operations == b.Operations && a.Epoch == b.Epoch && bytes.Equal(a.Proof, b.Proof)
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// Accounts are ed25519 keys, an address is the hex encoded public key. Transfers are signed by the sending
+// account, nodes only accept and apply transfers with a valid signature.
+
+var keyName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Shared by all prompts, the key to import and the passphrase may both come from stdin
+var stdin = bufio.NewReader(os.Stdin)
+
+func addressOf(pub ed25519.PublicKey) string {
+	return hex.EncodeToString(pub)
+}
+
+func isAddress(address string) bool {
+	b, err := hex.DecodeString(address)
+	return err == nil && len(b) == ed25519.PublicKeySize && address == strings.ToLower(address)
+}
+
+// The message signed by the sending account, bound to the network so a transfer can't be replayed on another one
+func txMessage(tx Tx) []byte {
+	return []byte(fmt.Sprintf("tx:%s:%s:%s:%d:%d", genesis.ChainID, tx.From, tx.To, tx.Amount, tx.Nonce))
+}
+
+func signTx(tx Tx, key ed25519.PrivateKey) Tx {
+	tx.Sig = hex.EncodeToString(ed25519.Sign(key, txMessage(tx)))
+	return tx
+}
+
+// Checks a transfer is signed by the account it spends from
+func verifyTx(tx Tx) error {
+	if tx.Governance != nil || !isAddress(tx.From) {
+		return errInvalidSignature
+	}
+	pub, _ := hex.DecodeString(tx.From)
+	sig, err := hex.DecodeString(tx.Sig)
+	// only the lowercase encoding is accepted, there is one way to write a signature
+	if err != nil || hex.EncodeToString(sig) != tx.Sig || !ed25519.Verify(ed25519.PublicKey(pub), txMessage(tx), sig) {
+		return errInvalidSignature
+	}
+	return nil
+}
+
+// node wallet <new|import|list|address|sign|send|submit|balance|history> [flags]
+// Keys are kept encrypted in the wallet directory of the data directory.
+func runWallet(args []string) int {
+	commands := map[string]func(cfg *Config, args []string) error{
+		"new":     walletNew,
+		"import":  walletImport,
+		"list":    walletList,
+		"address": walletAddress,
+		"sign":    walletSign,
+		"send":    walletSend,
+		"submit":  walletSubmit,
+		"balance": walletBalance,
+		"history": walletHistory,
+	}
+	if len(args) == 0 || commands[args[0]] == nil {
+		fmt.Fprintln(os.Stderr, "usage: node wallet <new|import|list|address|sign|send|submit|balance|history> [flags]")
+		return 2
+	}
+	cfg, err := commandConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if err := commands[args[0]](cfg, args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// The node's own RPC endpoint unless -rpc is given
+func defaultRPC(cfg *Config) string {
+	addr := cfg.HTTPAddr
+	if strings.HasPrefix(addr, ":") {
+		addr = "127.0.0.1" + addr
+	}
+	return "http://" + addr + "/rpc"
+}
+
+// WALLET_PASSPHRASE if it is set, otherwise a line read from stdin without echo
+func readPassphrase(prompt string, confirm bool) (string, error) {
+	if passphrase, ok := os.LookupEnv("WALLET_PASSPHRASE"); ok {
+		return passphrase, nil
+	}
+	passphrase, err := readSecret(prompt)
+	if err != nil {
+		return "", err
+	}
+	if confirm {
+		again, err := readSecret("Repeat passphrase: ")
+		if err != nil {
+			return "", err
+		}
+		if again != passphrase {
+			return "", errors.New("passphrases don't match")
+		}
+	}
+	return passphrase, nil
+}
+
+// Like readLine, but the input isn't echoed when stdin is a terminal
+func readSecret(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return readLine(prompt)
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	secret, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
+
+func readLine(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := stdin.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func saveKey(name string, key ed25519.PrivateKey) error {
+	if !keyName.MatchString(name) {
+		return fmt.Errorf("invalid key name %q", name)
+	}
+	if _, err := os.Stat(keystoreFile(name)); err == nil {
+		return fmt.Errorf("%s: %w", name, errKeyExists)
+	}
+	passphrase, err := readPassphrase("Passphrase: ", true)
+	if err != nil {
+		return err
+	}
+	k, err := encryptKey(key, passphrase)
+	if err != nil {
+		return err
+	}
+	if err := writeKeystore(name, k); err != nil {
+		return err
+	}
+	fmt.Println(k.Address)
+	return nil
+}
+
+func loadKey(name string) (ed25519.PrivateKey, error) {
+	k, err := readKeystore(name)
+	if err != nil {
+		return nil, err
+	}
+	passphrase, err := readPassphrase("Passphrase for "+name+": ", false)
+	if err != nil {
+		return nil, err
+	}
+	return k.decrypt(passphrase)
+}
+
+// node wallet new [-name default], prints the new key's address
+func walletNew(cfg *Config, args []string) error {
+	flags := flag.NewFlagSet("wallet new", flag.ExitOnError)
+	name := flags.String("name", "default", "name of the key")
+	flags.Parse(args)
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	return saveKey(*name, key)
+}
+
+// node wallet import [-name default], reads the hex encoded seed or private key from stdin
+func walletImport(cfg *Config, args []string) error {
+	flags := flag.NewFlagSet("wallet import", flag.ExitOnError)
+	name := flags.String("name", "default", "name of the key")
+	flags.Parse(args)
+
+	line, err := readSecret("Private key (hex): ")
+	if err != nil {
+		return err
+	}
+	b, err := hex.DecodeString(strings.TrimSpace(line))
+	if err != nil {
+		return errors.New("private key is not hex encoded")
+	}
+	switch len(b) {
+	case ed25519.SeedSize:
+		return saveKey(*name, ed25519.NewKeyFromSeed(b))
+	case ed25519.PrivateKeySize:
+		key := ed25519.PrivateKey(b)
+		// the public half of a private key is not checked by ed25519, a wrong one would derive a wrong address
+		if !key.Equal(ed25519.NewKeyFromSeed(key.Seed())) {
+			return errors.New("private key does not match its public key")
+		}
+		return saveKey(*name, key)
+	default:
+		return fmt.Errorf("private key must be %d or %d bytes", ed25519.SeedSize, ed25519.PrivateKeySize)
+	}
+}
+
+// node wallet list, the names and addresses of all keys
+func walletList(cfg *Config, args []string) error {
+	flags := flag.NewFlagSet("wallet list", flag.ExitOnError)
+	flags.Parse(args)
+
+	names, err := keystoreNames()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		k, err := readKeystore(name)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\t%s\n", name, k.Address)
+	}
+	return nil
+}
+
+// node wallet address [-name default]
+func walletAddress(cfg *Config, args []string) error {
+	flags := flag.NewFlagSet("wallet address", flag.ExitOnError)
+	name := flags.String("name", "default", "name of the key")
+	flags.Parse(args)
+
+	// the address is stored in the clear, no passphrase is needed
+	k, err := readKeystore(*name)
+	if err != nil {
+		return err
+	}
+	fmt.Println(k.Address)
+	return nil
+}
+
+// Parses the transfer flags shared by sign and send and signs the transfer they describe
+func signedTransfer(cfg *Config, flags *flag.FlagSet, args []string) (Tx, error) {
+	key := flags.String("name", "default", "name of the key sending")
+	to := flags.String("to", "", "address receiving")
+	amount := flags.Int("amount", 0, "amount sent")
+	flags.StringVar(&cfg.GenesisFile, "genesis", cfg.GenesisFile, "genesis file of the network")
+	flags.Parse(args)
+
+	var tx Tx
+	if !isAddress(*to) {
+		return tx, fmt.Errorf("invalid address %q", *to)
+	}
+	if *amount <= 0 {
+		return tx, errors.New("amount must be positive")
+	}
+	if err := configureNetwork(cfg.GenesisFile); err != nil {
+		return tx, err
+	}
+	private, err := loadKey(*key)
+	if err != nil {
+		return tx, err
+	}
+	tx = Tx{
+		From:   addressOf(private.Public().(ed25519.PublicKey)),
+		To:     *to,
+		Amount: *amount,
+		Nonce:  uint64(time.Now().UnixNano()),
+	}
+	return signTx(tx, private), nil
+}
+
+// node wallet sign -to address -amount n [-name default] [-genesis file], prints the signed transfer
+func walletSign(cfg *Config, args []string) error {
+	tx, err := signedTransfer(cfg, flag.NewFlagSet("wallet sign", flag.ExitOnError), args)
+	if err != nil {
+		return err
+	}
+	encoded, err := json.MarshalIndent(tx, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(encoded))
+	return nil
+}
+
+// node wallet send -to address -amount n [-name default] [-genesis file] [-rpc url], prints the transaction hash
+func walletSend(cfg *Config, args []string) error {
+	flags := flag.NewFlagSet("wallet send", flag.ExitOnError)
+	rpc := flags.String("rpc", defaultRPC(cfg), "JSON-RPC url of the node")
+	tx, err := signedTransfer(cfg, flags, args)
+	if err != nil {
+		return err
+	}
+	return submitTx(*rpc, tx)
+}
+
+// node wallet submit [-in file] [-rpc url], submits a transfer signed with sign
+func walletSubmit(cfg *Config, args []string) error {
+	flags := flag.NewFlagSet("wallet submit", flag.ExitOnError)
+	in := flags.String("in", "-", "signed transfer, - for stdin")
+	rpc := flags.String("rpc", defaultRPC(cfg), "JSON-RPC url of the node")
+	flags.Parse(args)
+
+	var r io.Reader = stdin
+	if *in != "-" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	var tx Tx
+	if err := json.NewDecoder(r).Decode(&tx); err != nil {
+		return err
+	}
+	return submitTx(*rpc, tx)
+}
+
+func submitTx(rpc string, tx Tx) error {
+	var hash string
+	if err := callRPC(rpc, "tx_send", &hash, tx); err != nil {
+		return err
+	}
+	fmt.Println(hash)
+	return nil
+}
+
+// The address given with -address, or the one of the key named by -name
+func accountFlags(cfg *Config, name string, args []string) (string, string, error) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	key := flags.String("name", "default", "name of the key")
+	address := flags.String("address", "", "address of any account, instead of a key's")
+	rpc := flags.String("rpc", defaultRPC(cfg), "JSON-RPC url of the node")
+	flags.Parse(args)
+
+	if *address != "" {
+		return *address, *rpc, nil
+	}
+	k, err := readKeystore(*key)
+	if err != nil {
+		return "", "", err
+	}
+	return k.Address, *rpc, nil
+}
+
+// node wallet balance [-name default | -address address] [-rpc url]
+func walletBalance(cfg *Config, args []string) error {
+	address, rpc, err := accountFlags(cfg, "wallet balance", args)
+	if err != nil {
+		return err
+	}
+	var balance int
+	if err := callRPC(rpc, "account_getBalance", &balance, address); err != nil {
+		return err
+	}
+	fmt.Println(balance)
+	return nil
+}
+
+// node wallet history [-name default | -address address] [-rpc url], one transfer per line
+func walletHistory(cfg *Config, args []string) error {
+	address, rpc, err := accountFlags(cfg, "wallet history", args)
+	if err != nil {
+		return err
+	}
+	var history []HistoryEntry
+	if err := callRPC(rpc, "account_getHistory", &history, address); err != nil {
+		return err
+	}
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	for _, entry := range history {
+		amount := entry.Tx.Amount
+		counterpart := entry.Tx.To
+		if entry.Tx.From == address {
+			amount = -amount
+		} else {
+			counterpart = entry.Tx.From
+		}
+		block := "-"
+		if entry.Status == TX_CONFIRMED {
+			block = fmt.Sprint(entry.Block)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%+d\t%s\t%s\n", block, entry.Status, amount, counterpart, entry.Hash)
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+#!/bin/sh
+# Generates the go code for the node and the worker, requires protoc, protoc-gen-go and protoc-gen-go-grpc
+cd "$(dirname "$0")"
+
+for module in node worker; do
+	protoc -I . \
+		--go_out=../$module --go_opt=module=$module --go_opt=Mminer/v2/miner.proto=$module/minerpb \
+		--go-grpc_out=../$module --go-grpc_opt=module=$module --go-grpc_opt=Mminer/v2/miner.proto=$module/minerpb \
+		miner/v2/miner.proto
+done
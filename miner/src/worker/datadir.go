@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Layout of a worker's data directory, the same names as in a node's where they overlap:
+//
+//	LOCK               held by the worker using the directory
+//	results/           sealed result log
+//	keys/state.sealed  sealed worker state, including the job key
+//	logs/worker.log    copy of the worker's log
+//	script.vg.enc      local script sealed to the job key, preferred over /worker/script.vg
+//	api.token          bearer token of the local HTTP endpoints serving results, new on every start
+//
+// Inside the enclave only mounted paths are reachable, the default is below the /worker mount of enclave.json.
+const (
+	LOCK_FILE      = "LOCK"
+	API_TOKEN_FILE = "api.token"
+)
+
+var dataDir = "/worker/data"
+
+// Kept open so the lock is held until the worker exits
+var dataLock *os.File
+
+var errDataDirLocked = errors.New("data directory is used by another worker")
+
+func resultsDir() string {
+	return filepath.Join(dataDir, "results")
+}
+
+func sealedScriptFile() string {
+	return filepath.Join(dataDir, "script.vg.enc")
+}
+
+func apiTokenFile() string {
+	return filepath.Join(dataDir, API_TOKEN_FILE)
+}
+
+func stateFile() string {
+	return filepath.Join(dataDir, "keys", "state.sealed")
+}
+
+// Creates the data directory and takes its lock. Two workers sharing one directory would interleave
+// their result logs and overwrite each other's state.
+func lockDataDir() error {
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dataDir, LOCK_FILE), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return fmt.Errorf("%s: %w", dataDir, errDataDirLocked)
+		}
+		// not every host file system the enclave mounts supports locks
+		if err == syscall.ENOSYS || err == syscall.ENOTSUP {
+			workerLog.Warn("Data directory can't be locked, make sure no other worker uses it", "dir", dataDir)
+			return nil
+		}
+		return err
+	}
+	f.Truncate(0)
+	fmt.Fprintf(f, "%d\n", os.Getpid())
+	dataLock = f
+	return nil
+}
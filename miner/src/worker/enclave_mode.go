@@ -0,0 +1,6 @@
+//go:build !simulation
+
+package main
+
+// Enclave builds always use remote attestation and the enclave's sealing key, see simulation.go
+const simulation = false
@@ -2,10 +2,31 @@ module worker
 
 go 1.19
 
-require github.com/edgelesssys/ego v1.1.0
+require (
+	github.com/edgelesssys/ego v1.1.0
+	github.com/prometheus/client_golang v1.14.0
+	google.golang.org/grpc v1.55.0
+	google.golang.org/protobuf v1.30.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/client_model v0.3.0 // indirect
+	github.com/prometheus/common v0.37.0 // indirect
+	github.com/prometheus/procfs v0.8.0 // indirect
+	golang.org/x/net v0.17.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
+	google.golang.org/genproto v0.0.0-20230410155749-daa745c078e1 // indirect
+)
 
 require (
 	github.com/SebastiaanWouters/verigo v0.1.8
-	golang.org/x/crypto v0.7.0 // indirect
+	golang.org/x/crypto v0.14.0
+	golang.org/x/exp v0.0.0-20221205204356-47842c84f3db
 	gopkg.in/square/go-jose.v2 v2.6.0 // indirect
 )
+
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"worker/minerpb"
+)
+
+const (
+	// Version of the miner protocol (poc.miner.v2) implemented by this worker, see miner/src/proto
+	PROTOCOL_VERSION = 3
+	STATS_INTERVAL   = 10 * time.Second
+	// Metadata carrying the session token the node sealed to our key
+	WORKER_TOKEN_HEADER = "worker-token"
+)
+
+var client minerpb.MinerClient
+var workerID string
+
+// gRPC address of the node, set with -node
+var nodeAddress = "localhost:4002"
+
+// Session token opened from the node's PublishKey response, empty until the key is published
+var sessionToken string
+var sessionMutex = &sync.Mutex{}
+
+// Set while the key is published again after the node refused the session
+var republishing int32
+
+// Chain tip as last streamed by the node
+var tip Block
+var tipMutex = &sync.Mutex{}
+var firstTip = make(chan bool)
+var firstTipOnce = &sync.Once{}
+
+var blocksFound uint64 = 0
+var resultsSubmitted uint64 = 0
+
+func connectNode() {
+	conn, err := grpc.Dial(nodeAddress, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithUnaryInterceptor(authenticate))
+	check(err)
+	client = minerpb.NewMinerClient(conn)
+	workerLog.Info("Connecting to node", "worker", workerID, "node", nodeAddress)
+}
+
+func setSessionToken(token string) {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+	sessionToken = token
+}
+
+// Adds the session token to every call. A node that doesn't know the session, e.g. after a restart or once the
+// key's report got too old, refuses the call and the key is published again for the next one.
+func authenticate(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	sessionMutex.Lock()
+	token := sessionToken
+	sessionMutex.Unlock()
+	if token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, WORKER_TOKEN_HEADER, token)
+	}
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if status.Code(err) == codes.Unauthenticated && atomic.CompareAndSwapInt32(&republishing, 0, 1) {
+		go func() {
+			defer atomic.StoreInt32(&republishing, 0)
+			publishKey()
+		}()
+	}
+	return err
+}
+
+// Keeps the cached tip up to date, reconnecting whenever the stream breaks
+func watchTip() {
+	for {
+		stream, err := client.WatchTip(context.Background(), &minerpb.WatchTipRequest{Version: PROTOCOL_VERSION, WorkerId: workerID})
+		if err != nil {
+			chainLog.Warn("Watching tip failed", "err", err)
+		} else {
+			published := false
+			for {
+				t, err := stream.Recv()
+				if err != nil {
+					chainLog.Warn("Tip stream closed", "err", err)
+					break
+				}
+				// the node might have restarted, it only knows our key once we publish it again
+				if !published {
+					publishKey()
+					published = true
+				}
+				tipMutex.Lock()
+				tip = fromProtoBlock(t.GetBlock())
+				difficulty = int(t.GetDifficulty())
+				tipMutex.Unlock()
+				firstTipOnce.Do(func() { close(firstTip) })
+			}
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func getWork() *minerpb.Work {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	work, err := client.GetWork(ctx, &minerpb.GetWorkRequest{Version: PROTOCOL_VERSION, WorkerId: workerID})
+	if err != nil {
+		workerLog.Warn("Getting work failed", "err", err)
+		return nil
+	}
+	return work
+}
+
+// The tip to build the next block on, the pending transactions valid on top of it and which of the jobs'
+// results are committed already
+func getBlockWork(jobs []string) *minerpb.Work {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	work, err := client.GetWork(ctx, &minerpb.GetWorkRequest{Version: PROTOCOL_VERSION, WorkerId: workerID, ForBlock: true, Results: jobs})
+	if err != nil {
+		chainLog.Warn("Getting block work failed", "err", err)
+		return nil
+	}
+	return work
+}
+
+func submitResult(jobID string, key string, value []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := client.SubmitResult(ctx, &minerpb.SubmitResultRequest{
+		Version:  PROTOCOL_VERSION,
+		WorkerId: workerID,
+		JobId:    jobID,
+		Key:      key,
+		Value:    value,
+	})
+	if err != nil {
+		workerLog.Error("Submitting result failed", err)
+		return
+	}
+	atomic.AddUint64(&resultsSubmitted, 1)
+}
+
+// Tells the node we started evaluating a job, it holds the job for us until the job's timeout
+func startJob(jobID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := client.SubmitResult(ctx, &minerpb.SubmitResultRequest{
+		Version:  PROTOCOL_VERSION,
+		WorkerId: workerID,
+		JobId:    jobID,
+		Started:  true,
+	})
+	if err != nil {
+		workerLog.Error("Starting job failed", err)
+	}
+}
+
+// Tells the node a job has been evaluated completely
+func finishJob(jobID string) {
+	if jobID == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := client.SubmitResult(ctx, &minerpb.SubmitResultRequest{
+		Version:  PROTOCOL_VERSION,
+		WorkerId: workerID,
+		JobId:    jobID,
+		Done:     true,
+	})
+	if err != nil {
+		workerLog.Error("Finishing job failed", err)
+	}
+}
+
+// Tells the node a job was aborted, for the local script the abort is only logged
+func abortJob(jobID string, aborted *Aborted) {
+	if jobID == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := client.SubmitResult(ctx, &minerpb.SubmitResultRequest{
+		Version:  PROTOCOL_VERSION,
+		WorkerId: workerID,
+		JobId:    jobID,
+		Done:     true,
+		Abort: &minerpb.Abort{
+			Reason:     aborted.Reason,
+			Operations: aborted.Operations,
+			ElapsedMs:  uint64(aborted.Elapsed.Milliseconds()),
+		},
+	})
+	if err != nil {
+		workerLog.Error("Aborting job failed", err)
+	}
+}
+
+func reportStats() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := client.ReportStats(ctx, &minerpb.ReportStatsRequest{
+		Version:     PROTOCOL_VERSION,
+		WorkerId:    workerID,
+		Operations:  work.Total(),
+		BlocksFound: atomic.LoadUint64(&blocksFound),
+		Results:     atomic.LoadUint64(&resultsSubmitted),
+	})
+	if err != nil {
+		workerLog.Error("Reporting stats failed", err)
+	}
+}
+
+// Reports stats to the node and saves the sealed state
+func statsReporter() {
+	for {
+		time.Sleep(STATS_INTERVAL)
+		reportStats()
+		persistState()
+	}
+}
+
+func toProtoBlock(block Block) *minerpb.Block {
+	return &minerpb.Block{
+		Index:      int64(block.Index),
+		Txs:        block.Txs,
+		TxRoot:     block.TxRoot,
+		Results:    block.Results,
+		ResultRoot: block.ResultRoot,
+		Hash:       block.Hash,
+		Nonce:      block.Nonce,
+		PrevHash:   block.PrevHash,
+		Proof:      block.Proof,
+		Operations: block.Operations,
+		Epoch:      block.Epoch,
+	}
+}
+
+func fromProtoBlock(block *minerpb.Block) Block {
+	return Block{
+		Index:      int(block.GetIndex()),
+		Txs:        block.GetTxs(),
+		TxRoot:     block.GetTxRoot(),
+		Results:    block.GetResults(),
+		ResultRoot: block.GetResultRoot(),
+		Hash:       block.GetHash(),
+		Nonce:      block.GetNonce(),
+		PrevHash:   block.GetPrevHash(),
+		Proof:      block.GetProof(),
+		Operations: block.GetOperations(),
+		Epoch:      block.GetEpoch(),
+	}
+}
@@ -0,0 +1,625 @@
+package main
+
+import (
+	"context"
+	crand "crypto/rand"
+	"fmt"
+	"math"
+	"math/big"
+
+	"github.com/SebastiaanWouters/verigo/ast"
+	"github.com/SebastiaanWouters/verigo/lexer"
+	"github.com/SebastiaanWouters/verigo/object"
+	"github.com/SebastiaanWouters/verigo/parser"
+)
+
+// Jobs are evaluated by this interpreter instead of verigo's evaluator, which can't be stopped and only reports
+// operations over channels. It follows verigo v0.1.8's evaluator, with the same builtins and operation codes, but
+// checks the job's context and limits at every operation, function call, loop iteration and block, so an aborted job stops right away
+// and leaves nothing running. The memory of a job is what its bindings and active calls hold, charged to the job alone.
+
+const (
+	// charged for every active function call, the environment and the evaluator's stack below it
+	CALL_FRAME_SIZE = 8 << 10
+	// charged for every binding on top of its name and value
+	BINDING_SIZE = 64
+	VALUE_SIZE   = 32
+	// builtins that loop check the context this often
+	BUILTIN_CHECK_INTERVAL = 1 << 16
+)
+
+const ABORT_FAILED = "evaluation failed"
+
+// Operation codes past verigo's, counted for every loop iteration and block so a script that only loops still
+// uses up its budget and sees its deadline
+const (
+	OP_LOOP  = 17
+	OP_BLOCK = 18
+)
+
+var (
+	TRUE  = &object.Boolean{Value: true}
+	FALSE = &object.Boolean{Value: false}
+	NULL  = &object.Null{}
+)
+
+type Interpreter struct {
+	ctx    context.Context
+	limits Limits
+	// called for every operation with its code and for every result saved by the script
+	onOperation func(code int)
+	onResult    func(object.Result)
+
+	operations uint64
+	memory     uint64
+	// charged size of every binding, per environment
+	frames map[*object.Environment]map[string]uint64
+}
+
+// Unwinds the evaluation from wherever a limit is hit, recovered in Run
+type abortEvaluation struct {
+	reason string
+}
+
+func NewInterpreter(ctx context.Context, limits Limits, onOperation func(int), onResult func(object.Result)) *Interpreter {
+	return &Interpreter{
+		ctx:         ctx,
+		limits:      limits,
+		onOperation: onOperation,
+		onResult:    onResult,
+		frames:      make(map[*object.Environment]map[string]uint64),
+	}
+}
+
+// Evaluates the script, returns nil when it ran to completion. Like repl.Eval, parser errors and errors raised
+// by the script end the evaluation without aborting the job.
+func (in *Interpreter) Run(script string) (aborted *Aborted) {
+	defer func() {
+		if r := recover(); r != nil {
+			reason := ABORT_FAILED
+			if abort, ok := r.(abortEvaluation); ok {
+				reason = abort.reason
+			} else {
+				workerLog.Warn("Evaluation failed", "err", fmt.Sprint(r))
+			}
+			aborted = &Aborted{Reason: reason, Operations: in.operations}
+		}
+	}()
+	p := parser.New(lexer.New(script))
+	program := p.ParseProgram()
+	// a program with parser errors has incomplete nodes, like the repl it isn't evaluated
+	if len(p.Errors()) != 0 {
+		return nil
+	}
+	in.eval(program, object.NewEnvironment())
+	return nil
+}
+
+// Memory charged to the job right now
+func (in *Interpreter) Memory() uint64 {
+	return in.memory
+}
+
+func (in *Interpreter) abort(reason string) {
+	panic(abortEvaluation{reason: reason})
+}
+
+// Stops the evaluation once the job's deadline passed
+func (in *Interpreter) checkpoint() {
+	select {
+	case <-in.ctx.Done():
+		in.abort(ABORT_DEADLINE)
+	default:
+	}
+}
+
+func (in *Interpreter) operation(code int) {
+	in.operations++
+	if in.operations > in.limits.MaxOperations {
+		in.abort(ABORT_OPERATIONS)
+	}
+	in.checkpoint()
+	in.onOperation(code)
+}
+
+func (in *Interpreter) charge(size uint64) {
+	in.memory += size
+	if in.memory > in.limits.MaxMemory {
+		in.abort(ABORT_MEMORY)
+	}
+}
+
+func valueSize(obj object.Object) uint64 {
+	if s, ok := obj.(*object.String); ok {
+		return VALUE_SIZE + uint64(len(s.Value))
+	}
+	return VALUE_SIZE
+}
+
+// Sets name in env, replacing a binding releases what the old value was charged
+func (in *Interpreter) bind(env *object.Environment, name string, val object.Object) {
+	frame := in.frames[env]
+	if frame == nil {
+		frame = make(map[string]uint64)
+		in.frames[env] = frame
+	}
+	size := BINDING_SIZE + uint64(len(name)) + valueSize(val)
+	in.memory -= frame[name]
+	frame[name] = size
+	in.charge(size)
+	env.Set(name, val)
+}
+
+// Releases the environment of a call that returned
+func (in *Interpreter) release(env *object.Environment) {
+	for _, size := range in.frames[env] {
+		in.memory -= size
+	}
+	delete(in.frames, env)
+	in.memory -= CALL_FRAME_SIZE
+}
+
+func (in *Interpreter) eval(node ast.Node, env *object.Environment) object.Object {
+	switch node := node.(type) {
+	// Statements
+	case *ast.Program:
+		return in.evalProgram(node, env)
+	case *ast.ExpressionStatement:
+		return in.eval(node.Expression, env)
+	// Expressions
+	case *ast.IntegerLiteral:
+		return &object.Integer{Value: node.Value}
+	case *ast.Boolean:
+		return nativeBoolToBooleanObject(node.Value)
+	case *ast.PrefixExpression:
+		right := in.eval(node.Right, env)
+		if isError(right) {
+			return right
+		}
+		return evalPrefixExpression(node.Operator, right)
+	case *ast.InfixExpression:
+		left := in.eval(node.Left, env)
+		if isError(left) {
+			return left
+		}
+		right := in.eval(node.Right, env)
+		if isError(right) {
+			return right
+		}
+		return in.evalInfixExpression(node.Operator, left, right)
+	case *ast.BlockStatement:
+		return in.evalBlockStatement(node, env)
+	case *ast.IfExpression:
+		return in.evalIfExpression(node, env)
+	case *ast.ForExpression:
+		return in.evalForExpression(node, env)
+	case *ast.ReturnStatement:
+		val := in.eval(node.ReturnValue, env)
+		if isError(val) {
+			return val
+		}
+		return &object.ReturnValue{Value: val}
+	case *ast.LetStatement:
+		val := in.eval(node.Value, env)
+		if isError(val) {
+			return val
+		}
+		in.bind(env, node.Name.Value, val)
+	case *ast.Identifier:
+		return evalIdentifier(node, env)
+	case *ast.FunctionLiteral:
+		return &object.Function{Parameters: node.Parameters, Env: env, Body: node.Body}
+	case *ast.StringLiteral:
+		return &object.String{Value: node.Value}
+	case *ast.CallExpression:
+		function := in.eval(node.Function, env)
+		if isError(function) {
+			return function
+		}
+		args := in.evalExpressions(node.Arguments, env)
+		if len(args) == 1 && isError(args[0]) {
+			return args[0]
+		}
+		return in.applyFunction(function, args)
+	}
+	return nil
+}
+
+func (in *Interpreter) evalProgram(program *ast.Program, env *object.Environment) object.Object {
+	var result object.Object
+	for _, statement := range program.Statements {
+		result = in.eval(statement, env)
+		switch result := result.(type) {
+		case *object.ReturnValue:
+			return result.Value
+		case *object.Error:
+			return result
+		}
+	}
+	return result
+}
+
+func (in *Interpreter) evalBlockStatement(block *ast.BlockStatement, env *object.Environment) object.Object {
+	in.operation(OP_BLOCK)
+	var result object.Object
+	for _, statement := range block.Statements {
+		result = in.eval(statement, env)
+		if result != nil {
+			rt := result.Type()
+			if rt == object.RETURN_VALUE_OBJ || rt == object.ERROR_OBJ {
+				return result
+			}
+		}
+	}
+	return result
+}
+
+func (in *Interpreter) evalExpressions(exps []ast.Expression, env *object.Environment) []object.Object {
+	var result []object.Object
+	for _, e := range exps {
+		evaluated := in.eval(e, env)
+		if isError(evaluated) {
+			return []object.Object{evaluated}
+		}
+		result = append(result, evaluated)
+	}
+	return result
+}
+
+func evalIdentifier(node *ast.Identifier, env *object.Environment) object.Object {
+	if val, ok := env.Get(node.Value); ok {
+		return val
+	}
+	if node.Value == "save" {
+		return saveBuiltin
+	}
+	if builtin, ok := builtins[node.Value]; ok {
+		return builtin
+	}
+	return newError("identifier not found: " + node.Value)
+}
+
+func (in *Interpreter) evalForExpression(ie *ast.ForExpression, env *object.Environment) object.Object {
+	in.eval(&ie.Variable, env)
+	condition := in.eval(ie.Condition, env)
+	if isError(condition) {
+		return condition
+	}
+	for isTruthy(condition) {
+		in.operation(OP_LOOP)
+		in.eval(ie.Loop, env)
+		in.eval(&ie.Update, env)
+		condition = in.eval(ie.Condition, env)
+		if isError(condition) {
+			return condition
+		}
+	}
+	return NULL
+}
+
+func (in *Interpreter) evalIfExpression(ie *ast.IfExpression, env *object.Environment) object.Object {
+	condition := in.eval(ie.Condition, env)
+	if isError(condition) {
+		return condition
+	}
+	if isTruthy(condition) {
+		return in.eval(ie.Consequence, env)
+	} else if ie.Alternative != nil {
+		return in.eval(ie.Alternative, env)
+	}
+	return NULL
+}
+
+func isTruthy(obj object.Object) bool {
+	switch obj {
+	case NULL:
+		return false
+	case TRUE:
+		return true
+	case FALSE:
+		return false
+	default:
+		return true
+	}
+}
+
+func (in *Interpreter) evalInfixExpression(operator string, left object.Object, right object.Object) object.Object {
+	switch {
+	case left.Type() == object.STRING_OBJ && right.Type() == object.STRING_OBJ:
+		return in.evalStringInfixExpression(operator, left, right)
+	case left.Type() == object.INTEGER_OBJ && right.Type() == object.INTEGER_OBJ:
+		return in.evalIntegerInfixExpression(operator, left, right)
+	case operator == "==":
+		return nativeBoolToBooleanObject(left == right)
+	case operator == "!=":
+		return nativeBoolToBooleanObject(left != right)
+	default:
+		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
+	}
+}
+
+func (in *Interpreter) evalStringInfixExpression(operator string, left, right object.Object) object.Object {
+	if operator != "+" {
+		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
+	}
+	leftVal := left.(*object.String).Value
+	rightVal := right.(*object.String).Value
+	in.operation(16)
+	// the new string isn't bound yet, but must fit into what the job has left
+	if in.memory+uint64(len(leftVal)+len(rightVal)) > in.limits.MaxMemory {
+		in.abort(ABORT_MEMORY)
+	}
+	return &object.String{Value: leftVal + rightVal}
+}
+
+func (in *Interpreter) evalIntegerInfixExpression(operator string, left, right object.Object) object.Object {
+	leftVal := left.(*object.Integer).Value
+	rightVal := right.(*object.Integer).Value
+	switch operator {
+	case "+":
+		in.operation(0)
+		return &object.Integer{Value: leftVal + rightVal}
+	case "-":
+		in.operation(1)
+		return &object.Integer{Value: leftVal - rightVal}
+	case "*":
+		in.operation(2)
+		return &object.Integer{Value: leftVal * rightVal}
+	case "/":
+		in.operation(3)
+		if rightVal == 0 {
+			return newError("division by zero")
+		}
+		return &object.Integer{Value: leftVal / rightVal}
+	case "<":
+		in.operation(4)
+		return nativeBoolToBooleanObject(leftVal < rightVal)
+	case ">":
+		in.operation(5)
+		return nativeBoolToBooleanObject(leftVal > rightVal)
+	case "==":
+		in.operation(6)
+		return nativeBoolToBooleanObject(leftVal == rightVal)
+	case "!=":
+		in.operation(7)
+		return nativeBoolToBooleanObject(leftVal != rightVal)
+	default:
+		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
+	}
+}
+
+func evalPrefixExpression(operator string, right object.Object) object.Object {
+	switch operator {
+	case "!":
+		return evalBangOperatorExpression(right)
+	case "-":
+		return evalMinusPrefixOperatorExpression(right)
+	default:
+		return newError("unknown operator: %s%s", operator, right.Type())
+	}
+}
+
+func evalBangOperatorExpression(right object.Object) object.Object {
+	switch right {
+	case TRUE:
+		return FALSE
+	case FALSE:
+		return TRUE
+	case NULL:
+		return TRUE
+	default:
+		return FALSE
+	}
+}
+
+func evalMinusPrefixOperatorExpression(right object.Object) object.Object {
+	if right.Type() != object.INTEGER_OBJ {
+		return newError("unknown operator: -%s", right.Type())
+	}
+	return &object.Integer{Value: -right.(*object.Integer).Value}
+}
+
+func nativeBoolToBooleanObject(boolean bool) *object.Boolean {
+	if boolean {
+		return TRUE
+	}
+	return FALSE
+}
+
+// Operation codes of the builtins, the others are counted as a call only
+var builtinOperations = map[string]int{
+	"isPrime": 8,
+	"sin":     9,
+	"tan":     10,
+	"rand":    11,
+	"pow":     12,
+	"sqrt":    13,
+	"len":     14,
+	"fib":     15,
+}
+
+func (in *Interpreter) applyFunction(fn object.Object, args []object.Object) object.Object {
+	switch fn := fn.(type) {
+	case *object.Function:
+		if len(args) < len(fn.Parameters) {
+			return newError("wrong number of arguments. got=%d, want=%d", len(args), len(fn.Parameters))
+		}
+		in.checkpoint()
+		in.charge(CALL_FRAME_SIZE)
+		env := object.NewEnclosedEnvironment(fn.Env)
+		for i, param := range fn.Parameters {
+			in.bind(env, param.Value, args[i])
+		}
+		result := unwrapReturnValue(in.eval(fn.Body, env))
+		// a returned function keeps the call's environment alive, it stays charged
+		if _, ok := result.(*object.Function); !ok {
+			in.release(env)
+		}
+		return result
+	case *object.Save:
+		if len(args) != 2 {
+			return newError("wrong number of arguments. got=%d, want=2", len(args))
+		}
+		if args[0].Type() != object.STRING_OBJ {
+			return newError("arguments to `save` not supported, got %s", args[0].Type())
+		}
+		in.onResult(object.Result{Key: args[0].Inspect(), Value: args[1]})
+		return NULL
+	case *object.Builtin:
+		if code, ok := builtinOperations[fn.Name]; ok {
+			in.operation(code)
+		}
+		switch fn.Name {
+		case "fib":
+			return in.fib(args...)
+		case "isPrime":
+			return in.isPrime(args...)
+		}
+		return fn.Fn(args...)
+	default:
+		return newError("not a function: %s", fn.Type())
+	}
+}
+
+func unwrapReturnValue(obj object.Object) object.Object {
+	if returnValue, ok := obj.(*object.ReturnValue); ok {
+		return returnValue.Value
+	}
+	return obj
+}
+
+func newError(format string, a ...interface{}) *object.Error {
+	return &object.Error{Message: fmt.Sprintf(format, a...)}
+}
+
+func isError(obj object.Object) bool {
+	if obj != nil {
+		return obj.Type() == object.ERROR_OBJ
+	}
+	return false
+}
+
+// Like verigo's fib and isPrime, but stopping at the job's deadline, both loop up to their argument
+func (in *Interpreter) fib(args ...object.Object) object.Object {
+	n, err := integerArg("fib", args)
+	if err != nil {
+		return err
+	}
+	var first, second int64 = 0, 1
+	if n == 0 {
+		return &object.Integer{Value: first}
+	} else if n <= 2 {
+		return &object.Integer{Value: second}
+	}
+	for i := int64(2); i <= n; i++ {
+		if i%BUILTIN_CHECK_INTERVAL == 0 {
+			in.checkpoint()
+		}
+		second = second + first
+		first = second - first
+	}
+	return &object.Integer{Value: second}
+}
+
+func (in *Interpreter) isPrime(args ...object.Object) object.Object {
+	value, err := integerArg("isPrime", args)
+	if err != nil {
+		return err
+	}
+	for i := int64(2); i <= int64(math.Floor(math.Sqrt(float64(value)))); i++ {
+		if i%BUILTIN_CHECK_INTERVAL == 0 {
+			in.checkpoint()
+		}
+		if value%i == 0 {
+			return FALSE
+		}
+	}
+	return nativeBoolToBooleanObject(value > 1)
+}
+
+func integerArg(name string, args []object.Object) (int64, *object.Error) {
+	if len(args) != 1 {
+		return 0, newError("wrong number of arguments. got=%d, want=1", len(args))
+	}
+	arg, ok := args[0].(*object.Integer)
+	if !ok {
+		return 0, newError("argument to `%s` not supported, got %s", name, args[0].Type())
+	}
+	return arg.Value, nil
+}
+
+// Applied by the interpreter itself, it hands the result to onResult
+var saveBuiltin = &object.Save{}
+
+var builtins = map[string]*object.Builtin{
+	"len": {
+		Name: "len",
+		Fn: func(args ...object.Object) object.Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments. got=%d, want=1", len(args))
+			}
+			arg, ok := args[0].(*object.String)
+			if !ok {
+				return newError("argument to `len` not supported, got %s", args[0].Type())
+			}
+			return &object.Integer{Value: int64(len(arg.Value))}
+		},
+	},
+	"pow": {
+		Name: "pow",
+		Fn: func(args ...object.Object) object.Object {
+			if len(args) != 2 {
+				return newError("wrong number of arguments. got=%d, want=2", len(args))
+			}
+			base, ok := args[0].(*object.Integer)
+			if !ok {
+				return newError("argument to `pow` not supported, got %s", args[0].Type())
+			}
+			exponent, ok := args[1].(*object.Integer)
+			if !ok {
+				return newError("argument to `pow` not supported, got %s", args[1].Type())
+			}
+			return &object.Integer{Value: int64(math.Pow(float64(base.Value), float64(exponent.Value)))}
+		},
+	},
+	"sqrt": floatBuiltin("sqrt", math.Sqrt),
+	"sin":  floatBuiltin("sin", math.Sin),
+	"tan":  floatBuiltin("tan", math.Tan),
+	"rand": {
+		Name: "rand",
+		Fn: func(args ...object.Object) object.Object {
+			if _, err := integerArg("rand", args); err != nil {
+				return err
+			}
+			val, err := crand.Int(crand.Reader, big.NewInt(0xFFFF))
+			if err != nil {
+				return &object.Integer{Value: 0}
+			}
+			return &object.Integer{Value: val.Int64()}
+		},
+	},
+	// evaluated by the interpreter, see fib and isPrime
+	"fib":     {Name: "fib"},
+	"isPrime": {Name: "isPrime"},
+	"print": {
+		Fn: func(args ...object.Object) object.Object {
+			for _, arg := range args {
+				fmt.Println(arg.Inspect())
+			}
+			return NULL
+		},
+	},
+}
+
+func floatBuiltin(name string, fn func(float64) float64) *object.Builtin {
+	return &object.Builtin{
+		Name: name,
+		Fn: func(args ...object.Object) object.Object {
+			value, err := integerArg(name, args)
+			if err != nil {
+				return err
+			}
+			return &object.Integer{Value: int64(fn(float64(value)))}
+		},
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/SebastiaanWouters/verigo/object"
+)
+
+func testLimits() Limits {
+	return Limits{MaxOperations: 1 << 40, Timeout: time.Minute, MaxMemory: 1 << 20}
+}
+
+// Runs the script and returns why it was aborted, the operations it counted and the results it saved
+func run(t *testing.T, ctx context.Context, limits Limits, script string) (*Aborted, int, map[string]string) {
+	t.Helper()
+	operations := 0
+	results := make(map[string]string)
+	in := NewInterpreter(ctx, limits, func(int) { operations++ }, func(res object.Result) {
+		results[res.Key] = res.Value.Inspect()
+	})
+	return in.Run(script), operations, results
+}
+
+func TestInterpreterResults(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   map[string]string
+	}{
+		{"arithmetic", `save("x", 2 * (3 + 4) - 10 / 5)`, map[string]string{"x": "12"}},
+		{"strings", `let a = "foo"; save("s", a + "bar"); save("n", len(a))`, map[string]string{"s": "foobar", "n": "3"}},
+		{"functions", `let add = fn(a, b) { a + b }; save("sum", add(2, add(3, 4)))`, map[string]string{"sum": "9"}},
+		{"closures", `let adder = fn(a) { fn(b) { a + b } }; save("c", adder(1)(2))`, map[string]string{"c": "3"}},
+		{"conditionals", `if (1 < 2) { save("if", 1) } else { save("if", 2) }`, map[string]string{"if": "1"}},
+		{"loops", `let n = 0; for (let i = 0; i < 10; let i = i + 1) { let n = n + i }; save("n", n)`, map[string]string{"n": "45"}},
+		{"builtins", `save("p", isPrime(97)); save("q", isPrime(91)); save("f", fib(10)); save("w", pow(2, 10))`,
+			map[string]string{"p": "true", "q": "false", "f": "55", "w": "1024"}},
+		{"errors end the script", `save("a", 1); save("b", missing); save("c", 3)`, map[string]string{"a": "1"}},
+		{"parser errors save nothing", `let = ;`, map[string]string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			aborted, _, results := run(t, context.Background(), testLimits(), test.script)
+			if aborted != nil {
+				t.Fatalf("aborted: %s", aborted.Reason)
+			}
+			if len(results) != len(test.want) {
+				t.Fatalf("saved %v, want %v", results, test.want)
+			}
+			for key, value := range test.want {
+				if results[key] != value {
+					t.Fatalf("saved %s = %s, want %s", key, results[key], value)
+				}
+			}
+		})
+	}
+}
+
+func TestInterpreterLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		limits func(l *Limits)
+		reason string
+	}{
+		// loops that don't call a function or evaluate an operator count their iterations and blocks
+		{"empty loop, operations", `for (let i = 1; i; let i = i) { }`, func(l *Limits) { l.MaxOperations = 1000 }, ABORT_OPERATIONS},
+		{"empty loop, deadline", `for (let i = 1; i; let i = i) { }`, func(l *Limits) {}, ABORT_DEADLINE},
+		{"arithmetic loop", `for (let i = 0; i < 1000000; let i = i + 1) { }`, func(l *Limits) { l.MaxOperations = 100 }, ABORT_OPERATIONS},
+		{"recursion", `let f = fn(n) { f(n + 1) }; f(0)`, func(l *Limits) {}, ABORT_MEMORY},
+		{"string growth", `let s = "x"; for (let i = 0; i < 100; let i = i + 1) { let s = s + s }`, func(l *Limits) {}, ABORT_MEMORY},
+		{"builtin loop", `isPrime(9223372036854775783)`, func(l *Limits) {}, ABORT_DEADLINE},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limits := testLimits()
+			test.limits(&limits)
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			done := make(chan *Aborted, 1)
+			go func() {
+				aborted, _, _ := run(t, ctx, limits, test.script)
+				done <- aborted
+			}()
+			select {
+			case aborted := <-done:
+				if aborted == nil || aborted.Reason != test.reason {
+					t.Fatalf("aborted with %v, want %s", aborted, test.reason)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("the script kept running past its limits")
+			}
+		})
+	}
+}
+
+func TestInterpreterCountsOperations(t *testing.T) {
+	aborted, operations, _ := run(t, context.Background(), testLimits(), `for (let i = 0; i < 10; let i = i + 1) { }`)
+	if aborted != nil {
+		t.Fatalf("aborted: %s", aborted.Reason)
+	}
+	// 11 comparisons, 10 additions, 10 iterations and 10 blocks
+	if operations != 41 {
+		t.Fatalf("counted %d operations, want 41", operations)
+	}
+}
+
+func TestInterpreterReleasesCalls(t *testing.T) {
+	in := NewInterpreter(context.Background(), testLimits(), func(int) {}, func(object.Result) {})
+	if aborted := in.Run(`let f = fn(a) { let b = a + 1; b }; f(1); f(2)`); aborted != nil {
+		t.Fatalf("aborted: %s", aborted.Reason)
+	}
+	// only the top level bindings stay charged
+	if in.Memory() == 0 || in.Memory() >= CALL_FRAME_SIZE {
+		t.Fatalf("%d bytes charged after the calls returned", in.Memory())
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+
+	"worker/minerpb"
+)
+
+const (
+	// Nodes reject key reports referencing a block that is too old, the key is attested again regularly
+	KEY_REFRESH_INTERVAL = time.Minute
+)
+
+// Key pair clients seal confidential scripts to, the private key never leaves the enclave unsealed
+type JobKey struct {
+	public  [32]byte
+	private [32]byte
+}
+
+var jobKey *JobKey
+
+var errUndecryptable = errors.New("script could not be decrypted")
+var errResultKey = errors.New("sealed job without a valid result key")
+
+// Plaintext of a confidential job as the client seals it: the script and the X25519 key, hex encoded, its results
+// are sealed to. Both travel in the box, so the node can't swap the key for one of its own.
+type SealedJob struct {
+	Script    string
+	ResultKey string
+}
+
+// Restores the key pair from its private key, or generates a new one if there is none yet
+func newJobKey(private []byte) (*JobKey, error) {
+	k := &JobKey{}
+	if len(private) == 0 {
+		if _, err := rand.Read(k.private[:]); err != nil {
+			return nil, err
+		}
+	} else if len(private) == len(k.private) {
+		copy(k.private[:], private)
+	} else {
+		return nil, errTampered
+	}
+	public, err := curve25519.X25519(k.private[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	copy(k.public[:], public)
+	return k, nil
+}
+
+// Report binding the public key to this enclave and to the current tip, which shows the report is recent
+func (k *JobKey) attest() ([]byte, error) {
+	return remoteReport(keyData(k.public[:], getLatestBlock().Hash))
+}
+
+// Report data of a key report: the SHA256 of the public key, followed by the first 32 characters of the tip's hash
+func keyData(public []byte, tipHash string) []byte {
+	data := make([]byte, REPORT_DATA_SIZE)
+	digest := sha256.Sum256(public)
+	copy(data[:32], digest[:])
+	copy(data[32:], tipHash)
+	return data
+}
+
+// Opens a script sealed to the public key as a NaCl anonymous box
+func (k *JobKey) Open(sealed []byte) (string, error) {
+	script, ok := box.OpenAnonymous(nil, sealed, &k.public, &k.private)
+	if !ok {
+		return "", errUndecryptable
+	}
+	return string(script), nil
+}
+
+// Opens a confidential job, its results are sealed to the returned key
+func (k *JobKey) OpenJob(sealed []byte) (string, *[32]byte, error) {
+	plaintext, ok := box.OpenAnonymous(nil, sealed, &k.public, &k.private)
+	if !ok {
+		return "", nil, errUndecryptable
+	}
+	var job SealedJob
+	if err := json.Unmarshal(plaintext, &job); err != nil {
+		return "", nil, errUndecryptable
+	}
+	key, err := hex.DecodeString(job.ResultKey)
+	if err != nil || len(key) != 32 {
+		return "", nil, errResultKey
+	}
+	resultKey := &[32]byte{}
+	copy(resultKey[:], key)
+	return job.Script, resultKey, nil
+}
+
+// Seals a result of a confidential job to the client's key, the node only ever stores the returned json string
+// of the box. The box holds the result's key and value like a plaintext result.
+func sealResult(key *[32]byte, resultKey string, value json.RawMessage) (json.RawMessage, error) {
+	plaintext, err := json.Marshal(struct {
+		Key   string
+		Value json.RawMessage
+	}{resultKey, value})
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := box.SealAnonymous(nil, plaintext, key, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(sealed)
+}
+
+// Publishes the public key to the node with a new report, the node answers with our session token sealed to the key
+func publishKey() {
+	report, err := jobKey.attest()
+	if err != nil {
+		attestLog.Error("Attesting key failed", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	res, err := client.PublishKey(ctx, &minerpb.PublishKeyRequest{
+		Version:   PROTOCOL_VERSION,
+		WorkerId:  workerID,
+		PublicKey: jobKey.public[:],
+		Report:    report,
+	})
+	if err != nil {
+		attestLog.Error("Publishing key failed", err)
+		return
+	}
+	token, ok := box.OpenAnonymous(nil, res.GetSealedToken(), &jobKey.public, &jobKey.private)
+	if !ok {
+		attestLog.Error("Opening session token failed", errUndecryptable)
+		return
+	}
+	setSessionToken(string(token))
+}
+
+func keyRefresher() {
+	for {
+		time.Sleep(KEY_REFRESH_INTERVAL)
+		publishKey()
+	}
+}
+
+// Reads the local script, a sealed script in the data directory is preferred over the plaintext one
+func localScript() string {
+	if sealed, err := os.ReadFile(sealedScriptFile()); err == nil {
+		script, err := jobKey.Open(sealed)
+		if err != nil {
+			workerLog.Warn("Ignoring sealed script", "file", sealedScriptFile(), "err", err)
+			return ""
+		}
+		return script
+	}
+	if dat, err := os.ReadFile("/worker/script.vg"); err == nil {
+		return string(dat)
+	}
+	return ""
+}
+
+// GET /key returns the public key and its attestation report
+func serveKey(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	report, err := jobKey.attest()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"Worker":    workerID,
+		"PublicKey": jobKey.public[:],
+		"Report":    report,
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/SebastiaanWouters/verigo/object"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Seals a confidential job to the worker like a client, returns the client's result key pair
+func sealTestJob(t *testing.T, k *JobKey, script string) ([]byte, *[32]byte, *[32]byte) {
+	t.Helper()
+	public, private, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, _ := json.Marshal(SealedJob{Script: script, ResultKey: hex.EncodeToString(public[:])})
+	sealed, err := box.SealAnonymous(nil, plaintext, &k.public, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sealed, public, private
+}
+
+func TestConfidentialResultsSealed(t *testing.T) {
+	k, err := newJobKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, public, private := sealTestJob(t, k, `save("secret", 42)`)
+	script, resultKey, err := k.OpenJob(sealed)
+	if err != nil || script != `save("secret", 42)` || *resultKey != *public {
+		t.Fatalf("opened %q with key %x, %v", script, resultKey, err)
+	}
+
+	res := object.Result{Key: "secret", Value: &object.Integer{Value: 42}}
+	stored, err := storedResult(Job{ID: "j", ResultKey: resultKey}, res, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// outside the enclave only the position and the box are visible
+	if stored.Key != "3" {
+		t.Fatalf("stored under %q, want the position", stored.Key)
+	}
+	var ciphertext []byte
+	if err := json.Unmarshal(stored.Value, &ciphertext); err != nil {
+		t.Fatalf("the value is not a sealed box: %v", err)
+	}
+	plaintext, ok := box.OpenAnonymous(nil, ciphertext, public, private)
+	if !ok {
+		t.Fatal("the client can't open the result")
+	}
+	var opened struct {
+		Key   string
+		Value json.RawMessage
+	}
+	if err := json.Unmarshal(plaintext, &opened); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := json.Marshal(res.Value)
+	if opened.Key != "secret" || string(opened.Value) != string(want) {
+		t.Fatalf("opened %s = %s, want secret = %s", opened.Key, opened.Value, want)
+	}
+
+	// results of other jobs stay as they are
+	plain, err := storedResult(Job{ID: "p"}, res, 3)
+	if err != nil || plain.Key != "secret" || string(plain.Value) != string(want) {
+		t.Fatalf("plaintext result stored as %s = %s, %v", plain.Key, plain.Value, err)
+	}
+}
+
+func TestOpenJobRejects(t *testing.T) {
+	k, _ := newJobKey(nil)
+	other, _ := newJobKey(nil)
+	sealed, _, _ := sealTestJob(t, other, "1")
+	if _, _, err := k.OpenJob(sealed); err != errUndecryptable {
+		t.Fatalf("opened a job sealed to another worker: %v", err)
+	}
+	for _, resultKey := range []string{"", "zz", hex.EncodeToString(make([]byte, 16))} {
+		plaintext, _ := json.Marshal(SealedJob{Script: "1", ResultKey: resultKey})
+		sealed, _ := box.SealAnonymous(nil, plaintext, &k.public, rand.Reader)
+		if _, _, err := k.OpenJob(sealed); err != errResultKey {
+			t.Fatalf("accepted result key %q: %v", resultKey, err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"time"
+
+	"worker/minerpb"
+)
+
+const (
+	DEFAULT_MAX_OPERATIONS = 100 * OPS_PER_BLOCK
+	DEFAULT_TIMEOUT        = 10 * time.Minute
+	DEFAULT_MAX_MEMORY     = 256 << 20
+	// the enclave has a heap of 512MB (see enclave.json), a single job never gets more than this
+	MAX_MEMORY = 384 << 20
+)
+
+type Limits struct {
+	MaxOperations uint64
+	Timeout       time.Duration
+	MaxMemory     uint64
+}
+
+// Result of a job whose evaluation was stopped because it exceeded one of its limits
+type Aborted struct {
+	Reason     string
+	Operations uint64
+	Elapsed    time.Duration
+}
+
+const (
+	ABORT_OPERATIONS = "operation budget exceeded"
+	ABORT_DEADLINE   = "deadline exceeded"
+	ABORT_MEMORY     = "memory limit exceeded"
+	ABORT_SHUTDOWN   = "worker shut down before starting the job"
+)
+
+// Fills in the defaults for limits the node left open and caps the memory to what the enclave can offer
+func jobLimits(l *minerpb.Limits) Limits {
+	limits := Limits{
+		MaxOperations: l.GetMaxOperations(),
+		Timeout:       time.Duration(l.GetTimeoutSeconds()) * time.Second,
+		MaxMemory:     l.GetMaxMemoryBytes(),
+	}
+	if limits.MaxOperations == 0 {
+		limits.MaxOperations = DEFAULT_MAX_OPERATIONS
+	}
+	if limits.Timeout == 0 {
+		limits.Timeout = DEFAULT_TIMEOUT
+	}
+	if limits.MaxMemory == 0 {
+		limits.MaxMemory = DEFAULT_MAX_MEMORY
+	}
+	if limits.MaxMemory > MAX_MEMORY {
+		limits.MaxMemory = MAX_MEMORY
+	}
+	return limits
+}
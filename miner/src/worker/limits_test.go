@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"worker/minerpb"
+)
+
+func TestJobLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits *minerpb.Limits
+		want   Limits
+	}{
+		{"none", nil, Limits{DEFAULT_MAX_OPERATIONS, DEFAULT_TIMEOUT, DEFAULT_MAX_MEMORY}},
+		{"left open", &minerpb.Limits{}, Limits{DEFAULT_MAX_OPERATIONS, DEFAULT_TIMEOUT, DEFAULT_MAX_MEMORY}},
+		{"given", &minerpb.Limits{MaxOperations: 1000, TimeoutSeconds: 5, MaxMemoryBytes: 1 << 20},
+			Limits{1000, 5 * time.Second, 1 << 20}},
+		{"more memory than the enclave has", &minerpb.Limits{MaxMemoryBytes: 1 << 30},
+			Limits{DEFAULT_MAX_OPERATIONS, DEFAULT_TIMEOUT, MAX_MEMORY}},
+	}
+	for _, test := range tests {
+		if limits := jobLimits(test.limits); limits != test.want {
+			t.Errorf("%s: %+v, want %+v", test.name, limits, test.want)
+		}
+	}
+}
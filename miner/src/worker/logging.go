@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/exp/slog"
+)
+
+// Subsystem loggers, every record carries its subsystem. Output and format are set by configureLogging.
+var (
+	chainLog  *slog.Logger
+	httpLog   *slog.Logger
+	workerLog *slog.Logger
+	attestLog *slog.Logger
+)
+
+// Minimum level logged, changed at runtime with PUT /loglevel
+var logLevel = new(slog.LevelVar)
+
+func init() {
+	setLogOutput(os.Stderr, false)
+}
+
+func setLogOutput(w io.Writer, json bool) {
+	opts := slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler = opts.NewTextHandler(w)
+	if json {
+		handler = opts.NewJSONHandler(w)
+	}
+	logger := slog.New(handler)
+	slog.SetDefault(logger)
+	chainLog = logger.With("subsystem", "chain")
+	httpLog = logger.With("subsystem", "http")
+	workerLog = logger.With("subsystem", "worker")
+	attestLog = logger.With("subsystem", "attest")
+}
+
+func parseLogLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "debug":
+		return slog.DebugLevel, nil
+	case "info":
+		return slog.InfoLevel, nil
+	case "warn":
+		return slog.WarnLevel, nil
+	case "error":
+		return slog.ErrorLevel, nil
+	}
+	return 0, fmt.Errorf("invalid log level %q", name)
+}
+
+// Sets the level and format, logs are written to stderr and to logs/worker.log in the data directory
+func configureLogging(level string, format string) error {
+	l, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	if format != "text" && format != "json" {
+		return fmt.Errorf("invalid log format %q", format)
+	}
+	logLevel.Set(l)
+
+	dir := filepath.Join(dataDir, "logs")
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "worker.log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	setLogOutput(io.MultiWriter(os.Stderr, f), format == "json")
+	return nil
+}
+
+// Logs at error level and exits, for errors the worker can't run with
+func fatal(logger *slog.Logger, msg string, err error, args ...any) {
+	logger.Error(msg, err, args...)
+	os.Exit(1)
+}
+
+// GET /loglevel returns the level, PUT /loglevel with a level as body (debug, info, warn or error) changes it
+func serveLogLevel(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		body, err := io.ReadAll(io.LimitReader(req.Body, 64))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		level, err := parseLogLevel(string(body))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logLevel.Set(level)
+		httpLog.Info("Log level changed", "level", level)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fmt.Fprintln(w, logLevel.Level())
+}
@@ -1,33 +1,40 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"crypto/sha256"
-	"encoding/binary"
 	"encoding/hex"
-	"encoding/json"
-	"io/ioutil"
-	"log"
+	"flag"
 	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/SebastiaanWouters/verigo/object"
-	"github.com/SebastiaanWouters/verigo/repl"
-	"github.com/edgelesssys/ego/enclave"
-)
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
-type Blockchain []Block
+	"worker/minerpb"
+)
 
 type Block struct {
-	Index    int
-	Txs      string
-	Hash     string
-	Nonce    uint32
-	PrevHash string
-	Proof    []byte
+	Index  int
+	Txs    string
+	TxRoot string
+	// Result commitments of finished jobs and their root, bound like the transactions
+	Results    string
+	ResultRoot string
+	Hash       string
+	Nonce      uint32
+	PrevHash   string
+	Proof      []byte
+	// The sealed epoch, the node checks both against the attestation
+	Operations uint64
+	Epoch      uint64
 }
 
 type Results struct {
@@ -42,23 +49,15 @@ type Tx struct {
 	Sig    string
 }
 
-var genesisBlock = Block{
-	Index:    0,
-	Txs:      "",
-	Hash:     "0000000000000000000000000000000000000000",
-	Nonce:    21,
-	PrevHash: "",
-	Proof:    []byte(""),
-}
-
-var operations uint32 = 0
-var results []int
-var blockchain Blockchain
+var sealer Sealer
+var resultStore *ResultStore
 var difficulty int = 1
-var operationCount int = 0
+var work = NewWorkAccumulator(OPS_PER_BLOCK)
 
 const (
 	OPS_PER_BLOCK = 10000000
+	// job key, log level, metrics and, to holders of the api token, the stored results
+	HTTP_ADDRESS = "127.0.0.1:4003"
 )
 
 func check(e error) {
@@ -67,25 +66,9 @@ func check(e error) {
 	}
 }
 
-func opChanMonitor(c chan int) {
-	for {
-		<-c
-		operationCount += 1
-		if operationCount%OPS_PER_BLOCK == 0 {
-			tryBlock()
-		}
-	}
-}
-
-func rChanMonitor(c chan object.Result) {
-	for {
-		writeToDisk(<-c)
-	}
-}
-
 // SHA256 hashing
 func calculateBlockHash(block Block) string {
-	record := strconv.Itoa(block.Index) + block.PrevHash + strconv.Itoa(int(block.Nonce)) + string(block.Proof)
+	record := strconv.Itoa(block.Index) + block.PrevHash + strconv.Itoa(int(block.Nonce)) + block.TxRoot + block.ResultRoot + string(block.Proof)
 	h := sha256.New()
 	h.Write([]byte(record))
 	hashed := h.Sum(nil)
@@ -109,176 +92,172 @@ func validateHash(hash string) bool {
 		leadingZeros++
 	}
 
+	tipMutex.Lock()
+	threshold := difficulty
+	tipMutex.Unlock()
+
 	// Check against threshold
-	if leadingZeros >= difficulty {
+	if leadingZeros >= threshold {
 		return true
 	} else {
 		return false
 	}
 }
 
+// Returns the chain tip as streamed by the node, waits until the first tip has been received
 func getLatestBlock() Block {
-	content, err := ioutil.ReadFile("/data/blockchain.json")
-	if err != nil {
-		path := "/data"
-		err := os.MkdirAll(path, os.ModePerm)
-		if err != nil {
-			log.Fatalln(err)
-		}
-		blockchain = append(blockchain, genesisBlock)
-		bytes, err := json.MarshalIndent(blockchain, "", "  ")
-		if err != nil {
-			log.Fatalln("Failed to initialize blockchain", err)
-		}
-		ioutil.WriteFile("/data/blockchain.json", bytes, 0644)
-		log.Println("Initialized blockchain with genesis block")
-	}
-	content, err = ioutil.ReadFile("/data/blockchain.json")
-
-	// Now let's unmarshall the data into `payload`
-	var payload Blockchain
-	err = json.Unmarshal(content, &payload)
-	if err != nil {
-		log.Fatal("Error during Unmarshal(): ", err)
-	}
-
-	// Let's print the unmarshalled data!
-	blockchain = payload
-	return blockchain[len(blockchain)-1]
-
+	<-firstTip
+	tipMutex.Lock()
+	defer tipMutex.Unlock()
+	return tip
 }
 
 func main() {
-	evalFile("/worker/script.vg")
-}
+	flag.StringVar(&dataDir, "datadir", dataDir, "Directory holding the results, keys and logs, must be reachable inside the enclave")
+	flag.StringVar(&nodeAddress, "node", nodeAddress, "gRPC address of the node")
+	logLevelName := flag.String("log-level", "info", "Minimum level logged: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "Log format: text or json")
+	flag.Parse()
+	if err := lockDataDir(); err != nil {
+		fatal(workerLog, "Locking the data directory failed", err)
+	}
+	if err := configureLogging(*logLevelName, *logFormat); err != nil {
+		fatal(workerLog, "Configuring logging failed", err)
+	}
 
-func evalFile(path string) {
-	opChan := make(chan int)
-	go opChanMonitor(opChan)
-	rChan := make(chan object.Result)
-	go rChanMonitor(rChan)
-	dat, err := os.ReadFile(path)
+	var err error
+	sealer = newSealer()
+	resultStore, err = OpenResultStore(resultsDir(), sealer, RESULTS_SEGMENT_SIZE, RESULTS_SEGMENTS)
 	if err != nil {
-		log.Fatalln("Reading File Failed")
+		fatal(workerLog, "Opening result store failed", err)
 	}
-	input := string(dat)
-
-	repl.Eval(input, rChan, opChan)
-
-	log.Println("Operations executed: ", operationCount)
-}
-
-func tryBlock() {
-	latestBlock := getLatestBlock()
-	hash := []byte(latestBlock.Hash)
-	attestation := generateAttestationWithHash(hash)
-	block := generateBlock(attestation)
-
-	log.Println("Found a block with hash: ", block.Hash)
-
-	if validateHash(block.Hash) {
-		log.Println("Block satisfies the dificulty requirement, broadcasting to the network...")
-		broadcast(block)
+	defer resultStore.Close()
+	state, err := loadState(stateFile())
+	if err != nil {
+		fatal(workerLog, "Loading state failed", err)
 	}
-}
+	if err := restoreState(state); err != nil {
+		fatal(workerLog, "Restoring state failed", err)
+	}
+	// a new job key must be sealed before it is published
+	persistState()
+	if err := writeAPIToken(); err != nil {
+		fatal(workerLog, "Writing the api token failed", err)
+	}
+	go serveHTTP()
 
-func generateAttestation() []byte {
-	buf := make([]byte, 10)
-	binary.LittleEndian.PutUint32(buf, operations)
-	byteArray := []byte{buf[0], buf[1], buf[2], buf[3], buf[4], buf[5], buf[6], buf[7], buf[8], buf[8], buf[9]}
-	log.Println("Operations: ", operations)
-	report, err := enclave.GetRemoteReport(byteArray)
-	check(err)
-	return report
+	connectNode()
+	go watchTip()
+	go statsReporter()
+	go keyRefresher()
 
-}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 
-func generateAttestationWithHash(hash []byte) []byte {
-	report, err := enclave.GetRemoteReport(hash)
-	check(err)
-	return report
-}
+	// the local script is evaluated next to the jobs handed out by the node
+	if script := localScript(); script != "" {
+		jobQueue <- Job{Script: script, Limits: jobLimits(nil)}
+	}
 
-func generateBlock(attestation []byte) Block {
-	nonce := rand.Uint32()
-	latestBlock := getLatestBlock()
-	prevHash := latestBlock.Hash
-	prevIndex := latestBlock.Index
-	block := Block{
-		Txs:      "",
-		Nonce:    nonce,
-		PrevHash: prevHash,
-		Index:    prevIndex + 1,
-		Proof:    attestation,
+	wg := &sync.WaitGroup{}
+	for i := 0; i < EVALUATORS; i++ {
+		wg.Add(1)
+		go (&evaluator{id: i}).run(ctx, wg)
 	}
-	block.Hash = calculateBlockHash(block)
-	return block
+	go blockProducer(ctx)
+	go submitter()
+	go fetchJobs(ctx)
+
+	<-ctx.Done()
+	workerLog.Info("Shutting down, waiting for running jobs to finish")
+	shutdown(wg)
+	persistState()
+	workerLog.Info("Stopped", "operations", work.Total())
 }
 
-func writeToDisk(res object.Result) {
-	filename := "/worker/results.json"
-
-	err := checkFile(filename)
-	if err != nil {
-		log.Println(err)
+func serveHTTP() {
+	http.HandleFunc("/key", serveKey)
+	http.HandleFunc("/loglevel", serveLogLevel)
+	http.HandleFunc("/results", requireAPIToken(serveResults))
+	http.Handle("/metrics", promhttp.Handler())
+	httpLog.Info("Listening", "addr", HTTP_ADDRESS)
+	if err := http.ListenAndServe(HTTP_ADDRESS, nil); err != nil {
+		httpLog.Error("HTTP server failed", err)
 	}
+}
 
-	file, err := ioutil.ReadFile(filename)
-	if err != nil {
-		log.Println(err)
+// Seals the epoch into a block on the node's tip carrying the pending transactions and our result commitments.
+// The attestation binds them through their roots, the node rejects the block if they are replaced.
+func tryBlock() {
+	epoch := work.Seal()
+	w := getBlockWork(pendingJobs())
+	if w == nil {
+		return
 	}
-
-	data := []object.Result{}
-
-	json.Unmarshal(file, &data)
-
-	data = append(data, res)
-
-	// Preparing the data to be marshalled and written.
-	dataBytes, err := json.Marshal(data)
+	latestBlock := fromProtoBlock(w.GetTip().GetBlock())
+	block, err := newBlock(latestBlock, w.GetTxs(), blockCommitments(latestBlock, w.GetCommitted()), epoch)
 	if err != nil {
-		log.Println(err)
+		chainLog.Warn("Node sent invalid transactions", "err", err)
+		return
 	}
-
-	err = ioutil.WriteFile(filename, dataBytes, 0644)
+	// the epoch's operations are lost, the next epoch tries again
+	block.Proof, err = generateAttestation(block)
 	if err != nil {
-		log.Println(err)
+		chainLog.Error("Generating the block's attestation failed", err, "epoch", epoch.Number)
+		return
 	}
+	block.Hash = calculateBlockHash(block)
 
-}
+	chainLog.Debug("Found a block", "hash", block.Hash, "operations", epoch.Operations, "epoch", epoch.Number, "txs", block.TxRoot)
 
-func checkFile(filename string) error {
-	_, err := os.Stat(filename)
-	if os.IsNotExist(err) {
-		_, err := os.Create(filename)
-		if err != nil {
-			return err
-		}
+	if validateHash(block.Hash) {
+		chainLog.Info("Block satisfies the difficulty requirement, broadcasting to the network", "index", block.Index, "hash", block.Hash)
+		broadcast(block)
 	}
-	return nil
 }
 
-func broadcast(block Block) {
+func generateAttestation(block Block) ([]byte, error) {
+	return remoteReport(attestationData(block))
+}
 
-	// marshall data to json (like json_encode)
-	marshalled, err := json.Marshal(block)
+func newBlock(latestBlock Block, txs string, results string, epoch Epoch) (Block, error) {
+	root, err := listRoot(txs)
 	if err != nil {
-		log.Println("impossible to marshall block: %s", err)
+		return Block{}, err
 	}
-	req, err := http.NewRequest("POST", "http://localhost:4001/newblock", bytes.NewReader(marshalled))
+	resultRoot, err := listRoot(results)
 	if err != nil {
-		log.Println("impossible to build request: %s", err)
-
+		return Block{}, err
 	}
+	return Block{
+		Index:      latestBlock.Index + 1,
+		Txs:        txs,
+		TxRoot:     root,
+		Results:    results,
+		ResultRoot: resultRoot,
+		Nonce:      rand.Uint32(),
+		PrevHash:   latestBlock.Hash,
+		Operations: epoch.Operations,
+		Epoch:      epoch.Number,
+	}, nil
+}
 
-	client := http.Client{Timeout: 10 * time.Second}
-	// send the request
-	res, err := client.Do(req)
+func broadcast(block Block) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	res, err := client.SubmitBlock(ctx, &minerpb.SubmitBlockRequest{
+		Version:  PROTOCOL_VERSION,
+		WorkerId: workerID,
+		Block:    toProtoBlock(block),
+	})
 	if err != nil {
-		log.Println("impossible to send request: %s", err)
+		chainLog.Error("Submitting block failed", err)
 		return
 	}
-	log.Printf("status Code: %d", res.StatusCode)
-
-	defer res.Body.Close()
+	if res.GetAccepted() {
+		atomic.AddUint64(&blocksFound, 1)
+		chainLog.Info("Block accepted by the node", "index", block.Index)
+	} else {
+		chainLog.Warn("Block rejected by the node", "index", block.Index, "reason", res.GetReason())
+	}
 }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// Merkle roots of a block's transactions and result commitments, computed like the node does: leaves and inner nodes are hashed with
+// different prefixes and the last node of an odd level is carried up as it is.
+
+func merkleLeaf(data []byte) []byte {
+	sum := sha256.Sum256(append([]byte{0}, data...))
+	return sum[:]
+}
+
+func merkleNode(left []byte, right []byte) []byte {
+	sum := sha256.Sum256(append(append([]byte{1}, left...), right...))
+	return sum[:]
+}
+
+// Hex encoded root of the tree, empty for no leaves
+func merkleRoot(leaves [][]byte) string {
+	if len(leaves) == 0 {
+		return ""
+	}
+	level := make([][]byte, len(leaves))
+	for i, leaf := range leaves {
+		level[i] = merkleLeaf(leaf)
+	}
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+			} else {
+				next = append(next, merkleNode(level[i], level[i+1]))
+			}
+		}
+		level = next
+	}
+	return hex.EncodeToString(level[0])
+}
+
+// Root of a json encoded list, the transactions handed out by the node or our result commitments. Both are encoded
+// canonically, so each element as sent is the leaf the node computes.
+func listRoot(list string) (string, error) {
+	if list == "" {
+		return "", nil
+	}
+	var elements []json.RawMessage
+	if err := json.Unmarshal([]byte(list), &elements); err != nil {
+		return "", err
+	}
+	leaves := make([][]byte, len(elements))
+	for i, element := range elements {
+		leaves[i] = element
+	}
+	return merkleRoot(leaves), nil
+}
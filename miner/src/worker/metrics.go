@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics served at /metrics on the results address. Operations per second are the rate of poc_operations_total.
+var (
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "poc_operations_total",
+		Help: "Operations evaluated by all evaluators",
+	}, func() float64 {
+		return float64(work.Total())
+	})
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "poc_blocks_found_total",
+		Help: "Blocks found and accepted by the node",
+	}, func() float64 {
+		return float64(atomic.LoadUint64(&blocksFound))
+	})
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "poc_results_submitted_total",
+		Help: "Job results submitted to the node",
+	}, func() float64 {
+		return float64(atomic.LoadUint64(&resultsSubmitted))
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "poc_chain_height",
+		Help: "Index of the chain tip as last streamed by the node",
+	}, func() float64 {
+		tipMutex.Lock()
+		defer tipMutex.Unlock()
+		return float64(tip.Index)
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "poc_jobs_queued",
+		Help: "Jobs waiting for an evaluator",
+	}, func() float64 {
+		return float64(len(jobQueue))
+	})
+	jobsEvaluated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "poc_jobs_total",
+		Help: "Evaluated jobs by outcome",
+	}, []string{"outcome"})
+	reportGeneration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "poc_get_remote_report_seconds",
+		Help:    "Duration of GetRemoteReport calls by result",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"result"})
+)
+
+func timeReportGeneration(start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	reportGeneration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+}
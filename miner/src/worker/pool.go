@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/SebastiaanWouters/verigo/object"
+
+	"worker/minerpb"
+)
+
+const (
+	QUEUE_SIZE       = 16
+	EVALUATORS       = 4
+	POLL_INTERVAL    = 2 * time.Second
+	SHUTDOWN_TIMEOUT = 30 * time.Second
+	// results and outcomes waiting to be sent to the node
+	SUBMISSION_QUEUE_SIZE = 256
+)
+
+type Job struct {
+	ID     string
+	Script string
+	Limits Limits
+	// Set for confidential jobs, their results are sealed to the client's key
+	ResultKey *[32]byte
+}
+
+// An evaluator runs one job at a time and keeps count of its own operations
+type evaluator struct {
+	id         int
+	operations uint64
+}
+
+var jobQueue = make(chan Job, QUEUE_SIZE)
+
+// A result or the outcome of a job on its way to the node
+type submission struct {
+	job     string
+	started bool
+	result  *StoredResult
+	done    bool
+	aborted *Aborted
+}
+
+// Evaluators queue what they send to the node and carry on, a single submitter sends it in order,
+// so the results of a job reach the node before the job is finished or aborted
+var submissions = make(chan submission, SUBMISSION_QUEUE_SIZE)
+var pendingSubmissions sync.WaitGroup
+
+func submitter() {
+	for s := range submissions {
+		switch {
+		case s.started:
+			startJob(s.job)
+		case s.result != nil:
+			submitResult(s.job, s.result.Key, s.result.Value)
+		case s.aborted != nil:
+			abortJob(s.job, s.aborted)
+		case s.done:
+			finishJob(s.job)
+		}
+		pendingSubmissions.Done()
+	}
+}
+
+func (e *evaluator) run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-jobQueue:
+			// the node holds the job for us until its timeout from now on
+			if job.ID != "" {
+				pendingSubmissions.Add(1)
+				submissions <- submission{job: job.ID, started: true}
+			}
+			aborted := e.eval(job)
+			if aborted != nil {
+				workerLog.Info("Job aborted", "evaluator", e.id, "job", job.ID, "operations", aborted.Operations, "reason", aborted.Reason)
+				jobsEvaluated.WithLabelValues("aborted").Inc()
+			} else {
+				workerLog.Info("Job finished", "evaluator", e.id, "job", job.ID, "evaluator_operations", atomic.LoadUint64(&e.operations))
+				jobsEvaluated.WithLabelValues("finished").Inc()
+				if job.ID != "" {
+					if err := commitResults(job.ID); err != nil {
+						workerLog.Error("Committing results failed", err, "job", job.ID)
+					}
+				}
+			}
+			pendingSubmissions.Add(1)
+			submissions <- submission{job: job.ID, done: true, aborted: aborted}
+		}
+	}
+}
+
+// Evaluates a job within its limits, results are stored and queued for the node under the job's id.
+// Returns nil when the script ran to completion, an aborted evaluation has stopped when eval returns.
+func (e *evaluator) eval(job Job) *Aborted {
+	ctx, cancel := context.WithTimeout(context.Background(), job.Limits.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	var in *Interpreter
+	sealed := 0
+	in = NewInterpreter(ctx, job.Limits, func(int) { e.countOperation() }, func(res object.Result) {
+		stored, err := storedResult(job, res, sealed)
+		if err != nil {
+			workerLog.Error("Encoding result failed", err, "job", job.ID)
+			return
+		}
+		sealed++
+		if err := resultStore.Append(job.ID, stored.Key, stored.Value); err != nil {
+			workerLog.Error("Storing result failed", err, "job", job.ID)
+		}
+		// a full queue holds the job back, but not past its deadline
+		pendingSubmissions.Add(1)
+		select {
+		case submissions <- submission{job: job.ID, result: &stored}:
+		case <-ctx.Done():
+			pendingSubmissions.Done()
+			in.abort(ABORT_DEADLINE)
+		}
+	})
+	aborted := in.Run(job.Script)
+	if aborted != nil {
+		aborted.Elapsed = time.Since(start)
+	}
+	return aborted
+}
+
+// The result as it leaves the enclave. A confidential job's result is sealed to the client's key with its key
+// inside the box, outside it is known by its position among the job's results.
+func storedResult(job Job, res object.Result, position int) (StoredResult, error) {
+	value, err := json.Marshal(res.Value)
+	if err != nil {
+		return StoredResult{}, err
+	}
+	if job.ResultKey == nil {
+		return StoredResult{Job: job.ID, Key: res.Key, Value: value}, nil
+	}
+	value, err = sealResult(job.ResultKey, res.Key, value)
+	return StoredResult{Job: job.ID, Key: strconv.Itoa(position), Value: value}, err
+}
+
+func (e *evaluator) countOperation() {
+	atomic.AddUint64(&e.operations, 1)
+	work.Add(1)
+}
+
+// Attempts a block every OPS_PER_BLOCK operations, in its own goroutine so the evaluators keep running during attestation
+func blockProducer(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-work.Ready():
+			tryBlock()
+		}
+	}
+}
+
+// Pulls jobs from the node as long as there is room in the queue
+func fetchJobs(ctx context.Context) {
+	for ctx.Err() == nil {
+		var work *minerpb.Work
+		if len(jobQueue) < cap(jobQueue) {
+			work = getWork()
+		}
+		if work == nil || work.GetJob() == nil {
+			select {
+			case <-ctx.Done():
+			case <-time.After(POLL_INTERVAL):
+			}
+			continue
+		}
+
+		job := Job{
+			ID:     work.GetJob().GetId(),
+			Script: work.GetJob().GetScript(),
+			Limits: jobLimits(work.GetJob().GetLimits()),
+		}
+		// confidential scripts are only ever decrypted inside the enclave
+		if sealed := work.GetJob().GetSealedScript(); len(sealed) > 0 {
+			script, resultKey, err := jobKey.OpenJob(sealed)
+			if err != nil {
+				workerLog.Warn("Job rejected", "job", job.ID, "err", err)
+				abortJob(job.ID, &Aborted{Reason: err.Error()})
+				continue
+			}
+			job.Script = script
+			job.ResultKey = resultKey
+		}
+		select {
+		case jobQueue <- job:
+			workerLog.Info("Queued job", "job", job.ID)
+		case <-ctx.Done():
+			abortUnstarted(job)
+		}
+	}
+}
+
+// Waits for the running jobs to finish and their results to be submitted. Queued jobs are reported aborted, so the
+// node hands them out again instead of waiting for their lease to run out.
+func shutdown(wg *sync.WaitGroup) {
+	deadline := time.After(SHUTDOWN_TIMEOUT)
+	if !waitFor(wg, deadline) {
+		workerLog.Warn("Running jobs did not finish in time")
+	}
+	for drained := false; !drained; {
+		select {
+		case job := <-jobQueue:
+			abortUnstarted(job)
+		default:
+			drained = true
+		}
+	}
+	if !waitFor(&pendingSubmissions, deadline) {
+		workerLog.Warn("Results were not submitted in time", "queued", len(submissions))
+	}
+	reportStats()
+}
+
+// Reports a job that never started as aborted by the shutdown
+func abortUnstarted(job Job) {
+	workerLog.Info("Aborting queued job on shutdown", "job", job.ID)
+	if job.ID == "" {
+		return
+	}
+	pendingSubmissions.Add(1)
+	submissions <- submission{job: job.ID, done: true, aborted: &Aborted{Reason: ABORT_SHUTDOWN}}
+}
+
+func waitFor(wg *sync.WaitGroup, deadline <-chan time.Time) bool {
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-deadline:
+		return false
+	}
+}
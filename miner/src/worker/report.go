@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"time"
+
+	"github.com/edgelesssys/ego/attestation"
+	"github.com/edgelesssys/ego/attestation/tcbstatus"
+	"github.com/edgelesssys/ego/enclave"
+)
+
+// Prefix of simulated reports, nodes only accept them with SIMULATE_ATTESTATION=1
+const SIMULATED_REPORT_PREFIX = "poc-simulated-report:"
+
+// UniqueID every simulated report carries, accept it in the node's attestation policy for test networks
+var simulatedUniqueID = sha256.Sum256([]byte("poc simulated enclave"))
+
+func remoteReport(data []byte) ([]byte, error) {
+	start := time.Now()
+	var report []byte
+	var err error
+	if simulation {
+		report, err = simulatedReport(data)
+	} else {
+		report, err = enclave.GetRemoteReport(data)
+	}
+	timeReportGeneration(start, err)
+	return report, err
+}
+
+// A simulated report is the json encoded report prefixed with SIMULATED_REPORT_PREFIX, it proves nothing.
+// ProductID and SecurityVersion match enclave.json.
+func simulatedReport(data []byte) ([]byte, error) {
+	productID := make([]byte, 16)
+	productID[0] = 1
+	report, err := json.Marshal(attestation.Report{
+		Data:            data,
+		SecurityVersion: 1,
+		Debug:           true,
+		UniqueID:        simulatedUniqueID[:],
+		SignerID:        make([]byte, 32),
+		ProductID:       productID,
+		TCBStatus:       tcbstatus.UpToDate,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(SIMULATED_REPORT_PREFIX), report...), nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Commitment to the results of a job this worker finished, encoded like the node's ResultCommitment. It is built
+// inside the enclave from the results in the sealed store and carries our key, so the node can neither forge
+// commitments for jobs we didn't run nor alter the root of the ones we did.
+type ResultCommitment struct {
+	Job     string
+	Worker  string
+	Results int
+	Root    string
+}
+
+const (
+	// Result commitments a block carries at most, like the node
+	MAX_BLOCK_RESULTS = 1000
+	// A commitment is kept until a block this deep in the node's chain carries it, a reorg may drop shallower ones
+	RESULT_CONFIRMATIONS = 6
+)
+
+// Commitments not deep enough in the chain yet, by job. They are part of the sealed state.
+var commitments = make(map[string]ResultCommitment)
+var commitmentsMutex = &sync.Mutex{}
+
+// Leaf of a result in the job's results tree, the node encodes its copy of the result the same way
+func resultLeaf(res StoredResult) []byte {
+	leaf, _ := json.Marshal(struct {
+		Key   string
+		Value json.RawMessage
+	}{res.Key, res.Value})
+	return leaf
+}
+
+// Commits to the results the finished job stored, a job without results has nothing to commit
+func commitResults(job string) error {
+	results, err := resultStore.Query(job)
+	if err != nil || len(results) == 0 {
+		return err
+	}
+	leaves := make([][]byte, len(results))
+	for i, res := range results {
+		leaves[i] = resultLeaf(res)
+	}
+	commitmentsMutex.Lock()
+	commitments[job] = ResultCommitment{Job: job, Worker: hex.EncodeToString(jobKey.public[:]), Results: len(results), Root: merkleRoot(leaves)}
+	commitmentsMutex.Unlock()
+	// a crash must not lose the commitment, the results it covers are stored already
+	persistState()
+	return nil
+}
+
+// Jobs with a commitment waiting for a block, sorted
+func pendingCommitments() []ResultCommitment {
+	commitmentsMutex.Lock()
+	defer commitmentsMutex.Unlock()
+	pending := make([]ResultCommitment, 0, len(commitments))
+	for _, c := range commitments {
+		pending = append(pending, c)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Job < pending[j].Job })
+	return pending
+}
+
+func pendingJobs() []string {
+	pending := pendingCommitments()
+	jobs := make([]string, len(pending))
+	for i, c := range pending {
+		jobs[i] = c.Job
+	}
+	return jobs
+}
+
+// The json encoded commitments for a block on tip, leaving out the ones the node reports committed. Those
+// committed deep enough are dropped.
+func blockCommitments(tip Block, committed map[string]int64) string {
+	results := make([]ResultCommitment, 0)
+	for _, c := range pendingCommitments() {
+		if index, ok := committed[c.Job]; ok {
+			if int64(tip.Index)-index >= RESULT_CONFIRMATIONS {
+				commitmentsMutex.Lock()
+				delete(commitments, c.Job)
+				commitmentsMutex.Unlock()
+			}
+			continue
+		}
+		if len(results) < MAX_BLOCK_RESULTS {
+			results = append(results, c)
+		}
+	}
+	if len(results) == 0 {
+		return ""
+	}
+	encoded, _ := json.Marshal(results)
+	return string(encoded)
+}
+
+// Token the local HTTP endpoints serving results require. Anyone on the host can reach them, only those able to
+// read the data directory can read the token.
+var apiToken string
+
+// Writes a new api token to the data directory, the previous one stops working
+func writeAPIToken() error {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+	apiToken = hex.EncodeToString(token)
+	return os.WriteFile(apiTokenFile(), []byte(apiToken+"\n"), 0600)
+}
+
+func requireAPIToken(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		header := req.Header.Get("Authorization")
+		token := strings.TrimPrefix(header, "Bearer ")
+		if token == header || apiToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(apiToken)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, req)
+	}
+}
+
+// GET /results lists the jobs with retained results, GET /results?job=<id> returns a job's results as they were
+// sent to the node
+func serveResults(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body interface{}
+	if job := req.URL.Query().Get("job"); job != "" {
+		results, err := resultStore.Query(job)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(results) == 0 {
+			http.Error(w, "no results retained for the job", http.StatusNotFound)
+			return
+		}
+		body = results
+	} else {
+		body = resultStore.Jobs()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
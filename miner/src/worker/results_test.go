@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestResultsRequireAPIToken(t *testing.T) {
+	savedDir, savedStore, savedToken := dataDir, resultStore, apiToken
+	t.Cleanup(func() { dataDir, resultStore, apiToken = savedDir, savedStore, savedToken })
+	dataDir = t.TempDir()
+	resultStore = openTestStore(t, resultsDir(), RESULTS_SEGMENT_SIZE, RESULTS_SEGMENTS)
+	appendTestResults(t, resultStore, "j", 0, 2)
+	if err := writeAPIToken(); err != nil {
+		t.Fatal(err)
+	}
+	written, err := os.ReadFile(apiTokenFile())
+	if err != nil || strings.TrimSpace(string(written)) != apiToken {
+		t.Fatalf("the token file holds %q, %v", written, err)
+	}
+	if info, _ := os.Stat(apiTokenFile()); info.Mode().Perm() != 0600 {
+		t.Fatalf("the token file is readable by others: %v", info.Mode())
+	}
+
+	get := func(path string, authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		requireAPIToken(serveResults)(w, req)
+		return w
+	}
+	for _, authorization := range []string{"", apiToken, "Bearer ", "Bearer " + apiToken[1:], "Basic " + apiToken} {
+		if w := get("/results?job=j", authorization); w.Code != http.StatusUnauthorized {
+			t.Fatalf("authorization %q answered %d", authorization, w.Code)
+		}
+	}
+
+	w := get("/results", "Bearer "+apiToken)
+	var jobs []string
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &jobs) != nil || len(jobs) != 1 || jobs[0] != "j" {
+		t.Fatalf("listed jobs %d %s", w.Code, w.Body)
+	}
+	w = get("/results?job=j", "Bearer "+apiToken)
+	var results []StoredResult
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &results) != nil || len(results) != 2 || results[1].Key != "1" {
+		t.Fatalf("queried results %d %s", w.Code, w.Body)
+	}
+	if w := get("/results?job=missing", "Bearer "+apiToken); w.Code != http.StatusNotFound {
+		t.Fatalf("a job without results answered %d", w.Code)
+	}
+}
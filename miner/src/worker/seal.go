@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+
+	"github.com/edgelesssys/ego/ecrypto"
+)
+
+// Encrypts and authenticates data written outside the enclave, so the host can neither read nor modify it unnoticed
+type Sealer interface {
+	Seal(plaintext []byte, additionalData []byte) ([]byte, error)
+	Unseal(ciphertext []byte, additionalData []byte) ([]byte, error)
+}
+
+// Returned when sealed data fails authentication, the data was modified or moved
+var errTampered = errors.New("sealed data has been tampered with")
+
+// Seals with the enclave's product key, so data stays readable after upgrading the worker
+// as long as it is signed with the same key and keeps its product id
+type enclaveSealer struct{}
+
+func (enclaveSealer) Seal(plaintext []byte, additionalData []byte) ([]byte, error) {
+	return ecrypto.SealWithProductKey(plaintext, additionalData)
+}
+
+func (enclaveSealer) Unseal(ciphertext []byte, additionalData []byte) ([]byte, error) {
+	plaintext, err := ecrypto.Unseal(ciphertext, additionalData)
+	if err != nil {
+		return nil, errTampered
+	}
+	return plaintext, nil
+}
+
+// Seals with a fixed key known to everyone, only meant for running the worker without SGX
+type simulatedSealer struct {
+	aead cipher.AEAD
+}
+
+func newSimulatedSealer() *simulatedSealer {
+	key := sha256.Sum256([]byte("poc simulated sealing key"))
+	block, err := aes.NewCipher(key[:])
+	check(err)
+	aead, err := cipher.NewGCM(block)
+	check(err)
+	return &simulatedSealer{aead: aead}
+}
+
+func (s *simulatedSealer) Seal(plaintext []byte, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func (s *simulatedSealer) Unseal(ciphertext []byte, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < s.aead.NonceSize() {
+		return nil, errTampered
+	}
+	nonce, ciphertext := ciphertext[:s.aead.NonceSize()], ciphertext[s.aead.NonceSize():]
+	plaintext, err := s.aead.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, errTampered
+	}
+	return plaintext, nil
+}
+
+func newSealer() Sealer {
+	if simulation {
+		workerLog.Warn("Running in simulation mode, sealed data is NOT confidential")
+		return newSimulatedSealer()
+	}
+	return enclaveSealer{}
+}
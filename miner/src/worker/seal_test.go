@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSimulatedSealer(t *testing.T) {
+	s := newSimulatedSealer()
+	sealed, err := s.Seal([]byte("state"), []byte("path"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("state")) {
+		t.Fatal("the plaintext is readable in the sealed data")
+	}
+	again, _ := s.Seal([]byte("state"), []byte("path"))
+	if bytes.Equal(sealed, again) {
+		t.Fatal("sealing twice gave the same ciphertext")
+	}
+	plaintext, err := s.Unseal(sealed, []byte("path"))
+	if err != nil || string(plaintext) != "state" {
+		t.Fatalf("unsealed %q, %v", plaintext, err)
+	}
+
+	modified := append([]byte(nil), sealed...)
+	modified[len(modified)-1] ^= 1
+	for _, test := range []struct {
+		name           string
+		sealed         []byte
+		additionalData string
+	}{
+		{"modified", modified, "path"},
+		{"moved", sealed, "other path"},
+		{"truncated", sealed[:4], "path"},
+	} {
+		if _, err := s.Unseal(test.sealed, []byte(test.additionalData)); err != errTampered {
+			t.Errorf("unsealed %s data: %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,7 @@
+//go:build simulation
+
+package main
+
+// Built with -tags simulation for running without SGX in EGo's simulation mode. The mode is fixed when the worker
+// is built, the host can't switch an enclave build into it.
+const simulation = true
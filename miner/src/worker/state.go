@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// Internal state of the worker kept across restarts. It is sealed like the results and records
+// the end of the result log, so a log truncated by the host is detected on reload.
+type WorkerState struct {
+	WorkerID      string
+	JobKey        []byte
+	Epoch         uint64
+	Operations    uint64
+	BlocksFound   uint64
+	ResultSegment int
+	ResultOffset  int64
+	// Result commitments waiting for a block
+	Commitments []ResultCommitment
+}
+
+func stateData(path string) []byte {
+	return []byte("worker state:" + path)
+}
+
+// Reads the sealed state, a missing file is a fresh worker
+func loadState(path string) (WorkerState, error) {
+	var state WorkerState
+	sealed, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	plaintext, err := sealer.Unseal(sealed, stateData(path))
+	if err != nil {
+		return state, fmt.Errorf("%s: %w", path, err)
+	}
+	err = json.Unmarshal(plaintext, &state)
+	return state, err
+}
+
+// Writes the sealed state next to the old one and swaps it in, so a crash never leaves a partial state
+func saveState(path string, state WorkerState) error {
+	plaintext, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	sealed, err := sealer.Seal(plaintext, stateData(path))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(sealed); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Restores the worker from its sealed state, fails if the result log ends before the recorded position
+func restoreState(state WorkerState) error {
+	segment, offset := resultStore.End()
+	if segment < state.ResultSegment || (segment == state.ResultSegment && offset < state.ResultOffset) {
+		return fmt.Errorf("result log ends at %s:%d, expected at least %s:%d: %w",
+			segmentName(segment), offset, segmentName(state.ResultSegment), state.ResultOffset, errTampered)
+	}
+
+	workerID = state.WorkerID
+	if workerID == "" {
+		id := make([]byte, 8)
+		_, err := rand.Read(id)
+		check(err)
+		workerID = hex.EncodeToString(id)
+	}
+	key, err := newJobKey(state.JobKey)
+	if err != nil {
+		return err
+	}
+	jobKey = key
+	commitmentsMutex.Lock()
+	for _, c := range state.Commitments {
+		commitments[c.Job] = c
+	}
+	commitmentsMutex.Unlock()
+	work.Restore(state.Epoch, state.Operations)
+	atomic.StoreUint64(&blocksFound, state.BlocksFound)
+	return nil
+}
+
+func currentState() WorkerState {
+	segment, offset := resultStore.End()
+	return WorkerState{
+		WorkerID:      workerID,
+		JobKey:        jobKey.private[:],
+		Epoch:         work.Epoch(),
+		Operations:    work.Total(),
+		BlocksFound:   atomic.LoadUint64(&blocksFound),
+		ResultSegment: segment,
+		ResultOffset:  offset,
+		Commitments:   pendingCommitments(),
+	}
+}
+
+// Saves are serialized, they share the temporary file
+var persistMutex = &sync.Mutex{}
+
+func persistState() {
+	persistMutex.Lock()
+	defer persistMutex.Unlock()
+	if err := saveState(stateFile(), currentState()); err != nil {
+		workerLog.Error("Saving state failed", err)
+	}
+}
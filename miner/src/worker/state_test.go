@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Swaps in the globals a worker restores from its state, with results stored in dir
+func testWorker(t *testing.T, dir string) {
+	t.Helper()
+	savedSealer, savedStore, savedWork, savedKey, savedID := sealer, resultStore, work, jobKey, workerID
+	savedCommitments, savedBlocks := commitments, blocksFound
+	t.Cleanup(func() {
+		sealer, resultStore, work, jobKey, workerID = savedSealer, savedStore, savedWork, savedKey, savedID
+		commitments, blocksFound = savedCommitments, savedBlocks
+	})
+	sealer = newSimulatedSealer()
+	resultStore = openTestStore(t, dir, RESULTS_SEGMENT_SIZE, RESULTS_SEGMENTS)
+	work = NewWorkAccumulator(OPS_PER_BLOCK)
+	commitments = make(map[string]ResultCommitment)
+	jobKey, workerID, blocksFound = nil, "", 0
+}
+
+func TestStateSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "keys", "state.sealed")
+	testWorker(t, filepath.Join(dir, "results"))
+	if state, err := loadState(path); err != nil || !reflect.DeepEqual(state, WorkerState{}) {
+		t.Fatalf("a fresh worker loaded %+v, %v", state, err)
+	}
+	if err := restoreState(WorkerState{}); err != nil {
+		t.Fatal(err)
+	}
+	appendTestResults(t, resultStore, "j", 0, 3)
+	work.Add(42)
+	work.Seal()
+	commitments["j"] = ResultCommitment{Job: "j", Worker: workerID, Results: 3, Root: "root"}
+	blocksFound = 2
+	saved := currentState()
+	if err := saveState(path, saved); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restarted worker keeps its identity, key, epochs and pending commitments
+	resultStore.Close()
+	testWorker(t, filepath.Join(dir, "results"))
+	state, err := loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreState(state); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(currentState(), saved) {
+		t.Fatalf("restored %+v, want %+v", currentState(), saved)
+	}
+	if epoch := work.Seal(); epoch.Number != 2 {
+		t.Fatalf("sealed epoch %d after the restart, want 2", epoch.Number)
+	}
+}
+
+func TestStateRejectsTampering(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.sealed")
+	testWorker(t, filepath.Join(dir, "results"))
+	if err := restoreState(WorkerState{}); err != nil {
+		t.Fatal(err)
+	}
+	appendTestResults(t, resultStore, "j", 0, 3)
+	if err := saveState(path, currentState()); err != nil {
+		t.Fatal(err)
+	}
+
+	moved := filepath.Join(dir, "moved.sealed")
+	sealed, _ := os.ReadFile(path)
+	os.WriteFile(moved, sealed, 0600)
+	if _, err := loadState(moved); !errors.Is(err, errTampered) {
+		t.Fatalf("loaded a state moved to another file: %v", err)
+	}
+
+	// the host rolled the result log back to before the state was saved
+	state, err := loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resultStore.Close()
+	os.RemoveAll(filepath.Join(dir, "results"))
+	testWorker(t, filepath.Join(dir, "results"))
+	if err := restoreState(state); !errors.Is(err, errTampered) {
+		t.Fatalf("restored a state ahead of its result log: %v", err)
+	}
+}
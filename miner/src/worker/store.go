@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	RESULTS_SEGMENT_SIZE = 16 << 20
+	RESULTS_SEGMENTS     = 8
+)
+
+// Append-only log of job results in size-rotated segment files. Every result is sealed
+// and stored base64 encoded on its own line, bound to its segment and offset.
+type ResultStore struct {
+	dir      string
+	sealer   Sealer
+	maxSize  int64
+	segments int
+	mutex    sync.Mutex
+	file     *os.File
+	size     int64
+	current  int
+	index    map[string][]location
+}
+
+type StoredResult struct {
+	Job   string
+	Key   string
+	Value json.RawMessage
+	Time  int64
+}
+
+// Position of a single result in the log
+type location struct {
+	segment int
+	offset  int64
+	length  int
+}
+
+var errStoreClosed = errors.New("result store closed")
+
+func segmentName(n int) string {
+	return fmt.Sprintf("results-%06d.log", n)
+}
+
+// Binds a sealed result to its place in the log, so results can't be reordered or moved between segments
+func recordData(segment int, offset int64) []byte {
+	return []byte(fmt.Sprintf("%s:%d", segmentName(segment), offset))
+}
+
+func (s *ResultStore) sealRecord(segment int, offset int64, plaintext []byte) ([]byte, error) {
+	sealed, err := s.sealer.Seal(plaintext, recordData(segment, offset))
+	if err != nil {
+		return nil, err
+	}
+	line := make([]byte, base64.StdEncoding.EncodedLen(len(sealed))+1)
+	base64.StdEncoding.Encode(line, sealed)
+	line[len(line)-1] = '\n'
+	return line, nil
+}
+
+func (s *ResultStore) openRecord(segment int, offset int64, line []byte) (StoredResult, error) {
+	var res StoredResult
+	sealed, err := base64.StdEncoding.DecodeString(string(bytes.TrimSuffix(line, []byte{'\n'})))
+	if err != nil {
+		return res, fmt.Errorf("%s at offset %d: %w", segmentName(segment), offset, errTampered)
+	}
+	plaintext, err := s.sealer.Unseal(sealed, recordData(segment, offset))
+	if err != nil {
+		return res, fmt.Errorf("%s at offset %d: %w", segmentName(segment), offset, err)
+	}
+	err = json.Unmarshal(plaintext, &res)
+	return res, err
+}
+
+// Opens the store in dir and rebuilds the index from the existing segments.
+// A partially written result at the end of the log, left by a crash, is cut off,
+// any complete result that fails to unseal makes opening the store fail.
+func OpenResultStore(dir string, sealer Sealer, maxSize int64, segments int) (*ResultStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &ResultStore{dir: dir, sealer: sealer, maxSize: maxSize, segments: segments, index: make(map[string][]location)}
+
+	existing, err := s.listSegments()
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range existing {
+		end, err := s.indexSegment(n)
+		if err != nil {
+			return nil, err
+		}
+		s.current = n
+		s.size = end
+	}
+	if len(existing) == 0 {
+		s.current = 1
+	}
+
+	s.file, err = os.OpenFile(filepath.Join(dir, segmentName(s.current)), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.file.Truncate(s.size); err != nil {
+		return nil, err
+	}
+	if _, err := s.file.Seek(s.size, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *ResultStore) listSegments() ([]int, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]int, 0)
+	for _, entry := range entries {
+		var n int
+		if _, err := fmt.Sscanf(entry.Name(), "results-%06d.log", &n); err == nil {
+			segments = append(segments, n)
+		}
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
+
+// Adds every complete result of a segment to the index, returns the offset after the last one
+func (s *ResultStore) indexSegment(n int) (int64, error) {
+	f, err := os.Open(filepath.Join(s.dir, segmentName(n)))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	offset := int64(0)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			// io.EOF, anything without a trailing newline is an incomplete write
+			return offset, nil
+		}
+		res, err := s.openRecord(n, offset, line)
+		if err != nil {
+			return 0, err
+		}
+		s.index[res.Job] = append(s.index[res.Job], location{segment: n, offset: offset, length: len(line)})
+		offset += int64(len(line))
+	}
+}
+
+// Stores a result as it is sent to the node, the json encoded value or for confidential jobs its sealed box
+func (s *ResultStore) Append(job string, key string, value json.RawMessage) error {
+	plaintext, err := json.Marshal(StoredResult{Job: job, Key: key, Value: value, Time: time.Now().Unix()})
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file == nil {
+		return errStoreClosed
+	}
+	line, err := s.sealRecord(s.current, s.size, plaintext)
+	if err != nil {
+		return err
+	}
+	if s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+		// the result is bound to its offset, seal it again for the new segment
+		if line, err = s.sealRecord(s.current, s.size, plaintext); err != nil {
+			return err
+		}
+	}
+	if _, err := s.file.Write(line); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.index[job] = append(s.index[job], location{segment: s.current, offset: s.size, length: len(line)})
+	s.size += int64(len(line))
+	return nil
+}
+
+// Position right after the last stored result
+func (s *ResultStore) End() (int, int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.current, s.size
+}
+
+// Starts a new segment and removes the oldest ones beyond the retention limit
+func (s *ResultStore) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.current++
+	s.size = 0
+	file, err := os.OpenFile(filepath.Join(s.dir, segmentName(s.current)), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0600)
+	if err != nil {
+		s.file = nil
+		return err
+	}
+	s.file = file
+
+	oldest := s.current - s.segments
+	segments, err := s.listSegments()
+	if err != nil {
+		return err
+	}
+	for _, n := range segments {
+		if n > oldest {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.dir, segmentName(n))); err != nil {
+			return err
+		}
+	}
+	for job, locations := range s.index {
+		kept := locations[:0]
+		for _, l := range locations {
+			if l.segment > oldest {
+				kept = append(kept, l)
+			}
+		}
+		if len(kept) == 0 {
+			delete(s.index, job)
+		} else {
+			s.index[job] = kept
+		}
+	}
+	return nil
+}
+
+// Returns all retained results of a job in the order they were stored
+func (s *ResultStore) Query(job string) ([]StoredResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	results := make([]StoredResult, 0, len(s.index[job]))
+	files := make(map[int]*os.File)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range s.index[job] {
+		f, ok := files[l.segment]
+		if !ok {
+			var err error
+			f, err = os.Open(filepath.Join(s.dir, segmentName(l.segment)))
+			if err != nil {
+				return nil, err
+			}
+			files[l.segment] = f
+		}
+		line := make([]byte, l.length)
+		if _, err := f.ReadAt(line, l.offset); err != nil {
+			return nil, err
+		}
+		res, err := s.openRecord(l.segment, l.offset, line)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// Returns the ids of all jobs with retained results
+func (s *ResultStore) Jobs() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	jobs := make([]string, 0, len(s.index))
+	for job := range s.index {
+		jobs = append(jobs, job)
+	}
+	sort.Strings(jobs)
+	return jobs
+}
+
+func (s *ResultStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openTestStore(t *testing.T, dir string, maxSize int64, segments int) *ResultStore {
+	t.Helper()
+	s, err := OpenResultStore(dir, newSimulatedSealer(), maxSize, segments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func appendTestResults(t *testing.T, s *ResultStore, job string, from int, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		if err := s.Append(job, fmt.Sprint(i), json.RawMessage(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Checks the job's retained results are the given range, in order
+func checkResults(t *testing.T, s *ResultStore, job string, from int, to int) {
+	t.Helper()
+	results, err := s.Query(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != to-from {
+		t.Fatalf("%d results of %s retained, want %d", len(results), job, to-from)
+	}
+	for i, res := range results {
+		if res.Job != job || res.Key != fmt.Sprint(from+i) || string(res.Value) != fmt.Sprint(from+i) {
+			t.Fatalf("result %d is %s %s = %s, want %d", i, res.Job, res.Key, res.Value, from+i)
+		}
+	}
+}
+
+func TestResultStoreQuery(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStore(t, dir, RESULTS_SEGMENT_SIZE, RESULTS_SEGMENTS)
+	appendTestResults(t, s, "b", 0, 3)
+	appendTestResults(t, s, "a", 0, 2)
+	appendTestResults(t, s, "b", 3, 5)
+	checkResults(t, s, "a", 0, 2)
+	checkResults(t, s, "b", 0, 5)
+	checkResults(t, s, "missing", 0, 0)
+	if jobs := s.Jobs(); len(jobs) != 2 || jobs[0] != "a" || jobs[1] != "b" {
+		t.Fatalf("jobs %v, want [a b]", jobs)
+	}
+
+	// the index is rebuilt from the log
+	s.Close()
+	s = openTestStore(t, dir, RESULTS_SEGMENT_SIZE, RESULTS_SEGMENTS)
+	checkResults(t, s, "b", 0, 5)
+	appendTestResults(t, s, "a", 2, 3)
+	checkResults(t, s, "a", 0, 3)
+}
+
+func TestResultStoreRotation(t *testing.T) {
+	dir := t.TempDir()
+	// a few results per segment, two segments retained
+	s := openTestStore(t, dir, 600, 2)
+	appendTestResults(t, s, "old", 0, 5)
+	appendTestResults(t, s, "new", 0, 20)
+
+	segments, err := s.listSegments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 2 {
+		t.Fatalf("%d segments on disk, want 2", len(segments))
+	}
+	for _, n := range segments {
+		info, err := os.Stat(filepath.Join(dir, segmentName(n)))
+		if err != nil || info.Size() > 600 {
+			t.Fatalf("segment %d is larger than the limit: %v", n, err)
+		}
+	}
+	if jobs := s.Jobs(); len(jobs) != 1 || jobs[0] != "new" {
+		t.Fatalf("jobs %v, want only the one still in the retained segments", jobs)
+	}
+	results, err := s.Query("new")
+	if err != nil || len(results) == 0 || len(results) == 20 {
+		t.Fatalf("%d results retained, want the newest but not all: %v", len(results), err)
+	}
+	first := 20 - len(results)
+	checkResults(t, s, "new", first, 20)
+
+	s.Close()
+	s = openTestStore(t, dir, 600, 2)
+	checkResults(t, s, "new", first, 20)
+	checkResults(t, s, "old", 0, 0)
+}
+
+func TestResultStoreRejectsTampering(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(log []byte) []byte
+	}{
+		{"modified", func(log []byte) []byte {
+			log[10] ^= 1
+			return log
+		}},
+		{"reordered", func(log []byte) []byte {
+			lines := bytes.SplitAfter(log, []byte{'\n'})
+			lines[0], lines[1] = lines[1], lines[0]
+			return bytes.Join(lines, nil)
+		}},
+		{"removed", func(log []byte) []byte {
+			return log[bytes.IndexByte(log, '\n')+1:]
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := openTestStore(t, dir, RESULTS_SEGMENT_SIZE, RESULTS_SEGMENTS)
+			// results of equal length, reordered ones sit exactly at the offsets of others
+			appendTestResults(t, s, "j", 0, 3)
+			s.Close()
+
+			file := filepath.Join(dir, segmentName(1))
+			log, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(file, test.modify(log), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := OpenResultStore(dir, newSimulatedSealer(), RESULTS_SEGMENT_SIZE, RESULTS_SEGMENTS); !errors.Is(err, errTampered) {
+				t.Fatalf("opened a %s log: %v", test.name, err)
+			}
+		})
+	}
+}
+
+func TestResultStoreCutsIncompleteWrite(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStore(t, dir, RESULTS_SEGMENT_SIZE, RESULTS_SEGMENTS)
+	appendTestResults(t, s, "j", 0, 2)
+	segment, end := s.End()
+	s.Close()
+
+	// a crash in the middle of writing the third result
+	f, err := os.OpenFile(filepath.Join(dir, segmentName(segment)), os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("aGFsZiB3cml0dGVu"))
+	f.Close()
+
+	s = openTestStore(t, dir, RESULTS_SEGMENT_SIZE, RESULTS_SEGMENTS)
+	if _, size := s.End(); size != end {
+		t.Fatalf("log ends at %d, want the incomplete write cut off at %d", size, end)
+	}
+	appendTestResults(t, s, "j", 2, 3)
+	checkResults(t, s, "j", 0, 3)
+}
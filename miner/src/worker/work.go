@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sync/atomic"
+)
+
+// Size of the report data embedded in an SGX attestation
+const REPORT_DATA_SIZE = 64
+
+// Accumulates the operations of all evaluators towards the next block attempt.
+// Evaluators only ever add atomically, so sealing an epoch never blocks them.
+type WorkAccumulator struct {
+	count     uint64
+	epoch     uint64
+	total     uint64
+	threshold uint64
+	ready     chan bool
+}
+
+// The work sealed into a single block attempt
+type Epoch struct {
+	Number     uint64
+	Operations uint64
+}
+
+func NewWorkAccumulator(threshold uint64) *WorkAccumulator {
+	return &WorkAccumulator{threshold: threshold, ready: make(chan bool, 1)}
+}
+
+// Adds operations to the current epoch, signals Ready once the epoch reaches the threshold
+func (w *WorkAccumulator) Add(n uint64) {
+	atomic.AddUint64(&w.total, n)
+	count := atomic.AddUint64(&w.count, n)
+	if count >= w.threshold && count-n < w.threshold {
+		select {
+		case w.ready <- true:
+		default:
+		}
+	}
+}
+
+func (w *WorkAccumulator) Ready() <-chan bool {
+	return w.ready
+}
+
+// Takes the operations of the current epoch and starts the next one,
+// operations added while the block attempt runs count towards the next epoch
+func (w *WorkAccumulator) Seal() Epoch {
+	operations := atomic.SwapUint64(&w.count, 0)
+	number := atomic.AddUint64(&w.epoch, 1)
+	return Epoch{Number: number, Operations: operations}
+}
+
+// Operations executed by this worker, including those restored from its sealed state
+func (w *WorkAccumulator) Total() uint64 {
+	return atomic.LoadUint64(&w.total)
+}
+
+// Number of the last sealed epoch
+func (w *WorkAccumulator) Epoch() uint64 {
+	return atomic.LoadUint64(&w.epoch)
+}
+
+// Continues counting from a previous run, so epoch numbers never repeat across restarts
+func (w *WorkAccumulator) Restore(epoch uint64, total uint64) {
+	atomic.StoreUint64(&w.epoch, epoch)
+	atomic.StoreUint64(&w.total, total)
+}
+
+// Report data binding an attestation to the block and the sealed work: the first 32 characters of the
+// previous hash, followed by the operations, the epoch number and the first 16 bytes of the SHA256 of the TxRoot
+// and the ResultRoot
+func attestationData(block Block) []byte {
+	data := make([]byte, REPORT_DATA_SIZE)
+	copy(data[:32], block.PrevHash)
+	binary.BigEndian.PutUint64(data[32:40], block.Operations)
+	binary.BigEndian.PutUint64(data[40:48], block.Epoch)
+	digest := sha256.Sum256([]byte(block.TxRoot + block.ResultRoot))
+	copy(data[48:64], digest[:16])
+	return data
+}
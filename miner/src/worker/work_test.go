@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func ready(w *WorkAccumulator) bool {
+	select {
+	case <-w.Ready():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestWorkAccumulatorEpochs(t *testing.T) {
+	w := NewWorkAccumulator(1000)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				w.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	// crossing the threshold signals once, adding past it doesn't signal again
+	if !ready(w) {
+		t.Fatal("the threshold was reached without a signal")
+	}
+	w.Add(500)
+	if ready(w) {
+		t.Fatal("signalled again past the threshold")
+	}
+
+	if epoch := w.Seal(); epoch != (Epoch{Number: 1, Operations: 1500}) {
+		t.Fatalf("sealed %+v, want epoch 1 with 1500 operations", epoch)
+	}
+	w.Add(10)
+	if ready(w) {
+		t.Fatal("signalled below the threshold")
+	}
+	if epoch := w.Seal(); epoch != (Epoch{Number: 2, Operations: 10}) {
+		t.Fatalf("sealed %+v, want epoch 2 with the operations added after epoch 1", epoch)
+	}
+	if w.Total() != 1510 || w.Epoch() != 2 {
+		t.Fatalf("total %d at epoch %d, want 1510 at 2", w.Total(), w.Epoch())
+	}
+
+	// a restarted worker continues the numbers of its sealed state
+	restarted := NewWorkAccumulator(1000)
+	restarted.Restore(w.Epoch(), w.Total())
+	restarted.Add(1000)
+	if !ready(restarted) {
+		t.Fatal("the restored accumulator didn't signal")
+	}
+	if epoch := restarted.Seal(); epoch != (Epoch{Number: 3, Operations: 1000}) || restarted.Total() != 2510 {
+		t.Fatalf("sealed %+v with total %d after restoring, want epoch 3 and total 2510", epoch, restarted.Total())
+	}
+}
+
+func TestAttestationData(t *testing.T) {
+	block := Block{PrevHash: strings.Repeat("0ab1", 16), Operations: 7, Epoch: 3, TxRoot: "tx", ResultRoot: "results"}
+	data := attestationData(block)
+	if len(data) != REPORT_DATA_SIZE || string(data[:32]) != block.PrevHash[:32] ||
+		binary.BigEndian.Uint64(data[32:40]) != 7 || binary.BigEndian.Uint64(data[40:48]) != 3 {
+		t.Fatalf("report data %x doesn't hold the block's previous hash, operations and epoch", data)
+	}
+	for _, other := range []Block{
+		{PrevHash: block.PrevHash, Operations: 7, Epoch: 3, TxRoot: "other", ResultRoot: "results"},
+		{PrevHash: block.PrevHash, Operations: 7, Epoch: 3, TxRoot: "tx", ResultRoot: "other"},
+	} {
+		if string(attestationData(other)[48:]) == string(data[48:]) {
+			t.Fatalf("the report data doesn't bind the roots %q and %q", other.TxRoot, other.ResultRoot)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Binary chain format used by export and import: the magic and a uvarint version, followed by one record per block.
+// A record is its uvarint length and the block: Index (varint), Nonce (uint32, big endian), Operations and Epoch
+// (uvarint), then Hash, PrevHash, Txs, Proof, TxRoot, Results and ResultRoot, each prefixed with its uvarint length.
+// Only the current version is read: blocks of earlier exports lack the roots and the attested work every block
+// needs now, they can't be valid.
+const (
+	CHAIN_MAGIC   = "POCCHAIN"
+	CHAIN_VERSION = 3
+	// Upper bound for a single record, protects against corrupt length prefixes
+	MAX_RECORD_SIZE = 64 << 20
+)
+
+var errChainFormat = errors.New("not a chain export")
+var errCorruptRecord = errors.New("corrupt block record")
+
+type ChainWriter struct {
+	w *bufio.Writer
+}
+
+type ChainReader struct {
+	r *bufio.Reader
+}
+
+// Writes the header, blocks are written one by one with Write
+func NewChainWriter(w io.Writer) (*ChainWriter, error) {
+	cw := &ChainWriter{w: bufio.NewWriter(w)}
+	header := binary.AppendUvarint([]byte(CHAIN_MAGIC), CHAIN_VERSION)
+	if _, err := cw.w.Write(header); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+func (cw *ChainWriter) Write(block Block) error {
+	record := encodeBlock(block)
+	if _, err := cw.w.Write(binary.AppendUvarint(nil, uint64(len(record)))); err != nil {
+		return err
+	}
+	_, err := cw.w.Write(record)
+	return err
+}
+
+func (cw *ChainWriter) Flush() error {
+	return cw.w.Flush()
+}
+
+// Reads and checks the header, blocks are read one by one with Read
+func NewChainReader(r io.Reader) (*ChainReader, error) {
+	cr := &ChainReader{r: bufio.NewReader(r)}
+	magic := make([]byte, len(CHAIN_MAGIC))
+	if _, err := io.ReadFull(cr.r, magic); err != nil || string(magic) != CHAIN_MAGIC {
+		return nil, errChainFormat
+	}
+	version, err := binary.ReadUvarint(cr.r)
+	if err != nil {
+		return nil, errChainFormat
+	}
+	if version != CHAIN_VERSION {
+		return nil, fmt.Errorf("unsupported chain export version %d, only version %d is read", version, CHAIN_VERSION)
+	}
+	return cr, nil
+}
+
+// Returns the next block, io.EOF after the last one
+func (cr *ChainReader) Read() (Block, error) {
+	length, err := binary.ReadUvarint(cr.r)
+	if err == io.EOF {
+		return Block{}, io.EOF
+	}
+	if err != nil || length > MAX_RECORD_SIZE {
+		return Block{}, errCorruptRecord
+	}
+	record := make([]byte, length)
+	if _, err := io.ReadFull(cr.r, record); err != nil {
+		return Block{}, errCorruptRecord
+	}
+	return decodeBlock(record)
+}
+
+func encodeBlock(block Block) []byte {
+	record := binary.AppendVarint(nil, int64(block.Index))
+	record = binary.BigEndian.AppendUint32(record, block.Nonce)
+	record = binary.AppendUvarint(record, block.Operations)
+	record = binary.AppendUvarint(record, block.Epoch)
+	for _, field := range [][]byte{[]byte(block.Hash), []byte(block.PrevHash), []byte(block.Txs), block.Proof, []byte(block.TxRoot), []byte(block.Results), []byte(block.ResultRoot)} {
+		record = binary.AppendUvarint(record, uint64(len(field)))
+		record = append(record, field...)
+	}
+	return record
+}
+
+func decodeBlock(record []byte) (Block, error) {
+	var block Block
+	index, n := binary.Varint(record)
+	if n <= 0 || len(record[n:]) < 4 {
+		return block, errCorruptRecord
+	}
+	block.Index = int(index)
+	record = record[n:]
+	block.Nonce = binary.BigEndian.Uint32(record)
+	record = record[4:]
+	for _, field := range []*uint64{&block.Operations, &block.Epoch} {
+		value, n := binary.Uvarint(record)
+		if n <= 0 {
+			return block, errCorruptRecord
+		}
+		*field = value
+		record = record[n:]
+	}
+
+	fields := make([][]byte, 7)
+	for i := range fields {
+		length, n := binary.Uvarint(record)
+		if n <= 0 || uint64(len(record[n:])) < length {
+			return block, errCorruptRecord
+		}
+		fields[i] = record[n : n+int(length)]
+		record = record[n+int(length):]
+	}
+	if len(record) != 0 {
+		return block, errCorruptRecord
+	}
+	block.Hash = string(fields[0])
+	block.PrevHash = string(fields[1])
+	block.Txs = string(fields[2])
+	block.Proof = append([]byte(""), fields[3]...)
+	block.TxRoot = string(fields[4])
+	block.Results = string(fields[5])
+	block.ResultRoot = string(fields[6])
+	return block, nil
+}
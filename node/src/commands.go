@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Subcommands run instead of the node, `node <command> -h` lists their flags
+var commands = map[string]func(args []string) int{
+	"config": runConfig,
+	"verify": runVerify,
+	"export": runExport,
+	"import": runImport,
+	"light":  runLight,
+	"wallet": runWallet,
+}
+
+// node export [-chain file] [-out file]
+// Streams the chain file into the binary chain format, one block at a time.
+func runExport(args []string) int {
+	if _, err := commandConfig(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	path := flags.String("chain", chainFile(), "chain file to export")
+	out := flags.String("out", "-", "export file, - for stdout")
+	flags.Parse(args)
+
+	in, err := os.Open(*path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer in.Close()
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+
+	count, err := exportChain(in, w)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "exported %d blocks\n", count)
+	return 0
+}
+
+// Decodes the json chain element by element so the chain is never held in memory
+func exportChain(in io.Reader, out io.Writer) (int, error) {
+	jr, err := newJSONChainReader(in)
+	if err != nil {
+		return 0, err
+	}
+	cw, err := NewChainWriter(out)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for {
+		block, err := jr.Read()
+		if err == io.EOF {
+			return count, cw.Flush()
+		}
+		if err != nil {
+			return count, err
+		}
+		if err := cw.Write(block); err != nil {
+			return count, err
+		}
+		count++
+	}
+}
+
+// node import [-chain file] [-in file] [-genesis file] [-force]
+// Streams a binary chain export into a chain file. Blocks must link up from the genesis block, attestations
+// are not checked, run verify on the imported chain for that.
+func runImport(args []string) int {
+	cfg, err := commandConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	path := flags.String("chain", chainFile(), "chain file to write")
+	in := flags.String("in", "-", "export file, - for stdin")
+	flags.StringVar(&cfg.GenesisFile, "genesis", cfg.GenesisFile, "genesis file of the chain's network")
+	force := flags.Bool("force", false, "replace an existing chain file")
+	flags.Parse(args)
+
+	if err := configureNetwork(cfg.GenesisFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	// a running node would overwrite the imported chain
+	if *path == chainFile() {
+		if err := lockDataDir(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	if _, err := os.Stat(*path); err == nil && !*force {
+		fmt.Fprintln(os.Stderr, *path, "already exists, use -force to replace it")
+		return 1
+	}
+
+	var r io.Reader = os.Stdin
+	if *in != "-" {
+		f, err := os.Open(*in)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		r = f
+	}
+
+	if err := os.MkdirAll(filepath.Dir(*path), os.ModePerm); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	// written next to the chain file and swapped in once complete
+	tmp := *path + ".import"
+	out, err := os.Create(tmp)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	count, err := importChain(r, out)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, *path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		fmt.Fprintf(os.Stderr, "import failed after %d blocks: %v\n", count, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "imported %d blocks into %s\n", count, *path)
+	return 0
+}
+
+// Writes the blocks in the same layout as writeBlockchain, checking each one links to the one before
+func importChain(in io.Reader, out io.Writer) (int, error) {
+	cr, err := NewChainReader(in)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := io.WriteString(out, "["); err != nil {
+		return 0, err
+	}
+	var prev Block
+	count := 0
+	for {
+		block, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+		if err := checkLink(block, prev, count); err != nil {
+			return count, fmt.Errorf("block %d: %w", count, err)
+		}
+
+		encoded, err := json.MarshalIndent(block, "  ", "  ")
+		if err != nil {
+			return count, err
+		}
+		separator := "\n  "
+		if count > 0 {
+			separator = ",\n  "
+		}
+		if _, err := io.WriteString(out, separator); err != nil {
+			return count, err
+		}
+		if _, err := out.Write(encoded); err != nil {
+			return count, err
+		}
+		prev = block
+		count++
+	}
+	if count == 0 {
+		return 0, errEmptyChain
+	}
+	_, err = io.WriteString(out, "\n]")
+	return count, err
+}
+
+// Checks the structure of the chain only: genesis, indices, hash linkage and block hashes
+func checkLink(block Block, prev Block, position int) error {
+	if position == 0 {
+		if block.Index != genesisBlock.Index || block.Hash != genesisBlock.Hash {
+			return errGenesis
+		}
+		return nil
+	}
+	if block.Index != prev.Index+1 {
+		return errBlockIndex
+	}
+	if block.PrevHash != prev.Hash {
+		return errPrevHash
+	}
+	if calculateHash(block) != block.Hash {
+		return errBlockHash
+	}
+	return nil
+}
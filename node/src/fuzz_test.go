@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Runs the node on the simulated network with its data directory in a temporary directory. The chain is reset
+// to the returned chain, which extends the genesis block by a few simulated blocks, before every input.
+func fuzzNode(f *testing.F) Blockchain {
+	configureSimulatedNetwork(f)
+	savedChain, savedDir := blockchain, dataDir
+	f.Cleanup(func() {
+		blockchain, dataDir = savedChain, savedDir
+	})
+	dataDir = f.TempDir()
+	if err := os.MkdirAll(filepath.Dir(chainFile()), 0700); err != nil {
+		f.Fatal(err)
+	}
+	chain := Blockchain{genesisBlock}
+	for len(chain) < 4 {
+		block, err := simulatedBlock(chain[len(chain)-1], "", "", difficulty, 0)
+		if err != nil {
+			f.Fatal(err)
+		}
+		chain = append(chain, block)
+	}
+	return chain
+}
+
+func resetChain(chain Blockchain) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	blockchain = append(Blockchain(nil), chain...)
+}
+
+// Fails unless the node's chain still starts at the genesis block and every block is valid
+func assertValidChain(t *testing.T) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(blockchain) == 0 || !sameBlock(blockchain[0], genesisBlock) {
+		t.Fatal("the node's chain no longer starts at the genesis block")
+	}
+	if i, err := verifyChain(blockchain); err != nil {
+		t.Fatalf("the node's chain holds an invalid block %d: %v", i, err)
+	}
+}
+
+func mustJSON(f *testing.F, v interface{}) []byte {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		f.Fatal(err)
+	}
+	return encoded
+}
+
+// A simulated report from the accepted enclave carrying data
+func mustReport(f *testing.F, data []byte) []byte {
+	report, err := simulatedReport(data)
+	if err != nil {
+		f.Fatal(err)
+	}
+	return report
+}
+
+// Chains sent by peers, one json array per line
+func FuzzReadData(f *testing.F) {
+	chain := fuzzNode(f)
+	longer, err := simulatedBlock(chain[len(chain)-1], "", "", difficulty, 0)
+	if err != nil {
+		f.Fatal(err)
+	}
+	valid := mustJSON(f, append(chain[:len(chain):len(chain)], longer))
+	f.Add(append(valid, '\n'))
+	f.Add(append(mustJSON(f, chain), '\n'))
+	// a block of the shared prefix with the same hash but another report, the prefix was compared by hash only before
+	forged := append(Blockchain(nil), chain...)
+	forged[1].Proof = []byte(SIMULATED_REPORT_PREFIX + "{}")
+	f.Add(append(mustJSON(f, append(forged, longer)), '\n'))
+	f.Add(valid[:len(valid)/2])
+	f.Add([]byte("[]\n"))
+	f.Add([]byte("null\n[{}]\n\n"))
+	f.Add([]byte(`[{"Index":0,"Hash":""},{"Index":1,"Proof":"cG9jLXNpbXVsYXRlZC1yZXBvcnQ6e30="}]` + "\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		resetChain(chain)
+		readData(bufio.NewReadWriter(bufio.NewReader(bytes.NewReader(data)), bufio.NewWriter(io.Discard)))
+		assertValidChain(t)
+	})
+}
+
+// The first line a peer sends on a stream
+func FuzzReadHello(f *testing.F) {
+	fuzzNode(f)
+	f.Add(append(mustJSON(f, Hello{ChainID: genesis.ChainID, Genesis: genesisBlock.Hash}), '\n'))
+	f.Add([]byte("{}\n"))
+	f.Add([]byte(`{"ChainID":1}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		err := readHello(bufio.NewReadWriter(bufio.NewReader(bytes.NewReader(data)), bufio.NewWriter(io.Discard)))
+		if err != nil {
+			return
+		}
+		var hello Hello
+		line, _, _ := bytes.Cut(data, []byte("\n"))
+		if json.Unmarshal(line, &hello) != nil || hello.ChainID != genesis.ChainID || hello.Genesis != genesisBlock.Hash {
+			t.Fatalf("accepted a hello from another network: %q", line)
+		}
+	})
+}
+
+// Chain exports read by the import command
+func FuzzChainReader(f *testing.F) {
+	chain := fuzzNode(f)
+	var export bytes.Buffer
+	cw, err := NewChainWriter(&export)
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, block := range chain {
+		if err := cw.Write(block); err != nil {
+			f.Fatal(err)
+		}
+	}
+	if err := cw.Flush(); err != nil {
+		f.Fatal(err)
+	}
+	f.Add(export.Bytes())
+	f.Add(export.Bytes()[:export.Len()-7])
+	f.Add([]byte(CHAIN_MAGIC))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		cr, err := NewChainReader(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		for {
+			block, err := cr.Read()
+			if err != nil {
+				return
+			}
+			decoded, err := decodeBlock(encodeBlock(block))
+			if err != nil || !sameBlock(decoded, block) {
+				t.Fatalf("block %d does not survive a round trip: %v", block.Index, err)
+			}
+		}
+	})
+}
+
+func FuzzCalculateHash(f *testing.F) {
+	f.Add(0, uint32(0), "", "", "", []byte(nil))
+	f.Add(-1, uint32(4294967295), strings.Repeat("0", 64), "[]", strings.Repeat("0", 64), []byte(SIMULATED_REPORT_PREFIX+"{}"))
+
+	f.Fuzz(func(t *testing.T, index int, nonce uint32, prevHash string, txs string, txRoot string, proof []byte) {
+		block := Block{Index: index, Nonce: nonce, PrevHash: prevHash, Txs: txs, TxRoot: txRoot, Proof: proof}
+		hash := calculateHash(block)
+		if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != 32 {
+			t.Fatalf("hash %q is not a hex encoded sha256", hash)
+		}
+		if calculateHash(block) != hash {
+			t.Fatal("hash is not deterministic")
+		}
+		// transactions are covered through their root, checkBlock matches the root against them
+		block.TxRoot += "x"
+		if calculateHash(block) == hash {
+			t.Fatal("hash does not cover the transaction root")
+		}
+		hash = calculateHash(block)
+		block.ResultRoot += "x"
+		if calculateHash(block) == hash {
+			t.Fatal("hash does not cover the result root")
+		}
+	})
+}
+
+func FuzzIsBlockValid(f *testing.F) {
+	chain := fuzzNode(f)
+	tip := chain[len(chain)-1]
+	next, err := simulatedBlock(tip, "", "", difficulty, 0)
+	if err != nil {
+		f.Fatal(err)
+	}
+	short := next
+	short.Proof = mustReport(f, []byte("0"))
+	short = sealBlock(short)
+	f.Add(next.Index, next.Nonce, next.Hash, next.PrevHash, next.Txs, next.TxRoot, next.Operations, next.Epoch, next.Proof)
+	f.Add(short.Index, short.Nonce, short.Hash, short.PrevHash, short.Txs, short.TxRoot, short.Operations, short.Epoch, short.Proof)
+	f.Add(next.Index, next.Nonce, next.Hash, next.PrevHash, `[{"From":"","To":"","Amount":1,"Sig":""}]`, next.TxRoot, next.Operations, next.Epoch, next.Proof)
+	f.Add(next.Index, next.Nonce, next.Hash, next.PrevHash, next.Txs, next.TxRoot, next.Operations*2, next.Epoch, next.Proof)
+	f.Add(0, uint32(0), "", "", "", "", uint64(0), uint64(0), []byte(nil))
+
+	f.Fuzz(func(t *testing.T, index int, nonce uint32, hash string, prevHash string, txs string, txRoot string, operations uint64, epoch uint64, proof []byte) {
+		block := Block{Index: index, Nonce: nonce, Hash: hash, PrevHash: prevHash, Txs: txs, TxRoot: txRoot, Operations: operations, Epoch: epoch, Proof: proof}
+		if !isBlockValid(block, chain) {
+			return
+		}
+		if block.Index != tip.Index+1 || block.PrevHash != tip.Hash || block.Hash != calculateHash(block) || !validateHash(block.Hash) {
+			t.Fatalf("accepted a block that doesn't extend the chain: %+v", block)
+		}
+		if block.TxRoot != merkleRoot(txLeaves(blockTxs(block))) {
+			t.Fatalf("accepted a block whose transactions don't match its root: %+v", block)
+		}
+		if block.Operations < MIN_BLOCK_OPERATIONS || block.Epoch == 0 {
+			t.Fatalf("accepted a block without enough work: %+v", block)
+		}
+	})
+}
+
+// Reports from the simulated verifier against the parent's hash, the sealed work and the block's transaction root
+func FuzzCheckAttestation(f *testing.F) {
+	fuzzNode(f)
+	report := func(data []byte) []byte { return mustReport(f, data) }
+	ops := uint64(MIN_BLOCK_OPERATIONS)
+	data := simulatedReportData(Block{PrevHash: genesisBlock.Hash, Operations: ops, Epoch: 1})
+	f.Add(report(data), genesisBlock.Hash, "", ops, uint64(1))
+	f.Add(report(data), genesisBlock.Hash, strings.Repeat("0", 64), ops, uint64(1))
+	f.Add(report(data), genesisBlock.Hash, "", ops+1, uint64(1))
+	f.Add(report(data), genesisBlock.Hash, "", ops, uint64(2))
+	f.Add(report(simulatedReportData(Block{PrevHash: genesisBlock.Hash})), genesisBlock.Hash, "", uint64(0), uint64(0))
+	// too short to compare, sliced without a length check before
+	f.Add(report([]byte("0")), genesisBlock.Hash, "", ops, uint64(1))
+	f.Add(report(data), "0", "", ops, uint64(1))
+	f.Add([]byte(SIMULATED_REPORT_PREFIX+"{}"), "", "", uint64(0), uint64(0))
+
+	f.Fuzz(func(t *testing.T, proof []byte, oldHash string, txRoot string, operations uint64, epoch uint64) {
+		block := Block{TxRoot: txRoot, Operations: operations, Epoch: epoch, Proof: proof}
+		if err := checkAttestation(block, oldHash, genesis.basePolicy()); err != nil {
+			return
+		}
+		report, err := verifySimulatedReport(proof)
+		if err != nil || len(report.Data) < 64 || len(oldHash) < 32 || string(report.Data[:32]) != oldHash[:32] {
+			t.Fatalf("accepted a report not bound to %q", oldHash)
+		}
+		if !bytes.Equal(report.Data[48:64], contentDigest(block)) {
+			t.Fatalf("accepted a report not bound to the transaction root %q", txRoot)
+		}
+		if !bytes.Equal(report.Data[32:48], simulatedReportData(block)[32:48]) || operations < MIN_BLOCK_OPERATIONS || epoch == 0 {
+			t.Fatalf("accepted a report not matching the block's work: %d operations in epoch %d", operations, epoch)
+		}
+	})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Defines a network, read from the json file named by GENESIS_FILE. Nodes started from different
+// genesis files have different genesis blocks and refuse each other's connections.
+type Genesis struct {
+	ChainID string
+	// Leading zeros required in block hashes
+	Difficulty int
+	// Unix time the network was created, lets networks with otherwise identical genesis files differ
+	Timestamp int64
+	// Initial account balances
+	Balances map[string]int
+	// Enclave measurements (MRENCLAVE) accepted from the first block on, in addition to Policy
+	Enclaves []string
+	// Attestation policy from the first block on, governance transactions change it later on
+	Policy *AttestationPolicy `json:",omitempty"`
+	// Hex encoded ed25519 public key signing governance transactions, without one they are rejected
+	GovernanceKey string `json:",omitempty"`
+}
+
+// Network used without a genesis file
+var defaultGenesis = Genesis{
+	ChainID:    "poc-devnet",
+	Difficulty: 1,
+	Timestamp:  1672531200,
+}
+
+var genesis Genesis
+
+// Sent as the first line of every stream between nodes
+type Hello struct {
+	ChainID string
+	Genesis string
+}
+
+var errWrongNetwork = errors.New("peer is on another network")
+
+// Loads the genesis file and derives the genesis block, the difficulty and the governance key
+func configureNetwork(genesisFile string) error {
+	g := defaultGenesis
+	if genesisFile != "" {
+		var err error
+		g, err = loadGenesis(genesisFile)
+		if err != nil {
+			return fmt.Errorf("loading genesis failed: %w", err)
+		}
+	}
+	return configureGenesis(g)
+}
+
+func configureGenesis(g Genesis) error {
+	key, err := loadGovernanceKey(g.GovernanceKey)
+	if err != nil {
+		return err
+	}
+	genesis = g
+	genesisBlock = g.block()
+	difficulty = g.Difficulty
+	governanceKey = key
+	chainLog.Info("Network configured", "chain_id", g.ChainID, "genesis", genesisBlock.Hash)
+	return nil
+}
+
+func loadGenesis(path string) (Genesis, error) {
+	var g Genesis
+	f, err := os.Open(path)
+	if err != nil {
+		return g, err
+	}
+	defer f.Close()
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&g); err != nil {
+		return g, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := g.validate(); err != nil {
+		return g, fmt.Errorf("%s: %w", path, err)
+	}
+	return g, nil
+}
+
+func (g *Genesis) validate() error {
+	if g.ChainID == "" {
+		return errors.New("missing chain id")
+	}
+	// the genesis hash is mined when the file is loaded, so the difficulty is kept within reach
+	if g.Difficulty < 1 || g.Difficulty > 8 {
+		return fmt.Errorf("invalid difficulty %d", g.Difficulty)
+	}
+	for address, balance := range g.Balances {
+		if balance <= 0 {
+			return fmt.Errorf("invalid balance %d for %s", balance, address)
+		}
+	}
+	for i, id := range g.Enclaves {
+		g.Enclaves[i] = strings.ToLower(id)
+		if !isMeasurement(id) {
+			return fmt.Errorf("invalid enclave %q", id)
+		}
+	}
+	if g.Policy != nil {
+		if err := g.Policy.validate(); err != nil {
+			return err
+		}
+	}
+	_, err := loadGovernanceKey(g.GovernanceKey)
+	return err
+}
+
+// Measurements accepted from the first block on. Every node derives them from the genesis file alone,
+// so all nodes agree on the blocks they accept.
+func (g Genesis) basePolicy() AttestationPolicy {
+	var p AttestationPolicy
+	if g.Policy != nil {
+		p = g.Policy.clone()
+	}
+	if p.MaxReportAge == 0 {
+		p.MaxReportAge = DEFAULT_MAX_REPORT_AGE
+	}
+	for _, id := range g.Enclaves {
+		p.apply(Governance{Action: GOVERNANCE_ADD, UniqueID: id})
+	}
+	return p
+}
+
+// The genesis block's hash commits to the whole genesis file. Like any other block it has to meet the difficulty,
+// the first block's attestation is bound to it, so the nonce is the first one giving a hash that does.
+func (g Genesis) block() Block {
+	encoded, err := json.Marshal(g)
+	if err != nil {
+		fatal(chainLog, "Failed to encode genesis", err)
+	}
+	var nonce uint32
+	for {
+		sum := sha256.Sum256(append(encoded, strconv.Itoa(int(nonce))...))
+		hash := hex.EncodeToString(sum[:])
+		if countLeadingZeros(hash) >= g.Difficulty {
+			return Block{Index: 0, Txs: "", Hash: hash, Nonce: nonce, PrevHash: "", Proof: []byte("")}
+		}
+		nonce++
+	}
+}
+
+func writeHello(rw *bufio.ReadWriter) error {
+	bytes, err := json.Marshal(Hello{ChainID: genesis.ChainID, Genesis: genesisBlock.Hash})
+	if err != nil {
+		return err
+	}
+	if _, err := rw.WriteString(string(bytes) + "\n"); err != nil {
+		return err
+	}
+	return rw.Flush()
+}
+
+// Reads the peer's hello, streams from nodes with another genesis block are closed before any chain is exchanged
+func readHello(rw *bufio.ReadWriter) error {
+	line, err := rw.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	var hello Hello
+	if err := json.Unmarshal([]byte(line), &hello); err != nil {
+		return err
+	}
+	if hello.ChainID != genesis.ChainID || hello.Genesis != genesisBlock.Hash {
+		return fmt.Errorf("%w %s (genesis %s)", errWrongNetwork, hello.ChainID, hello.Genesis)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+)
+
+const (
+	// Peers send their chain every 5 seconds, a node that heard from none for longer is no longer considered synced
+	SYNC_TIMEOUT     = 30 * time.Second
+	SHUTDOWN_TIMEOUT = 10 * time.Second
+)
+
+// Set once the libp2p host is listening
+var p2pHost host.Host
+
+// Unix time of the last chain received from a peer, the node's chain has been at least as heavy since
+var lastSync int64
+
+// Closed on shutdown, no blocks are accepted afterwards
+var stopped = make(chan bool)
+
+var errShuttingDown = errors.New("node is shutting down")
+
+type Readiness struct {
+	Ready  bool
+	Synced bool
+	Peers  int
+	// The chain directory can be written to
+	Store bool
+}
+
+func markSynced() {
+	atomic.StoreInt64(&lastSync, time.Now().Unix())
+}
+
+func isStopping() bool {
+	select {
+	case <-stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+func connectedPeers() int {
+	if p2pHost == nil {
+		return 0
+	}
+	return len(p2pHost.Network().Peers())
+}
+
+func storeWritable() bool {
+	dir := filepath.Dir(chainFile())
+	f, err := os.CreateTemp(dir, ".probe")
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return os.Remove(f.Name()) == nil
+}
+
+func readiness() Readiness {
+	r := Readiness{
+		Synced: time.Since(time.Unix(atomic.LoadInt64(&lastSync), 0)) < SYNC_TIMEOUT,
+		Peers:  connectedPeers(),
+		Store:  storeWritable(),
+	}
+	r.Ready = r.Synced && r.Peers > 0 && r.Store && !isStopping()
+	return r
+}
+
+// GET /healthz, the process is up and serving requests
+func handleHealth(w http.ResponseWriter, req *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// GET /readyz, 200 if the node is synced with its peers and can write its chain, 503 otherwise
+func handleReady(w http.ResponseWriter, req *http.Request) {
+	r := readiness()
+	w.Header().Set("Content-Type", "application/json")
+	if !r.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(r)
+}
+
+// Stops accepting blocks, closes the servers and the libp2p host and writes the chain.
+// stopWorkers disconnects the workers of nodes serving them, it may be nil. Returns the process's exit code.
+func shutdown(server *http.Server, stopWorkers func()) int {
+	close(stopped)
+	chainLog.Info("Shutting down")
+	code := 0
+
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		httpLog.Error("Stopping the HTTP server failed", err)
+		code = 1
+	}
+	if stopWorkers != nil {
+		stopWorkers()
+	}
+	if p2pHost != nil {
+		if err := p2pHost.Close(); err != nil {
+			p2pLog.Error("Closing the host failed", err)
+			code = 1
+		}
+	}
+
+	// blocks in flight have been written or rejected once the lock is taken
+	mutex.Lock()
+	defer mutex.Unlock()
+	bytes, err := json.MarshalIndent(blockchain, "", "  ")
+	if err == nil {
+		err = os.WriteFile(chainFile(), bytes, 0644)
+	}
+	if err != nil {
+		chainLog.Error("Writing the chain failed", err)
+		code = 1
+	}
+	dataLock.Close()
+	chainLog.Info("Stopped", "height", blockchain[len(blockchain)-1].Index)
+	return code
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// Headers served by chain_getHeaders at once
+	MAX_HEADERS = 500
+	// Light clients poll their full nodes as often as nodes send their chain to peers
+	LIGHT_SYNC_INTERVAL = 5 * time.Second
+)
+
+// A block without its transactions. Light clients sync headers only, they check linkage, difficulty and
+// attestations like full nodes and ask full nodes for Merkle proofs of the transactions they are interested in.
+type Header struct {
+	Index    int
+	Hash     string
+	Nonce    uint32
+	PrevHash string
+	Proof    []byte
+	// Merkle roots of the block's transactions and result commitments, covered by Hash
+	TxRoot     string
+	ResultRoot string `json:",omitempty"`
+	Operations uint64 `json:",omitempty"`
+	Epoch      uint64 `json:",omitempty"`
+	// Governance transactions of the block with their proofs, they change the measurements accepted later on
+	Governance []TxProof `json:",omitempty"`
+}
+
+// A transaction and its path to the TxRoot of the block including it
+type TxProof struct {
+	Block int
+	Tx    Tx
+	Proof []MerkleStep
+}
+
+// A job result and its path to the root of all results of the job, followed by the path of the job's
+// commitment to the ResultRoot of the block committing it. Job results are not on chain, their root is.
+type ResultProof struct {
+	Job string
+	// Key of the worker that ran the job and committed its results
+	Worker  string
+	Status  string
+	Results int
+	Root    string
+	Index   int
+	Result  JobResult
+	Proof   []MerkleStep
+	// Block committing the job's results
+	Block           int
+	CommitmentProof []MerkleStep
+}
+
+var errMerkleProof = errors.New("invalid merkle proof")
+
+func headerOf(block Block) Header {
+	txs := blockTxs(block)
+	leaves := txLeaves(txs)
+	h := Header{
+		Index:      block.Index,
+		Hash:       block.Hash,
+		Nonce:      block.Nonce,
+		PrevHash:   block.PrevHash,
+		Proof:      block.Proof,
+		TxRoot:     block.TxRoot,
+		ResultRoot: block.ResultRoot,
+		Operations: block.Operations,
+		Epoch:      block.Epoch,
+	}
+	for i, tx := range txs {
+		if tx.Governance != nil {
+			h.Governance = append(h.Governance, TxProof{Block: block.Index, Tx: tx, Proof: merkleProof(leaves, i)})
+		}
+	}
+	return h
+}
+
+// The block as far as the header knows it, enough to validate it and replay governance
+func (h Header) block() Block {
+	txs := make([]Tx, 0, len(h.Governance))
+	for _, g := range h.Governance {
+		txs = append(txs, g.Tx)
+	}
+	return Block{Index: h.Index, Hash: h.Hash, Nonce: h.Nonce, PrevHash: h.PrevHash, Proof: h.Proof, TxRoot: h.TxRoot, ResultRoot: h.ResultRoot, Operations: h.Operations, Epoch: h.Epoch, Txs: encodeTxs(txs)}
+}
+
+// Checks the governance transactions the header carries are part of its transactions
+func (h Header) checkGovernance() error {
+	for _, g := range h.Governance {
+		if g.Block != h.Index || g.Tx.Governance == nil || !g.verify(h.TxRoot) {
+			return errMerkleProof
+		}
+	}
+	return nil
+}
+
+func (p TxProof) verify(root string) bool {
+	leaves := txLeaves([]Tx{p.Tx})
+	return len(leaves) == 1 && verifyMerkleProof(leaves[0], p.Proof, root)
+}
+
+func (p ResultProof) verify(root string) bool {
+	leaves := resultLeaves([]JobResult{p.Result})
+	commitment := commitmentLeaves([]ResultCommitment{{Job: p.Job, Worker: p.Worker, Results: p.Results, Root: p.Root}})
+	return len(leaves) == 1 && p.Index >= 0 && p.Index < p.Results && verifyMerkleProof(leaves[0], p.Proof, p.Root) &&
+		len(commitment) == 1 && verifyMerkleProof(commitment[0], p.CommitmentProof, root)
+}
+
+func headerBlocks(headers []Header) Blockchain {
+	chain := make(Blockchain, len(headers))
+	for i, h := range headers {
+		chain[i] = h.block()
+	}
+	return chain
+}
+
+// Calls a JSON-RPC method of a node, result is decoded from the response
+func callRPC(url string, method string, result interface{}, params ...interface{}) error {
+	if params == nil {
+		params = make([]interface{}, 0)
+	}
+	encoded, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(rpcRequest{JSONRPC: "2.0", Method: method, Params: encoded, ID: json.RawMessage("1")})
+	if err != nil {
+		return err
+	}
+	res, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	var response struct {
+		Result json.RawMessage
+		Error  *rpcError
+	}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return fmt.Errorf("%s: %w", url, err)
+	}
+	if response.Error != nil {
+		return fmt.Errorf("%s: %s", url, response.Error.Message)
+	}
+	return json.Unmarshal(response.Result, result)
+}
+
+type LightClient struct {
+	// JSON-RPC urls of the full nodes
+	nodes   []string
+	headers []Header
+}
+
+func headersFile() string {
+	return filepath.Join(dataDir, "chain", "headers.json")
+}
+
+// node light -rpc urls [-genesis file] [-simulate] [-tx hash] [-job id -result index [-worker key]]
+// Syncs headers from full nodes until interrupted. With -tx or -job it syncs once, prints the verified
+// transaction or job result and exits with 1 if a full node's proof doesn't check out.
+func runLight(args []string) int {
+	cfg, err := commandConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	flags := flag.NewFlagSet("light", flag.ExitOnError)
+	nodes := flags.String("rpc", "", "comma separated JSON-RPC urls of full nodes, e.g. http://127.0.0.1:8080/rpc")
+	flags.StringVar(&cfg.GenesisFile, "genesis", cfg.GenesisFile, "genesis file of the network")
+	flags.BoolVar(&cfg.SimulateAttestation, "simulate", cfg.SimulateAttestation, "accept simulated attestation reports instead of verifying them with EGo")
+	tx := flags.String("tx", "", "hash of a transaction to prove")
+	job := flags.String("job", "", "id of a job whose result to prove")
+	result := flags.Int("result", 0, "index of the job result to prove")
+	worker := flags.String("worker", "", "hex key of the worker expected to have run the job, e.g. the one a confidential job was sealed to")
+	flags.Parse(args)
+
+	if *nodes == "" {
+		fmt.Fprintln(os.Stderr, "light: -rpc is required")
+		return 2
+	}
+	if err := configureAttestation(cfg); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if err := configureNetwork(cfg.GenesisFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if err := lockDataDir(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer dataLock.Close()
+
+	lc := &LightClient{nodes: strings.Split(*nodes, ",")}
+	if err := lc.load(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if *job != "" {
+		lc.sync()
+		proof, err := lc.proveResult(*job, *result, *worker)
+		return printProof(proof, err)
+	}
+	if *tx != "" {
+		lc.sync()
+		proof, err := lc.proveTx(*tx)
+		return printProof(proof, err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	for {
+		lc.sync()
+		select {
+		case <-ctx.Done():
+			chainLog.Info("Stopped", "height", lc.tip().Index)
+			return 0
+		case <-time.After(LIGHT_SYNC_INTERVAL):
+		}
+	}
+}
+
+func printProof(proof interface{}, err error) int {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if errors.Is(err, errMerkleProof) {
+			return 1
+		}
+		return 2
+	}
+	encoded, err := json.MarshalIndent(proof, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	fmt.Println(string(encoded))
+	return 0
+}
+
+// Loads the stored headers, checking them again since the policy may have changed. Starts from genesis without any.
+func (lc *LightClient) load() error {
+	lc.headers = []Header{headerOf(genesisBlock)}
+	content, err := ioutil.ReadFile(headersFile())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var headers []Header
+	if err := json.Unmarshal(content, &headers); err != nil {
+		return fmt.Errorf("%s: %w", headersFile(), err)
+	}
+	if i, err := lc.verify(headers); err != nil {
+		chainLog.Warn("Discarding stored headers", "index", i, "err", err)
+		return nil
+	}
+	lc.headers = headers
+	return nil
+}
+
+func (lc *LightClient) save() {
+	bytes, err := json.MarshalIndent(lc.headers, "", "  ")
+	if err != nil {
+		chainLog.Error("Marshalling headers failed", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(headersFile()), os.ModePerm); err != nil {
+		chainLog.Error("Writing headers failed", err)
+		return
+	}
+	_ = ioutil.WriteFile(headersFile(), bytes, 0644)
+}
+
+func (lc *LightClient) tip() Header {
+	return lc.headers[len(lc.headers)-1]
+}
+
+// Returns the index of the first invalid header
+func (lc *LightClient) verify(headers []Header) (int, error) {
+	if i, err := checkGovernance(headers); err != nil {
+		return i, err
+	}
+	return verifyBlocks(headerBlocks(headers), false)
+}
+
+func checkGovernance(headers []Header) (int, error) {
+	for i, h := range headers {
+		if err := h.checkGovernance(); err != nil {
+			return i, err
+		}
+	}
+	return len(headers), nil
+}
+
+// Adopts the heaviest valid header chain among the full nodes
+func (lc *LightClient) sync() {
+	for _, node := range lc.nodes {
+		headers, err := lc.fetch(node)
+		if err != nil {
+			p2pLog.Warn("Syncing headers failed", "node", node, "err", err)
+			continue
+		}
+		if i, err := checkGovernance(headers); err != nil {
+			chainLog.Warn("Rejected headers", "node", node, "index", headers[i].Index, "err", err)
+			continue
+		}
+		adopt, err := chooseFork(headerBlocks(lc.headers), headerBlocks(headers), false)
+		if err != nil {
+			chainLog.Warn("Rejected headers", "node", node, "reason", validationReason(err), "err", err)
+			continue
+		}
+		if adopt {
+			if isReorg(headerBlocks(lc.headers), headerBlocks(headers)) {
+				chainLog.Info("Reorganized headers", "old_tip", lc.tip().Hash)
+			}
+			lc.headers = headers
+			lc.save()
+			chainLog.Info("Headers synced", "height", lc.tip().Index, "tip", lc.tip().Hash, "node", node)
+		}
+	}
+}
+
+// The node's header chain from genesis, sharing our headers up to the last one the node agrees on
+func (lc *LightClient) fetch(node string) ([]Header, error) {
+	// steps back exponentially until the node has our header
+	fork := len(lc.headers) - 1
+	for step := 1; ; step *= 2 {
+		var headers []Header
+		if err := callRPC(node, "chain_getHeaders", &headers, lc.headers[fork].Index, 1); err != nil {
+			return nil, err
+		}
+		if len(headers) == 1 && headers[0].Hash == lc.headers[fork].Hash {
+			break
+		}
+		if fork == 0 {
+			return nil, errForeignChain
+		}
+		fork -= step
+		if fork < 0 {
+			fork = 0
+		}
+	}
+
+	chain := append([]Header(nil), lc.headers[:fork+1]...)
+	for {
+		var headers []Header
+		if err := callRPC(node, "chain_getHeaders", &headers, chain[len(chain)-1].Index+1, MAX_HEADERS); err != nil {
+			return nil, err
+		}
+		chain = append(chain, headers...)
+		if len(headers) < MAX_HEADERS {
+			return chain, nil
+		}
+	}
+}
+
+// Gets the transaction's proof from a full node and checks it against the TxRoot of our synced header
+func (lc *LightClient) proveTx(hash string) (TxProof, error) {
+	var proof TxProof
+	if err := callRPC(lc.nodes[0], "tx_getProof", &proof, hash); err != nil {
+		return proof, err
+	}
+	if calculateTxHash(proof.Tx) != hash {
+		return proof, fmt.Errorf("%w: proof is for another transaction", errMerkleProof)
+	}
+	header, err := lc.header(proof.Block)
+	if err != nil {
+		return proof, err
+	}
+	if !proof.verify(header.TxRoot) {
+		return proof, errMerkleProof
+	}
+	return proof, nil
+}
+
+// Job results are only known to the node the job was submitted to, the first full node. The proof is checked
+// against the ResultRoot of our synced header, which the block's attestation binds, and against the worker's
+// key if one is given.
+func (lc *LightClient) proveResult(job string, index int, worker string) (ResultProof, error) {
+	var proof ResultProof
+	if err := callRPC(lc.nodes[0], "job_getResultProof", &proof, job, index); err != nil {
+		return proof, err
+	}
+	if proof.Job != job || proof.Index != index {
+		return proof, fmt.Errorf("%w: proof is for another result", errMerkleProof)
+	}
+	if worker != "" && proof.Worker != worker {
+		return proof, fmt.Errorf("%w: results committed by worker %s", errMerkleProof, proof.Worker)
+	}
+	header, err := lc.header(proof.Block)
+	if err != nil {
+		return proof, err
+	}
+	if !proof.verify(header.ResultRoot) {
+		return proof, errMerkleProof
+	}
+	return proof, nil
+}
+
+// The synced header at the block index
+func (lc *LightClient) header(block int) (Header, error) {
+	index := block - lc.headers[0].Index
+	if index < 0 || index >= len(lc.headers) {
+		return Header{}, fmt.Errorf("block %d is not synced yet", block)
+	}
+	return lc.headers[index], nil
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"time"
+
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 
 	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
@@ -29,3 +32,17 @@ func initMDNS(peerhost host.Host, rendezvous string) chan peer.AddrInfo {
 	}
 	return n.PeerChan
 }
+
+const REDIAL_INTERVAL = 10 * time.Second
+
+// Feeds the configured peers to peerChan whenever the node is not connected to them
+func redialPeers(peerhost host.Host, peers []peer.AddrInfo, peerChan chan peer.AddrInfo) {
+	for {
+		for _, p := range peers {
+			if peerhost.Network().Connectedness(p.ID) != network.Connected {
+				peerChan <- p
+			}
+		}
+		time.Sleep(REDIAL_INTERVAL)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// Merkle trees over the transactions of a block and the results of a job. Leaves and inner nodes are hashed with
+// different prefixes so an inner node can't pass as a leaf, the last node of an odd level is carried up as it is.
+
+// A sibling on the path from a leaf to the root
+type MerkleStep struct {
+	Hash string
+	// The sibling is the left child
+	Left bool
+}
+
+func merkleLeaf(data []byte) []byte {
+	sum := sha256.Sum256(append([]byte{0}, data...))
+	return sum[:]
+}
+
+func merkleNode(left []byte, right []byte) []byte {
+	sum := sha256.Sum256(append(append([]byte{1}, left...), right...))
+	return sum[:]
+}
+
+// Hashes of the level above, carrying up the last node of an odd level
+func merkleLevel(level [][]byte) [][]byte {
+	next := make([][]byte, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		if i+1 == len(level) {
+			next = append(next, level[i])
+		} else {
+			next = append(next, merkleNode(level[i], level[i+1]))
+		}
+	}
+	return next
+}
+
+func merkleLeaves(leaves [][]byte) [][]byte {
+	level := make([][]byte, len(leaves))
+	for i, leaf := range leaves {
+		level[i] = merkleLeaf(leaf)
+	}
+	return level
+}
+
+// Hex encoded root of the tree, empty for no leaves
+func merkleRoot(leaves [][]byte) string {
+	if len(leaves) == 0 {
+		return ""
+	}
+	level := merkleLeaves(leaves)
+	for len(level) > 1 {
+		level = merkleLevel(level)
+	}
+	return hex.EncodeToString(level[0])
+}
+
+// Siblings on the path from the leaf at index to the root, leaf first
+func merkleProof(leaves [][]byte, index int) []MerkleStep {
+	proof := make([]MerkleStep, 0)
+	level := merkleLeaves(leaves)
+	for len(level) > 1 {
+		sibling := index ^ 1
+		if sibling < len(level) {
+			proof = append(proof, MerkleStep{Hash: hex.EncodeToString(level[sibling]), Left: sibling < index})
+		}
+		level = merkleLevel(level)
+		index /= 2
+	}
+	return proof
+}
+
+func verifyMerkleProof(leaf []byte, proof []MerkleStep, root string) bool {
+	hash := merkleLeaf(leaf)
+	for _, step := range proof {
+		sibling, err := hex.DecodeString(step.Hash)
+		if err != nil || len(sibling) != sha256.Size {
+			return false
+		}
+		if step.Left {
+			hash = merkleNode(sibling, hash)
+		} else {
+			hash = merkleNode(hash, sibling)
+		}
+	}
+	return root != "" && hex.EncodeToString(hash) == root
+}
+
+// Leaves are the json encoding of each transaction, unlike the tx hash it covers governance transactions' content
+func txLeaves(txs []Tx) [][]byte {
+	leaves := make([][]byte, 0, len(txs))
+	for _, tx := range txs {
+		// a leaf that can't be encoded is left empty so the others keep their index
+		encoded, _ := json.Marshal(tx)
+		leaves = append(leaves, encoded)
+	}
+	return leaves
+}
+
+func resultLeaves(results []JobResult) [][]byte {
+	leaves := make([][]byte, 0, len(results))
+	for _, result := range results {
+		encoded, _ := json.Marshal(result)
+		leaves = append(leaves, encoded)
+	}
+	return leaves
+}
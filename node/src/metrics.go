@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/edgelesssys/ego/attestation"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics served at /metrics on the HTTP address
+var (
+	chainHeight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "poc_chain_height",
+		Help: "Index of the chain tip",
+	})
+	chainReorgs = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "poc_chain_reorgs_total",
+		Help: "Chains received from peers that replaced the tip with a block of another branch",
+	})
+	blockRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "poc_block_rejections_total",
+		Help: "Blocks failing validation by reason",
+	}, []string{"reason"})
+	attestationRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "poc_attestation_rejections_total",
+		Help: "Rejected attestations by reason, as returned by attestation_getRejections",
+	}, []string{"reason"})
+	blockValidation = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "poc_block_validation_seconds",
+		Help:    "Time taken to validate a block, including its attestation",
+		Buckets: prometheus.DefBuckets,
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "poc_peers",
+		Help: "Connected peers",
+	}, func() float64 {
+		return float64(connectedPeers())
+	})
+	reportVerification = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "poc_verify_remote_report_seconds",
+		Help:    "Duration of VerifyRemoteReport calls by result",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"result"})
+)
+
+func observeChain(chain Blockchain) {
+	chainHeight.Set(float64(chain[len(chain)-1].Index))
+}
+
+// A chain replacing old is a reorg unless it contains old's tip
+func isReorg(old Blockchain, chain Blockchain) bool {
+	tip := old[len(old)-1]
+	i := tip.Index - chain[0].Index
+	return i < 0 || i >= len(chain) || chain[i].Hash != tip.Hash
+}
+
+// Reason label of a block failing checkBlock, attestation failures use their rejection reason
+func validationReason(err error) string {
+	switch {
+	case errors.Is(err, errBlockIndex):
+		return "index"
+	case errors.Is(err, errPrevHash):
+		return "prev_hash"
+	case errors.Is(err, errBlockHash):
+		return "hash"
+	case errors.Is(err, errDifficulty):
+		return "difficulty"
+	case errors.Is(err, errBlockWork):
+		return "work"
+	case errors.Is(err, errForeignChain):
+		return "foreign_chain"
+	case errors.Is(err, errTxRoot):
+		return "tx_root"
+	case errors.Is(err, errBlockTxs):
+		return "txs"
+	case errors.Is(err, errResultRoot):
+		return "result_root"
+	case errors.Is(err, errBlockResults), errors.Is(err, errDuplicateResult):
+		return "results"
+	}
+	if reason := rejectionReason(err); reason != "" {
+		return reason
+	}
+	return "other"
+}
+
+func timeReportVerification(start time.Time, err error) {
+	result := "ok"
+	if errors.Is(err, attestation.ErrTCBLevelInvalid) {
+		result = "tcb_level"
+	} else if err != nil {
+		result = "error"
+	}
+	reportVerification.WithLabelValues(result).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/edgelesssys/ego/attestation"
+	"github.com/edgelesssys/ego/attestation/tcbstatus"
+	"github.com/edgelesssys/ego/eclient"
+)
+
+// Decides which worker enclaves are accepted. The network's policy comes from the genesis file, the node's own
+// policy read from the json file named by ATTESTATION_POLICY only narrows the workers that may publish keys to it.
+// An enclave is accepted if its UniqueID is listed or if it matches one of the signers.
+type AttestationPolicy struct {
+	// Accepted enclave measurements (MRENCLAVE), hex encoded
+	UniqueIDs []string
+	// Accepted signers (MRSIGNER), any enclave they sign with the product id and at least the security version is accepted
+	Signers []SignerPolicy
+	// Debug enclaves can be inspected by the host, they are rejected unless allowed
+	AllowDebug bool
+	// TCB statuses accepted besides UpToDate, e.g. "SWHardeningNeeded". Revoked platforms are never accepted
+	TCBStatuses []string
+	// Reports not bound to a block, like the workers' key reports, are rejected once the block they reference is older than this
+	MaxReportAge int
+}
+
+type SignerPolicy struct {
+	SignerID           string
+	ProductID          uint16
+	MinSecurityVersion uint
+}
+
+const DEFAULT_MAX_REPORT_AGE = 100
+
+// The node's own policy, empty if none is configured
+var policy AttestationPolicy
+
+var errInvalidReport = errors.New("invalid report")
+var errTCBStatus = errors.New("tcb status not accepted")
+var errDebugEnclave = errors.New("debug enclave")
+var errSecurityVersion = errors.New("security version too low")
+var errUnknownEnclave = errors.New("enclave not accepted by the attestation policy")
+var errReportData = errors.New("report not bound to the block")
+var errStaleReport = errors.New("report too old")
+
+// Verifies remote reports, replaced by verifySimulatedReport on networks without SGX
+var verifyRemoteReport = eclient.VerifyRemoteReport
+
+// UniqueID of the reports of simulated workers, see the worker's report.go
+const SIMULATED_UNIQUE_ID = "ff3e28440a9d48d9497de247c86991f139f118a5e161276371acbd2e3886bfa3"
+
+// Prefix of the simulated reports produced by workers in EGo's simulation mode
+const SIMULATED_REPORT_PREFIX = "poc-simulated-report:"
+
+// Rejected attestations counted by reason
+var rejections = make(map[string]uint64)
+var rejectionsMutex = &sync.Mutex{}
+
+// Sets up the node's attestation policy and the report verifier
+func configureAttestation(c *Config) error {
+	var err error
+	policy, err = loadPolicy(c.AttestationPolicy, c.UniqueID, c.AllowDebug)
+	if err != nil {
+		return fmt.Errorf("loading attestation policy failed: %w", err)
+	}
+	if c.SimulateAttestation {
+		attestLog.Warn("Accepting simulated attestation reports, blocks are NOT attested")
+		verifyRemoteReport = verifySimulatedReport
+	}
+	return nil
+}
+
+// Loads the policy file, without one only the legacy UniqueID is accepted
+func loadPolicy(path string, legacyID string, allowDebug bool) (AttestationPolicy, error) {
+	var p AttestationPolicy
+	if path == "" {
+		if legacyID == "" {
+			return p, nil
+		}
+		attestLog.Info("No attestation policy set, accepting worker keys only from UNIQUE_ID", "unique_id", legacyID, "allow_debug", allowDebug)
+		p = AttestationPolicy{UniqueIDs: []string{legacyID}, AllowDebug: allowDebug, MaxReportAge: DEFAULT_MAX_REPORT_AGE}
+		return p, p.validate()
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return p, err
+	}
+	defer f.Close()
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&p); err != nil {
+		return p, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(p.UniqueIDs) == 0 && len(p.Signers) == 0 {
+		return p, fmt.Errorf("%s: policy accepts no enclave", path)
+	}
+	if err := p.validate(); err != nil {
+		return p, fmt.Errorf("%s: %w", path, err)
+	}
+	if p.MaxReportAge == 0 {
+		p.MaxReportAge = DEFAULT_MAX_REPORT_AGE
+	}
+	attestLog.Info("Loaded attestation policy", "file", path, "unique_ids", len(p.UniqueIDs), "signers", len(p.Signers), "allow_debug", p.AllowDebug)
+	return p, nil
+}
+
+// Whether the policy accepts any enclave, an empty policy is no policy
+func (p AttestationPolicy) configured() bool {
+	return len(p.UniqueIDs) > 0 || len(p.Signers) > 0
+}
+
+func (p AttestationPolicy) clone() AttestationPolicy {
+	p.UniqueIDs = append([]string(nil), p.UniqueIDs...)
+	p.Signers = append([]SignerPolicy(nil), p.Signers...)
+	p.TCBStatuses = append([]string(nil), p.TCBStatuses...)
+	return p
+}
+
+// Checks all ids are 32 byte hex strings and normalizes them to lower case
+func (p *AttestationPolicy) validate() error {
+	for i, id := range p.UniqueIDs {
+		p.UniqueIDs[i] = strings.ToLower(id)
+		if !isMeasurement(id) {
+			return fmt.Errorf("invalid unique id %q", id)
+		}
+	}
+	for i, s := range p.Signers {
+		p.Signers[i].SignerID = strings.ToLower(s.SignerID)
+		if !isMeasurement(s.SignerID) {
+			return fmt.Errorf("invalid signer id %q", s.SignerID)
+		}
+	}
+	for _, name := range p.TCBStatuses {
+		status, ok := parseTCBStatus(name)
+		if !ok || status == tcbstatus.Revoked {
+			return fmt.Errorf("invalid tcb status %q", name)
+		}
+	}
+	if p.MaxReportAge < 0 {
+		return fmt.Errorf("invalid max report age %d", p.MaxReportAge)
+	}
+	return nil
+}
+
+func parseTCBStatus(name string) (tcbstatus.Status, bool) {
+	for status := tcbstatus.UpToDate; status <= tcbstatus.Unknown; status++ {
+		if status.String() == name {
+			return status, true
+		}
+	}
+	return tcbstatus.Unknown, false
+}
+
+func isMeasurement(id string) bool {
+	b, err := hex.DecodeString(id)
+	return err == nil && len(b) == 32
+}
+
+// Verifies a remote report and checks the policy accepts the platform's TCB level and the enclave
+func (p AttestationPolicy) verifyReport(raw []byte) (attestation.Report, error) {
+	start := time.Now()
+	report, err := verifyRemoteReport(raw)
+	timeReportVerification(start, err)
+	if errors.Is(err, attestation.ErrTCBLevelInvalid) {
+		if !p.acceptsTCB(report.TCBStatus) {
+			return report, fmt.Errorf("%w: %s", errTCBStatus, report.TCBStatus)
+		}
+	} else if err != nil {
+		return report, fmt.Errorf("%w: %v", errInvalidReport, err)
+	}
+	return report, p.check(report)
+}
+
+func (p AttestationPolicy) acceptsTCB(status tcbstatus.Status) bool {
+	if status == tcbstatus.Revoked {
+		return false
+	}
+	for _, name := range p.TCBStatuses {
+		if name == status.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns nil if the policy accepts the enclave that produced the report
+func (p AttestationPolicy) check(report attestation.Report) error {
+	if report.Debug && !p.AllowDebug {
+		return errDebugEnclave
+	}
+	uniqueID := hex.EncodeToString(report.UniqueID)
+	for _, id := range p.UniqueIDs {
+		if id == uniqueID {
+			return nil
+		}
+	}
+
+	signerID := hex.EncodeToString(report.SignerID)
+	productID := uint16(0)
+	if len(report.ProductID) >= 2 {
+		productID = binary.LittleEndian.Uint16(report.ProductID)
+	}
+	err := errUnknownEnclave
+	for _, s := range p.Signers {
+		if s.SignerID != signerID || s.ProductID != productID {
+			continue
+		}
+		if report.SecurityVersion >= s.MinSecurityVersion {
+			return nil
+		}
+		err = errSecurityVersion
+	}
+	return err
+}
+
+// Simulated reports are plain json with nothing to verify, they must only be accepted on test networks
+func verifySimulatedReport(raw []byte) (attestation.Report, error) {
+	var report attestation.Report
+	if !bytes.HasPrefix(raw, []byte(SIMULATED_REPORT_PREFIX)) {
+		return report, errors.New("not a simulated report")
+	}
+	err := json.Unmarshal(raw[len(SIMULATED_REPORT_PREFIX):], &report)
+	return report, err
+}
+
+// Index of the block among the last maxAge blocks whose hash starts with the given prefix, -1 if there is none
+func reportHeight(chain Blockchain, prefix []byte, maxAge int) int {
+	for i := len(chain) - 1; i >= 0 && i >= len(chain)-1-maxAge; i-- {
+		if len(chain[i].Hash) >= len(prefix) && chain[i].Hash[:len(prefix)] == string(prefix) {
+			return chain[i].Index
+		}
+	}
+	return -1
+}
+
+func rejectionReason(err error) string {
+	switch {
+	case errors.Is(err, errInvalidReport):
+		return "invalid_report"
+	case errors.Is(err, errTCBStatus):
+		return "tcb_status"
+	case errors.Is(err, errDebugEnclave):
+		return "debug_enclave"
+	case errors.Is(err, errSecurityVersion):
+		return "security_version"
+	case errors.Is(err, errUnknownEnclave):
+		return "unknown_enclave"
+	case errors.Is(err, errReportData):
+		return "report_data"
+	case errors.Is(err, errStaleReport):
+		return "stale_report"
+	default:
+		return ""
+	}
+}
+
+// Counts attestation failures, other errors are ignored
+func countRejection(err error) {
+	reason := rejectionReason(err)
+	if reason == "" {
+		return
+	}
+	attestationRejections.WithLabelValues(reason).Inc()
+	rejectionsMutex.Lock()
+	defer rejectionsMutex.Unlock()
+	rejections[reason]++
+}
+
+func rejectionCounts() map[string]uint64 {
+	rejectionsMutex.Lock()
+	defer rejectionsMutex.Unlock()
+	counts := make(map[string]uint64, len(rejections))
+	for reason, n := range rejections {
+		counts[reason] = n
+	}
+	return counts
+}
+
+// A block on top of tip with the json encoded txs and result commitments and a simulated report, the nonce is
+// searched from nonce on until the hash meets the difficulty
+func simulatedBlock(tip Block, txs string, results string, difficulty int, nonce uint32) (Block, error) {
+	block := Block{
+		Index:      tip.Index + 1,
+		PrevHash:   tip.Hash,
+		Txs:        txs,
+		TxRoot:     merkleRoot(txLeaves(blockTxs(Block{Txs: txs}))),
+		Results:    results,
+		ResultRoot: merkleRoot(commitmentLeaves(blockResults(Block{Results: results}))),
+		Nonce:      nonce,
+		// every simulated block is the next epoch of the same worker
+		Operations: MIN_BLOCK_OPERATIONS,
+		Epoch:      uint64(tip.Index + 1),
+	}
+	var err error
+	block.Proof, err = simulatedReport(simulatedReportData(block))
+	if err != nil {
+		return Block{}, err
+	}
+	for {
+		block.Hash = calculateHash(block)
+		if countLeadingZeros(block.Hash) >= difficulty {
+			return block, nil
+		}
+		block.Nonce++
+	}
+}
+
+// A simulated report of the simulated enclave with the report data
+func simulatedReport(data []byte) ([]byte, error) {
+	uniqueID, _ := hex.DecodeString(SIMULATED_UNIQUE_ID)
+	productID := make([]byte, 16)
+	productID[0] = 1
+	report, err := json.Marshal(attestation.Report{
+		Data:            data,
+		SecurityVersion: 1,
+		Debug:           true,
+		UniqueID:        uniqueID,
+		SignerID:        make([]byte, 32),
+		ProductID:       productID,
+		TCBStatus:       tcbstatus.UpToDate,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(SIMULATED_REPORT_PREFIX), report...), nil
+}
+
+// Report data a worker attests for the block, like the worker's attestationData
+func simulatedReportData(block Block) []byte {
+	data := make([]byte, 64)
+	copy(data[:32], block.PrevHash)
+	binary.BigEndian.PutUint64(data[32:40], block.Operations)
+	binary.BigEndian.PutUint64(data[40:48], block.Epoch)
+	copy(data[48:64], contentDigest(block))
+	return data
+}
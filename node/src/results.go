@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Commits a block to the results of a finished job. The job's results stay with the node it was submitted to,
+// the block only carries their Merkle root, so light clients can check a result against a synced header. The
+// worker builds the commitment inside its enclave from the results it sealed, bound to its own key: a job's
+// results are committed once per worker, a commitment by another key can't lock out the worker that ran it.
+type ResultCommitment struct {
+	Job string
+	// Hex encoded public key of the worker that ran the job
+	Worker  string
+	Results int
+	// Merkle root of the job's results
+	Root string
+}
+
+// Result commitments a block carries at most
+const MAX_BLOCK_RESULTS = 1000
+
+var errBlockResults = errors.New("invalid block results")
+var errResultRoot = errors.New("result root does not match the block's results")
+var errDuplicateResult = errors.New("job results already committed")
+
+func decodeResults(encoded string) ([]ResultCommitment, error) {
+	results := make([]ResultCommitment, 0)
+	if encoded == "" {
+		return results, nil
+	}
+	err := json.Unmarshal([]byte(encoded), &results)
+	return results, err
+}
+
+func encodeResults(results []ResultCommitment) string {
+	if len(results) == 0 {
+		return ""
+	}
+	bytes, err := json.Marshal(results)
+	if err != nil {
+		return ""
+	}
+	return string(bytes)
+}
+
+func blockResults(block Block) []ResultCommitment {
+	results, err := decodeResults(block.Results)
+	if err != nil {
+		return make([]ResultCommitment, 0)
+	}
+	return results
+}
+
+func commitmentLeaves(results []ResultCommitment) [][]byte {
+	leaves := make([][]byte, 0, len(results))
+	for _, result := range results {
+		encoded, _ := json.Marshal(result)
+		leaves = append(leaves, encoded)
+	}
+	return leaves
+}
+
+// Key of a commitment in the chain state, the job and the worker that ran it
+func commitmentKey(job string, worker string) string {
+	return job + ":" + worker
+}
+
+// Checks the block's result commitments and records them with the block's index
+func (s *ChainState) applyResults(block Block) error {
+	results, err := decodeResults(block.Results)
+	// canonical like the transactions, the leaves are the encoded commitments the worker sealed
+	if err != nil || encodeResults(results) != block.Results || len(results) > MAX_BLOCK_RESULTS {
+		return errBlockResults
+	}
+	if merkleRoot(commitmentLeaves(results)) != block.ResultRoot {
+		return errResultRoot
+	}
+	for _, result := range results {
+		if result.Job == "" || !isWorkerKey(result.Worker) || result.Results <= 0 || len(result.Root) != 64 {
+			return fmt.Errorf("%w: %s", errBlockResults, result.Job)
+		}
+		key := commitmentKey(result.Job, result.Worker)
+		if _, ok := s.Committed[key]; ok {
+			return fmt.Errorf("%w: %s", errDuplicateResult, result.Job)
+		}
+		s.commit(key, block.Index)
+	}
+	return nil
+}
+
+// Lower case hex of a 32 byte key, one way to write a worker's key
+func isWorkerKey(key string) bool {
+	b, err := hex.DecodeString(key)
+	return err == nil && len(b) == 32 && hex.EncodeToString(b) == key
+}
+
+// Index of the block committing each of the jobs' results by the worker, jobs not committed are left out
+func committedResults(s *ChainState, jobs []string, worker string) map[string]int64 {
+	committed := make(map[string]int64)
+	for _, job := range jobs {
+		if index, ok := s.Committed[commitmentKey(job, worker)]; ok {
+			committed[job] = int64(index)
+		}
+	}
+	return committed
+}
+
+// Looks up the position in the chain of the block committing the job's results by the worker and the
+// commitment's position in the block, -1 if they are not in the chain
+func findResults(chain Blockchain, job string, worker string) (int, int) {
+	for i := len(chain) - 1; i >= 0; i-- {
+		for j, result := range blockResults(chain[i]) {
+			if result.Job == job && result.Worker == worker {
+				return i, j
+			}
+		}
+	}
+	return -1, -1
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// JSON-RPC 2.0 interface, all methods take positional parameters
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+const (
+	RPC_PARSE_ERROR      = -32700
+	RPC_INVALID_REQUEST  = -32600
+	RPC_METHOD_NOT_FOUND = -32601
+	RPC_INVALID_PARAMS   = -32602
+	RPC_INTERNAL_ERROR   = -32603
+	RPC_SERVER_ERROR     = -32000
+)
+
+type rpcMethod func(params []json.RawMessage) (interface{}, *rpcError)
+
+var rpcMethods = map[string]rpcMethod{
+	"chain_getBlock":            rpcGetBlock,
+	"chain_getTip":              rpcGetTip,
+	"chain_getSnapshot":         rpcGetSnapshot,
+	"chain_getHeaders":          rpcGetHeaders,
+	"tx_send":                   rpcSendTx,
+	"tx_getStatus":              rpcGetTxStatus,
+	"tx_getProof":               rpcGetTxProof,
+	"account_getBalance":        rpcGetBalance,
+	"account_getHistory":        rpcGetHistory,
+	"job_submit":                rpcSubmitJob,
+	"job_submitSealed":          rpcSubmitSealedJob,
+	"job_getStatus":             rpcGetJobStatus,
+	"job_getResultProof":        rpcGetResultProof,
+	"worker_getKeys":            rpcGetWorkerKeys,
+	"governance_getPolicy":      rpcGetPolicy,
+	"attestation_getRejections": rpcGetRejections,
+	"log_setLevel":              rpcSetLogLevel,
+}
+
+var nullID = json.RawMessage("null")
+
+func handleRPC(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var out interface{}
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(body, &batch); err != nil {
+			out = errorResponse(nullID, RPC_PARSE_ERROR, "parse error")
+		} else if len(batch) == 0 {
+			out = errorResponse(nullID, RPC_INVALID_REQUEST, "empty batch")
+		} else {
+			responses := make([]*rpcResponse, 0, len(batch))
+			for _, raw := range batch {
+				if res := processRPC(raw); res != nil {
+					responses = append(responses, res)
+				}
+			}
+			// a batch of notifications gets no response at all
+			if len(responses) == 0 {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			out = responses
+		}
+	} else {
+		res := processRPC(body)
+		if res == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		out = res
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// Handles a single request object, returns nil for notifications
+func processRPC(raw json.RawMessage) *rpcResponse {
+	var r rpcRequest
+	if err := json.Unmarshal(raw, &r); err != nil {
+		return errorResponse(nullID, RPC_PARSE_ERROR, "parse error")
+	}
+	id := r.ID
+	if id == nil {
+		id = nullID
+	}
+	if r.JSONRPC != "2.0" || r.Method == "" {
+		return errorResponse(id, RPC_INVALID_REQUEST, "invalid request")
+	}
+
+	method, ok := rpcMethods[r.Method]
+	if !ok {
+		if r.ID == nil {
+			return nil
+		}
+		return errorResponse(id, RPC_METHOD_NOT_FOUND, "method not found")
+	}
+
+	params := make([]json.RawMessage, 0)
+	if len(r.Params) > 0 && string(r.Params) != "null" {
+		if err := json.Unmarshal(r.Params, &params); err != nil {
+			return errorResponse(id, RPC_INVALID_PARAMS, "params must be an array")
+		}
+	}
+
+	result, rpcErr := method(params)
+	if r.ID == nil {
+		return nil
+	}
+	if rpcErr != nil {
+		return &rpcResponse{JSONRPC: "2.0", Error: rpcErr, ID: id}
+	}
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		return errorResponse(id, RPC_INTERNAL_ERROR, err.Error())
+	}
+	return &rpcResponse{JSONRPC: "2.0", Result: encoded, ID: id}
+}
+
+func errorResponse(id json.RawMessage, code int, message string) *rpcResponse {
+	return &rpcResponse{JSONRPC: "2.0", Error: &rpcError{Code: code, Message: message}, ID: id}
+}
+
+// Decodes the positional parameters into the given targets, all of them are required
+func parseParams(params []json.RawMessage, targets ...interface{}) *rpcError {
+	if len(params) != len(targets) {
+		return &rpcError{Code: RPC_INVALID_PARAMS, Message: "wrong number of params"}
+	}
+	for i, target := range targets {
+		if err := json.Unmarshal(params[i], target); err != nil {
+			return &rpcError{Code: RPC_INVALID_PARAMS, Message: err.Error()}
+		}
+	}
+	return nil
+}
+
+// chain_getBlock [index or hash]
+func rpcGetBlock(params []json.RawMessage) (interface{}, *rpcError) {
+	var key interface{}
+	if err := parseParams(params, &key); err != nil {
+		return nil, err
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	switch k := key.(type) {
+	case float64:
+		// a bootstrapped chain starts at the tip of its base snapshot
+		index := int(k) - blockchain[0].Index
+		if float64(int(k)) != k || index < 0 || index >= len(blockchain) {
+			return nil, &rpcError{Code: RPC_SERVER_ERROR, Message: "block not found"}
+		}
+		return blockchain[index], nil
+	case string:
+		for _, block := range blockchain {
+			if block.Hash == k {
+				return block, nil
+			}
+		}
+		return nil, &rpcError{Code: RPC_SERVER_ERROR, Message: "block not found"}
+	default:
+		return nil, &rpcError{Code: RPC_INVALID_PARAMS, Message: "expected block index or hash"}
+	}
+}
+
+// chain_getTip []
+func rpcGetTip(params []json.RawMessage) (interface{}, *rpcError) {
+	if err := parseParams(params); err != nil {
+		return nil, err
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	return blockchain[len(blockchain)-1], nil
+}
+
+// chain_getSnapshot [], the latest snapshot taken by the node
+func rpcGetSnapshot(params []json.RawMessage) (interface{}, *rpcError) {
+	if err := parseParams(params); err != nil {
+		return nil, err
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	snapshot, err := latestSnapshot()
+	if err != nil {
+		return nil, &rpcError{Code: RPC_SERVER_ERROR, Message: "no snapshot"}
+	}
+	return snapshot, nil
+}
+
+// chain_getHeaders [from, count], at most MAX_HEADERS headers starting at index from
+func rpcGetHeaders(params []json.RawMessage) (interface{}, *rpcError) {
+	var from, count int
+	if err := parseParams(params, &from, &count); err != nil {
+		return nil, err
+	}
+	if count <= 0 {
+		return nil, &rpcError{Code: RPC_INVALID_PARAMS, Message: "count must be positive"}
+	}
+	if count > MAX_HEADERS {
+		count = MAX_HEADERS
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	// a bootstrapped chain starts at the tip of its base snapshot
+	start := from - blockchain[0].Index
+	if start < 0 {
+		return nil, &rpcError{Code: RPC_SERVER_ERROR, Message: "block not found"}
+	}
+	headers := make([]Header, 0)
+	for i := start; i < len(blockchain) && len(headers) < count; i++ {
+		headers = append(headers, headerOf(blockchain[i]))
+	}
+	return headers, nil
+}
+
+// tx_send [tx]
+func rpcSendTx(params []json.RawMessage) (interface{}, *rpcError) {
+	var tx Tx
+	if err := parseParams(params, &tx); err != nil {
+		return nil, err
+	}
+	hash, err := addTx(tx)
+	if err != nil {
+		return nil, &rpcError{Code: RPC_SERVER_ERROR, Message: err.Error()}
+	}
+	return hash, nil
+}
+
+// tx_getStatus [hash]
+func rpcGetTxStatus(params []json.RawMessage) (interface{}, *rpcError) {
+	var hash string
+	if err := parseParams(params, &hash); err != nil {
+		return nil, err
+	}
+	status, index := txStatus(hash)
+	result := map[string]interface{}{"status": status}
+	if status == TX_CONFIRMED {
+		result["block"] = index
+	}
+	return result, nil
+}
+
+// tx_getProof [hash], the transaction and its path to the TxRoot of the block including it
+func rpcGetTxProof(params []json.RawMessage) (interface{}, *rpcError) {
+	var hash string
+	if err := parseParams(params, &hash); err != nil {
+		return nil, err
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	for i := len(blockchain) - 1; i >= 0; i-- {
+		txs := blockTxs(blockchain[i])
+		for j, tx := range txs {
+			if calculateTxHash(tx) == hash {
+				return TxProof{Block: blockchain[i].Index, Tx: tx, Proof: merkleProof(txLeaves(txs), j)}, nil
+			}
+		}
+	}
+	return nil, &rpcError{Code: RPC_SERVER_ERROR, Message: "transaction not found"}
+}
+
+// account_getBalance [address]
+func rpcGetBalance(params []json.RawMessage) (interface{}, *rpcError) {
+	var address string
+	if err := parseParams(params, &address); err != nil {
+		return nil, err
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	balance, err := accountBalance(blockchain, address)
+	if err != nil {
+		return nil, &rpcError{Code: RPC_SERVER_ERROR, Message: err.Error()}
+	}
+	return balance, nil
+}
+
+// account_getHistory [address], transfers from or to the address, confirmed ones first
+func rpcGetHistory(params []json.RawMessage) (interface{}, *rpcError) {
+	var address string
+	if err := parseParams(params, &address); err != nil {
+		return nil, err
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	return accountHistory(blockchain, address), nil
+}
+
+// job_submit [script, limits?]
+func rpcSubmitJob(params []json.RawMessage) (interface{}, *rpcError) {
+	var script string
+	var limits JobLimits
+	var err *rpcError
+	if len(params) == 2 {
+		err = parseParams(params, &script, &limits)
+	} else {
+		err = parseParams(params, &script)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if script == "" {
+		return nil, &rpcError{Code: RPC_INVALID_PARAMS, Message: "empty script"}
+	}
+	job := submitJob(script, limits)
+	return map[string]interface{}{"id": job.ID, "status": job.Status}, nil
+}
+
+// job_submitSealed [worker, sealed script (base64), limits?]
+func rpcSubmitSealedJob(params []json.RawMessage) (interface{}, *rpcError) {
+	var worker string
+	var sealed []byte
+	var limits JobLimits
+	var err *rpcError
+	if len(params) == 3 {
+		err = parseParams(params, &worker, &sealed, &limits)
+	} else {
+		err = parseParams(params, &worker, &sealed)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) == 0 {
+		return nil, &rpcError{Code: RPC_INVALID_PARAMS, Message: "empty script"}
+	}
+	job, submitErr := submitSealedJob(worker, sealed, limits)
+	if submitErr != nil {
+		return nil, &rpcError{Code: RPC_SERVER_ERROR, Message: submitErr.Error()}
+	}
+	return map[string]interface{}{"id": job.ID, "status": job.Status}, nil
+}
+
+// job_getStatus [id]
+func rpcGetJobStatus(params []json.RawMessage) (interface{}, *rpcError) {
+	var id string
+	if err := parseParams(params, &id); err != nil {
+		return nil, err
+	}
+	job, ok := getJob(id)
+	if !ok {
+		return nil, &rpcError{Code: RPC_SERVER_ERROR, Message: errUnknownJob.Error()}
+	}
+	return job, nil
+}
+
+// job_getResultProof [id, index], the job's result at index, its path to the root of all of the job's results and
+// the path of the commitment by the job's worker to the ResultRoot of the block committing it
+func rpcGetResultProof(params []json.RawMessage) (interface{}, *rpcError) {
+	var id string
+	var index int
+	if err := parseParams(params, &id, &index); err != nil {
+		return nil, err
+	}
+	job, ok := getJob(id)
+	if !ok {
+		return nil, &rpcError{Code: RPC_SERVER_ERROR, Message: errUnknownJob.Error()}
+	}
+	if index < 0 || index >= len(job.Results) {
+		return nil, &rpcError{Code: RPC_SERVER_ERROR, Message: "result not found"}
+	}
+	mutex.Lock()
+	chain := blockchain
+	mutex.Unlock()
+	i, j := findResults(chain, id, job.WorkerKey)
+	if i < 0 {
+		return nil, &rpcError{Code: RPC_SERVER_ERROR, Message: "results not committed yet"}
+	}
+	leaves := resultLeaves(job.Results)
+	commitments := blockResults(chain[i])
+	// the worker committed to the results it sealed, results that never reached us can't be proven
+	if commitments[j].Results != len(job.Results) || commitments[j].Root != merkleRoot(leaves) {
+		return nil, &rpcError{Code: RPC_SERVER_ERROR, Message: "results do not match the worker's commitment"}
+	}
+	return ResultProof{
+		Job:             job.ID,
+		Worker:          job.WorkerKey,
+		Status:          job.Status,
+		Results:         len(job.Results),
+		Root:            merkleRoot(leaves),
+		Index:           index,
+		Result:          job.Results[index],
+		Proof:           merkleProof(leaves, index),
+		Block:           chain[i].Index,
+		CommitmentProof: merkleProof(commitmentLeaves(commitments), j),
+	}, nil
+}
+
+// worker_getKeys []
+func rpcGetWorkerKeys(params []json.RawMessage) (interface{}, *rpcError) {
+	if err := parseParams(params); err != nil {
+		return nil, err
+	}
+	return listWorkerKeys(), nil
+}
+
+// governance_getPolicy [height?], defaults to the next block
+func rpcGetPolicy(params []json.RawMessage) (interface{}, *rpcError) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	height := nextHeight(blockchain)
+	var err *rpcError
+	if len(params) > 0 {
+		err = parseParams(params, &height)
+	} else {
+		err = parseParams(params)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return activePolicy(blockchain, height), nil
+}
+
+// attestation_getRejections [], rejected attestations counted by reason
+func rpcGetRejections(params []json.RawMessage) (interface{}, *rpcError) {
+	if err := parseParams(params); err != nil {
+		return nil, err
+	}
+	return rejectionCounts(), nil
+}
+
+// log_setLevel [level], one of debug, info, warn or error. Returns the level set.
+func rpcSetLogLevel(params []json.RawMessage) (interface{}, *rpcError) {
+	var name string
+	if err := parseParams(params, &name); err != nil {
+		return nil, err
+	}
+	level, err := parseLogLevel(name)
+	if err != nil {
+		return nil, &rpcError{Code: RPC_INVALID_PARAMS, Message: err.Error()}
+	}
+	logLevel.Set(level)
+	httpLog.Info("Log level changed", "level", level)
+	return level.String(), nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	SNAPSHOT_VERSION  = 5
+	SNAPSHOT_INTERVAL = 100
+	SNAPSHOTS_KEPT    = 3
+)
+
+// State of the chain up to and including Tip. A bootstrapped node starts its chain at the tip
+// of a snapshot and keeps the snapshot as its base, in place of the blocks before the tip.
+type Snapshot struct {
+	Version  int
+	Tip      Block
+	Work     int
+	Balances map[string]int
+	// Hashes of the transactions included up to the tip, sorted, copies of them are rejected later on
+	TxHashes []string
+	// Nonce of the last included transfer of each account
+	Nonces map[string]uint64
+	// Result commitments up to the tip, keyed by job and worker key, with the index of the block committing them
+	Committed map[string]int
+	// Governance transactions included up to the tip, needed to know the measurements accepted later on
+	Governance []GovernanceRecord
+	// SHA256 of the snapshot's json encoding without the hash
+	Hash string `json:",omitempty"`
+}
+
+type GovernanceRecord struct {
+	Block int
+	Tx    Tx
+}
+
+// Base of a chain bootstrapped from a snapshot, nil for nodes that synced from genesis
+var base *Snapshot
+
+// Height of the last snapshot taken by this node
+var lastSnapshot int
+
+var errCheckpoint = errors.New("snapshot does not match the checkpoint")
+
+func snapshotDir() string {
+	return filepath.Join(filepath.Dir(chainFile()), "snapshots")
+}
+
+func baseFile() string {
+	return filepath.Join(filepath.Dir(chainFile()), "base.json")
+}
+
+// Whether chain starts at the tip of the base snapshot rather than at genesis
+func based(chain Blockchain) bool {
+	return base != nil && len(chain) > 0 && chain[0].Hash == base.Tip.Hash
+}
+
+// Index of the block following the chain's tip
+func nextHeight(chain Blockchain) int {
+	return chain[len(chain)-1].Index + 1
+}
+
+func (s Snapshot) contentHash() string {
+	s.Hash = ""
+	encoded, err := json.Marshal(s)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
+
+func takeSnapshot(chain Blockchain) Snapshot {
+	state := replayTxs(chain, nil)
+	hashes := make([]string, 0, len(state.Seen))
+	for hash := range state.Seen {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	s := Snapshot{
+		Version:    SNAPSHOT_VERSION,
+		Tip:        chain[len(chain)-1],
+		Work:       calculateWork(chain),
+		Balances:   state.Balances,
+		TxHashes:   hashes,
+		Nonces:     state.Nonces,
+		Committed:  state.Committed,
+		Governance: state.Governance,
+	}
+	s.Hash = s.contentHash()
+	return s
+}
+
+// Part of a received chain from the base snapshot's tip on. A bootstrapped node trusts its checkpoint,
+// chains that don't contain the tip are rejected.
+func fromBase(chain Blockchain) (Blockchain, bool) {
+	if base == nil {
+		return chain, true
+	}
+	for i, block := range chain {
+		if block.Index == base.Tip.Index {
+			return chain[i:], block.Hash == base.Tip.Hash
+		}
+	}
+	return nil, false
+}
+
+// A node bootstrapped from a snapshot sends its chain from the snapshot's tip on. If that block is part of
+// current, the received chain continues current from there and is completed with the blocks before it.
+func anchorChain(current Blockchain, received Blockchain) Blockchain {
+	if len(current) == 0 || len(received) == 0 {
+		return received
+	}
+	i := received[0].Index - current[0].Index
+	if i <= 0 || i >= len(current) || !sameBlock(current[i], received[0]) {
+		return received
+	}
+	return append(current[:i:i], received...)
+}
+
+// Snapshots the chain whenever it passes a multiple of SNAPSHOT_INTERVAL, every node snapshots the same heights
+func maybeSnapshot(chain Blockchain) {
+	tip := chain[len(chain)-1].Index
+	height := tip - tip%SNAPSHOT_INTERVAL
+	if height == 0 || height <= lastSnapshot || height < chain[0].Index {
+		return
+	}
+	s := takeSnapshot(chain[:height-chain[0].Index+1])
+	if err := writeSnapshot(s); err != nil {
+		chainLog.Error("Writing snapshot failed", err, "height", height)
+		return
+	}
+	lastSnapshot = height
+	chainLog.Info("Snapshot written", "height", height, "hash", s.Hash)
+}
+
+func writeSnapshot(s Snapshot) error {
+	dir := snapshotDir()
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	bytes, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("snapshot-%08d.json", s.Tip.Index)), bytes, 0644); err != nil {
+		return err
+	}
+
+	files, err := snapshotFiles()
+	if err != nil {
+		return err
+	}
+	for len(files) > SNAPSHOTS_KEPT {
+		os.Remove(files[0])
+		files = files[1:]
+	}
+	return nil
+}
+
+// Snapshot files, oldest first
+func snapshotFiles() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(snapshotDir(), "snapshot-*.json"))
+	sort.Strings(files)
+	return files, err
+}
+
+func latestSnapshot() (Snapshot, error) {
+	files, err := snapshotFiles()
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if len(files) == 0 {
+		return Snapshot{}, os.ErrNotExist
+	}
+	return readSnapshot(files[len(files)-1])
+}
+
+func readSnapshot(path string) (Snapshot, error) {
+	var s Snapshot
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal(content, &s)
+	return s, err
+}
+
+// Starts a new chain from a snapshot matching the checkpoint hash, the node then syncs forward from its tip.
+// Does nothing if the node already has a chain.
+func bootstrap(path string, checkpoint string) error {
+	if _, err := os.Stat(chainFile()); err == nil {
+		chainLog.Info("Chain already exists, not bootstrapping", "snapshot", path)
+		return nil
+	}
+	if checkpoint == "" {
+		return errors.New("bootstrapping from a snapshot requires a checkpoint hash")
+	}
+	s, err := readSnapshot(path)
+	if err != nil {
+		return err
+	}
+	if s.Version != SNAPSHOT_VERSION {
+		return fmt.Errorf("unsupported snapshot version %d", s.Version)
+	}
+	if s.Hash != checkpoint || s.contentHash() != s.Hash {
+		return errCheckpoint
+	}
+	if calculateHash(s.Tip) != s.Tip.Hash {
+		return errBlockHash
+	}
+
+	if err := os.MkdirAll(filepath.Dir(chainFile()), os.ModePerm); err != nil {
+		return err
+	}
+	bytes, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(baseFile(), bytes, 0644); err != nil {
+		return err
+	}
+	bytes, err = json.MarshalIndent(Blockchain{s.Tip}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(chainFile(), bytes, 0644); err != nil {
+		return err
+	}
+	chainLog.Info("Bootstrapped from snapshot", "hash", s.Hash, "height", s.Tip.Index)
+	return nil
+}
+
+// Loads the base snapshot of a chain that doesn't start at genesis
+func loadBase(chain Blockchain) error {
+	return loadBaseFile(chain, baseFile())
+}
+
+// Like loadBase, with the snapshot read from path
+func loadBaseFile(chain Blockchain, path string) error {
+	if chain[0].Index == 0 {
+		return nil
+	}
+	s, err := readSnapshot(path)
+	if err != nil {
+		return err
+	}
+	if s.Tip.Hash != chain[0].Hash {
+		return fmt.Errorf("chain starts at block %d but the base snapshot ends at block %d", chain[0].Index, s.Tip.Index)
+	}
+	base = &s
+	lastSnapshot = s.Tip.Index
+	return nil
+}